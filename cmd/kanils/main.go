@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/json"
 	"fmt"
 
 	"io"
@@ -9,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"math"
 	"math/rand"
 
 	"github.com/dustin/go-humanize"
@@ -16,7 +18,9 @@ import (
 	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
 	"github.com/thesues/cannyls-go/storage"
+	"github.com/thesues/cannyls-go/storage/journal"
 	"github.com/urfave/cli"
 )
 
@@ -25,7 +29,8 @@ func createCannyls(c *cli.Context) error {
 	capactiyBytes := c.Uint64("capacity")
 	capactiyBytes = block.Min().CeilAlign(capactiyBytes)
 	fmt.Printf("Creating cannyls <%s>, capacity is <%d>\n", path, capactiyBytes)
-	store, err := storage.CreateCannylsStorage(path, capactiyBytes, 0.1)
+	store, err := storage.CreateCannylsStorageWithOptions(path, capactiyBytes, 0.1,
+		storage.Options{JournalPath: c.String("journal")})
 	if err != nil {
 		fmt.Printf("%+v\n", err)
 		return err
@@ -39,8 +44,16 @@ func printHeader(header nvm.StorageHeader) {
 	fmt.Printf("UUID  %v\n", header.UUID)
 	fmt.Printf("Block Size %d \n", header.BlockSize.AsU16())
 	fmt.Printf("Version %d %d \n", header.MajorVersion, header.MinorVersion)
+	if header.Checksummed() {
+		fmt.Printf("Sequence %d\n", header.Sequence)
+	}
 	fmt.Printf("Journal Region Size %d, for short %s\n", header.JournalRegionSize, humanize.Bytes(header.JournalRegionSize))
 	fmt.Printf("Data    Region Size %d, for short %s\n", header.DataRegionSize, humanize.Bytes(header.DataRegionSize))
+	if header.HasExternalJournal() {
+		fmt.Printf("External Journal UUID %v\n", header.JournalUUID)
+	} else if header.IsJournalFile() {
+		fmt.Println("Journal File")
+	}
 }
 
 func printUsage(usage storage.StorageUsage) {
@@ -50,6 +63,8 @@ func printUsage(usage storage.StorageUsage) {
 	fmt.Printf("data Free Bytes %s \n", humanize.Bytes(usage.DataFreeBytes))
 	fmt.Printf("journal capacity %s \n", humanize.Bytes(usage.JournalCapacity))
 	fmt.Printf("journal Usage Bytes %s \n", humanize.Bytes(usage.JournalUsageBytes))
+	fmt.Printf("free portions %d, largest %s, fragmentation %.2f\n", usage.FreePortions,
+		humanize.Bytes(usage.MaxSegmentSize), usage.Fragmentation)
 
 }
 
@@ -67,22 +82,37 @@ func expandDataRegionSize(c *cli.Context) (err error) {
 	}
 	fmt.Printf("setting new size to %d\n", newSize)
 	header.DataRegionSize = newSize
+	//the header is updated A/B, a torn write leaves the other copy
+	return nvm.WriteHeader(fileNVM, header)
+}
 
-	headBuf := new(bytes.Buffer)
-	if err = header.WriteHeaderRegionTo(headBuf); err != nil {
+func resizeJournalCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	size := c.Uint64("size")
+	store, err := storage.OpenCannylsStorageWithOptions(path, storage.Options{JournalPath: c.String("journal")})
+	if err != nil {
 		return err
 	}
+	defer store.Close()
 
-	alignedBufHead := block.FromBytes(headBuf.Bytes(), fileNVM.BlockSize())
-	alignedBufHead.Align()
-	//now headBuf's len should be at least 512
-	if _, err = fileNVM.Seek(0, io.SeekStart); err != nil {
-		return err
-	}
-	if _, err = fileNVM.Write(alignedBufHead.AsBytes()); err != nil {
+	fmt.Printf("resizing journal region to %d\n", size)
+	if err = store.ResizeJournal(size); err != nil {
+		fmt.Printf("%+v\n", err)
 		return err
 	}
-	return nil
+	printHeader(store.Header())
+	printUsage(store.Usage())
+	return
+}
+
+//inspection commands open the storage read-only unless --rw is given,
+//so they could run while readup is serving the storage
+func openForInspection(c *cli.Context) (*storage.Storage, error) {
+	path := c.String("storage")
+	return storage.OpenCannylsStorageWithOptions(path, storage.Options{
+		ReadOnly:    !c.Bool("rw"),
+		JournalPath: c.String("journal"),
+	})
 }
 
 func headerCannyls(c *cli.Context) (err error) {
@@ -92,16 +122,15 @@ func headerCannyls(c *cli.Context) (err error) {
 	fmt.Println(replay)
 	//do not restore index
 	if replay == false {
-		fileNVM, header, err := nvm.Open(path)
+		header, err := nvm.ReadHeaderFromPath(path)
 		if err != nil {
 			return err
 		}
-		fileNVM.Close()
 		printHeader(*header)
 		return err
 	}
 
-	store, err := storage.OpenCannylsStorage(path)
+	store, err := openForInspection(c)
 	if err != nil {
 		return err
 	}
@@ -132,23 +161,18 @@ func deleteCannyls(c *cli.Context) (err error) {
 }
 
 func dumpCannyls(c *cli.Context) (err error) {
-	path := c.String("storage")
-	store, err := storage.OpenCannylsStorage(path)
+	store, err := openForInspection(c)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	ids := store.List()
-	for _, id := range ids {
-		d, err := store.Get(id)
-		if err != nil {
-			break
-		}
-
-		fmt.Printf("%s :%s\n", id.String(), string(d))
+	it := store.Iter(lump.FromU64(0, 0), lump.FromU64(0, math.MaxUint64), storage.IterOptions{Prefetch: true})
+	for it.Next() {
+		info := it.Lump()
+		fmt.Printf("%s :%s\n", info.Id.String(), string(info.Data))
 	}
-	return
+	return it.Err()
 }
 
 func journalGCCannyls(c *cli.Context) (err error) {
@@ -159,14 +183,15 @@ func journalGCCannyls(c *cli.Context) (err error) {
 	}
 	defer store.Close()
 
-	store.JournalGC()
+	if err = store.JournalGC(); err != nil {
+		return err
+	}
 	fmt.Println("Journal Full GC completed")
 	return
 }
 
 func journalCannyls(c *cli.Context) (err error) {
-	path := c.String("storage")
-	store, err := storage.OpenCannylsStorage(path)
+	store, err := openForInspection(c)
 	if err != nil {
 		return err
 	}
@@ -183,6 +208,165 @@ func journalCannyls(c *cli.Context) (err error) {
 	return
 }
 
+type dumpPortion struct {
+	Start uint64 `json:"start"`
+	Len   uint16 `json:"len"`
+}
+
+//journalDumpRecord is a journal record printed by JournalDump
+type journalDumpRecord struct {
+	Position uint64 `json:"position"`
+	Tag      string `json:"tag"`
+	//LumpID is the start of a delete_range record, End is its end
+	LumpID     string       `json:"lumpid"`
+	End        string       `json:"end,omitempty"`
+	Portion    *dumpPortion `json:"portion,omitempty"`
+	EmbedLen   *int         `json:"embedlen,omitempty"`
+	Version    uint64       `json:"version,omitempty"`
+	Checksum   string       `json:"checksum"`
+	ChecksumOK bool         `json:"checksumok"`
+	Garbage    bool         `json:"garbage"`
+}
+
+func newJournalDumpRecord(entry journal.DumpEntry) journalDumpRecord {
+	dump := journalDumpRecord{
+		Position:   entry.Position,
+		Tag:        journal.TagName(entry.Record.Tag()),
+		Checksum:   entry.Checksum.Format.String(),
+		ChecksumOK: entry.Checksum.Valid(),
+		Garbage:    entry.Garbage,
+	}
+	setPortion := func(id lump.LumpId, p portion.DataPortion) {
+		dump.LumpID = id.String()
+		dump.Portion = &dumpPortion{Start: p.Start.AsU64(), Len: p.Len}
+	}
+	switch record := entry.Record.(type) {
+	case journal.PutRecord:
+		setPortion(record.LumpID, record.DataPortion)
+	case journal.PutWithMetaRecord:
+		setPortion(record.LumpID, record.DataPortion)
+	case journal.PutVersionRecord:
+		setPortion(record.LumpID, record.DataPortion)
+		dump.Version = record.Version
+	case journal.EmbedRecord:
+		dump.LumpID = record.LumpID.String()
+		embedLen := len(record.Data)
+		dump.EmbedLen = &embedLen
+	case journal.EmbedVersionRecord:
+		dump.LumpID = record.LumpID.String()
+		embedLen := len(record.Data)
+		dump.EmbedLen = &embedLen
+		dump.Version = record.Version
+	case journal.DeleteRecord:
+		dump.LumpID = record.LumpID.String()
+	case journal.DeleteRange:
+		dump.LumpID = record.Start.String()
+		dump.End = record.End.String()
+	}
+	return dump
+}
+
+//parseTags returns the set of the tag names in the comma separated list, nil for all the tags
+func parseTags(list string) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for tag := journal.TAG_PUT; tag <= journal.TAG_EMBED_VERSION; tag++ {
+		known[journal.TagName(tag)] = true
+	}
+	tags := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, errors.Errorf("unknown record tag %q", name)
+		}
+		tags[name] = true
+	}
+	return tags, nil
+}
+
+func journalDumpCannyls(c *cli.Context) (err error) {
+	format := c.String("format")
+	if format != "json" && format != "table" {
+		return errors.Errorf("unknown format %q, it is json or table", format)
+	}
+	tags, err := parseTags(c.String("tag"))
+	if err != nil {
+		return err
+	}
+	store, err := openForInspection(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	encoder := json.NewEncoder(out)
+	if format == "table" {
+		fmt.Fprintf(out, "%-12s %-14s %-18s %-28s %-8s %-5s %s\n",
+			"POSITION", "TAG", "LUMPID", "DETAIL", "CHECKSUM", "VALID", "GARBAGE")
+	}
+	return store.JournalDump(c.Int64("from"), func(entry journal.DumpEntry) error {
+		dump := newJournalDumpRecord(entry)
+		if tags != nil && !tags[dump.Tag] {
+			return nil
+		}
+		if format == "json" {
+			return encoder.Encode(dump)
+		}
+		var detail string
+		switch {
+		case dump.Portion != nil:
+			detail = fmt.Sprintf("start=%d len=%d", dump.Portion.Start, dump.Portion.Len)
+		case dump.EmbedLen != nil:
+			detail = fmt.Sprintf("embed len=%d", *dump.EmbedLen)
+		case dump.End != "":
+			detail = "end=" + dump.End
+		}
+		_, err := fmt.Fprintf(out, "%-12d %-14s %-18s %-28s %-8s %-5v %v\n",
+			dump.Position, dump.Tag, dump.LumpID, detail, dump.Checksum, dump.ChecksumOK, dump.Garbage)
+		return err
+	})
+}
+
+func pointInTimeCannyls(c *cli.Context) (err error) {
+	store, err := openForInspection(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	view, err := store.PointInTime(c.Int64("position"), c.Int64("records"))
+	if err != nil {
+		return err
+	}
+	defer view.Close()
+	fmt.Printf("position %d, %d records replayed, %d lumps\n", view.Position(), view.Records(), view.Count())
+
+	if c.IsSet("key") {
+		data, err := view.Get(lump.FromU64(0, c.Uint64("key")))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", string(data))
+		return nil
+	}
+	for _, id := range view.List() {
+		available, err := view.Available(id)
+		if err != nil {
+			return err
+		}
+		status := "available"
+		if !available {
+			status = "unavailable"
+		}
+		fmt.Printf("%s %s\n", id.String(), status)
+	}
+	return nil
+}
+
 func wbenchCannyls(c *cli.Context) (err error) {
 	return benchCannyls(c, 1, false)
 }
@@ -254,7 +438,9 @@ func benchCannyls(c *cli.Context, ratio float64, read bool) (err error) {
 		}
 
 		if sync {
-			store.Sync()
+			if err = store.Sync(); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -280,8 +466,7 @@ func createCannylsForBench(c *cli.Context, ratio float64) (store *storage.Storag
 }
 
 func getCannyls(c *cli.Context) (err error) {
-	path := c.String("storage")
-	store, err := storage.OpenCannylsStorage(path)
+	store, err := openForInspection(c)
 	if err != nil {
 		return err
 	}
@@ -345,6 +530,115 @@ func putCannyls(c *cli.Context) (err error) {
 	return
 }
 
+func restoreCannyls(c *cli.Context) (err error) {
+	backup := c.String("backup")
+	target := c.String("target")
+	if backup == "" || target == "" {
+		return errors.New("--backup and --target are required")
+	}
+	if c.NArg() > 0 {
+		return errors.New("only one full backup is restored, incremental backup chains are not supported")
+	}
+
+	var opts storage.RestoreOptions
+	//the backup must come from the source storage
+	if source := c.String("source"); source != "" {
+		header, err := nvm.ReadHeaderFromPath(source)
+		if err != nil {
+			return err
+		}
+		opts.SourceUUID = header.UUID
+	}
+
+	if err = storage.RestoreBackup(backup, target, opts); err != nil {
+		fmt.Printf("%+v\n", err)
+		return err
+	}
+	fmt.Printf("%s is restored to %s\n", backup, target)
+	return nil
+}
+
+func verifyBackupCannyls(c *cli.Context) (err error) {
+	backup := c.String("backup")
+	report, err := storage.VerifyBackup(backup)
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return err
+	}
+	printHeader(report.Header)
+	fmt.Printf("Lumps: %d, Bytes: %s\n", report.Lumps, humanize.Bytes(report.Bytes))
+	for _, id := range report.Corrupted {
+		fmt.Printf("lump %s is corrupted\n", id.String())
+	}
+	if !report.OK() {
+		return errors.Errorf("%d lumps are corrupted", len(report.Corrupted))
+	}
+	return nil
+}
+
+func exportCannyls(c *cli.Context) (err error) {
+	output := c.String("output")
+	store, err := openForInspection(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if output != "" && output != "-" {
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	start := time.Now()
+	stats, err := store.Export(w)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d lumps (%d embedded), %s in %v\n",
+		stats.Lumps, stats.Embedded, humanize.Bytes(stats.Bytes), time.Since(start))
+	return nil
+}
+
+func importCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	input := c.String("input")
+	store, err := storage.OpenCannylsStorage(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var r io.Reader = os.Stdin
+	if input != "" && input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	opts := storage.ImportOptions{
+		Workers:      c.Int("workers"),
+		ProgressFile: c.String("progress"),
+	}
+	start := time.Now()
+	stats, err := store.Import(r, opts)
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return err
+	}
+	fmt.Printf("imported %d lumps (%d embedded), %s in %v, skipped %d\n",
+		stats.Lumps, stats.Embedded, humanize.Bytes(stats.Bytes), time.Since(start), stats.Skipped)
+	return nil
+}
+
 func readUpData(r io.Reader, lumpdata lump.LumpData) error {
 	s := lumpdata.AsBytes()
 	for {
@@ -367,10 +661,11 @@ func main() {
 	app.Commands = []cli.Command{
 		{
 			Name:  "Create",
-			Usage: "Create --storage <path> --capacity <size>",
+			Usage: "Create --storage <path> --capacity <size> [--journal <path>]",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "storage"},
 				cli.Uint64Flag{Name: "capacity"},
+				cli.StringFlag{Name: "journal", Usage: "put the journal region in another file"},
 			},
 			Action: createCannyls,
 		},
@@ -386,18 +681,22 @@ func main() {
 		},
 		{
 			Name:  "Get",
-			Usage: "Get --storage path --key key",
+			Usage: "Get --storage path --key key [--rw]",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "storage"},
+				cli.BoolFlag{Name: "rw", Usage: "open the storage read-write"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
 				cli.Uint64Flag{Name: "key"},
 			},
 			Action: getCannyls,
 		},
 		{
 			Name:  "Dump",
-			Usage: "Dump --storage path",
+			Usage: "Dump --storage path [--rw]",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "storage"},
+				cli.BoolFlag{Name: "rw", Usage: "open the storage read-write"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
 			},
 			Action: dumpCannyls,
 		},
@@ -412,12 +711,40 @@ func main() {
 		},
 		{
 			Name:  "Journal",
-			Usage: "Journal --storage path",
+			Usage: "Journal --storage path [--rw]",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "storage"},
+				cli.BoolFlag{Name: "rw", Usage: "open the storage read-write"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
 			},
 			Action: journalCannyls,
 		},
+		{
+			Name:  "JournalDump",
+			Usage: "JournalDump --storage path [--format json|table] [--from pos] [--tag put,delete]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.BoolFlag{Name: "rw", Usage: "open the storage read-write"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
+				cli.StringFlag{Name: "format", Value: "table", Usage: "json prints one record per line"},
+				cli.Int64Flag{Name: "from", Value: -1, Usage: "position of the first record, the unreleased head by default"},
+				cli.StringFlag{Name: "tag", Usage: "comma separated record tags to print, all of them by default"},
+			},
+			Action: journalDumpCannyls,
+		},
+		{
+			Name:  "PointInTime",
+			Usage: "PointInTime --storage path [--position pos | --records n] [--key key]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.BoolFlag{Name: "rw", Usage: "open the storage read-write"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
+				cli.Int64Flag{Name: "position", Value: -1, Usage: "replay the journal up to the record at this position"},
+				cli.Int64Flag{Name: "records", Usage: "replay this count of records"},
+				cli.Uint64Flag{Name: "key", Usage: "print the lump instead of listing the lumps"},
+			},
+			Action: pointInTimeCannyls,
+		},
 		{
 			Name:  "JournalGC",
 			Usage: "JournalGC --storage path",
@@ -431,6 +758,8 @@ func main() {
 			Usage: "Header --storage path --replay <true> ",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "storage"},
+				cli.BoolFlag{Name: "rw", Usage: "open the storage read-write"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
 				cli.BoolFlag{Name: "replay"},
 			},
 			Action: headerCannyls,
@@ -468,6 +797,56 @@ func main() {
 			},
 			Action: expandDataRegionSize,
 		},
+		{
+			Name:  "ResizeJournal",
+			Usage: "ResizeJournal --storage <path> --size <bytes> [--journal <path>]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.Uint64Flag{Name: "size"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
+			},
+			Action: resizeJournalCannyls,
+		},
+		{
+			Name:  "Restore",
+			Usage: "Restore --backup <file> --target <path> [--source <path>], the backup is one full backup, incremental chains are not supported",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "backup"},
+				cli.StringFlag{Name: "target"},
+				cli.StringFlag{Name: "source"},
+			},
+			Action: restoreCannyls,
+		},
+		{
+			Name:  "VerifyBackup",
+			Usage: "VerifyBackup --backup <file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "backup"},
+			},
+			Action: verifyBackupCannyls,
+		},
+		{
+			Name:  "Export",
+			Usage: "Export --storage <path> --output <file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.BoolFlag{Name: "rw", Usage: "open the storage read-write"},
+				cli.StringFlag{Name: "journal", Usage: "the external journal of the storage"},
+				cli.StringFlag{Name: "output", Value: "-"},
+			},
+			Action: exportCannyls,
+		},
+		{
+			Name:  "Import",
+			Usage: "Import --storage <path> --input <file> [--workers 4] [--progress <file>]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.StringFlag{Name: "input", Value: "-"},
+				cli.IntFlag{Name: "workers", Value: 4},
+				cli.StringFlag{Name: "progress"},
+			},
+			Action: importCannyls,
+		},
 	}
 	err := app.Run(os.Args)
 	if err != nil {
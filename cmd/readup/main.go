@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"io"
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
@@ -20,9 +21,11 @@ import (
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-contrib/static"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/logger"
 	"github.com/thesues/cannyls-go/lump"
 	x "github.com/thesues/cannyls-go/metrics"
 	"github.com/thesues/cannyls-go/storage"
+	"github.com/thesues/cannyls-go/storage/journal"
 	"github.com/thesues/cannyls-go/util"
 	"github.com/urfave/cli"
 )
@@ -42,6 +45,7 @@ var backupRuning bool = false
 type PutRequest struct {
 	ctx        context.Context
 	data       lump.LumpData
+	meta       lump.LumpMeta
 	id         uint64
 	isAutoId   bool
 	resultChan chan PutResult
@@ -103,8 +107,25 @@ func handlePutRequest(store *storage.Storage, request PutRequest) {
 }
 */
 
-func ServeStore(store *storage.Storage) {
-	fmt.Printf("start http server\n")
+//setMetaHeader returns the lump meta as http headers
+func setMetaHeader(c *gin.Context, meta lump.LumpMeta) {
+	if meta.ContentType != "" {
+		c.Header("Content-Type", meta.ContentType)
+	}
+	if !meta.Created.IsZero() {
+		c.Header("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+	}
+	if meta.Owner != "" {
+		c.Header("X-Owner", meta.Owner)
+	}
+}
+
+func ServeStore(store *storage.Storage, log logger.Logger) {
+	log.Infof("start http server")
+
+	store.OnFatalError(func(err error) {
+		log.Errorf("storage failed, all requests will fail: %+v", err)
+	})
 
 	reqeustChan := make(chan PutRequest, 20)
 
@@ -131,9 +152,8 @@ func ServeStore(store *storage.Storage) {
 
 				var results []PutResult
 
-				fmt.Printf("len of slurp is %d\n", len(requests))
 				for _, req := range requests {
-					_, span := trace.StartSpan(req.ctx, "write cannyls")
+					putCtx, span := trace.StartSpan(req.ctx, "write cannyls")
 					var id lump.LumpId = lump.FromU64(0, req.id)
 					var have bool
 					if req.isAutoId {
@@ -151,7 +171,7 @@ func ServeStore(store *storage.Storage) {
 							_, err = store.PutEmbed(id, req.data.Inner.AsBytes())
 						} else {
 					*/
-					_, err = store.Put(id, req.data)
+					_, err = store.PutWithMetaContext(putCtx, id, req.data, req.meta)
 					//}
 					span.Annotate(nil, "Cannyls: put data done")
 					span.End()
@@ -165,22 +185,30 @@ func ServeStore(store *storage.Storage) {
 				}
 
 				var spans []*trace.Span
-				for _, req := range requests {
+				syncCtx := context.Background()
+				for i, req := range requests {
 					_, span := trace.StartSpan(req.ctx, "sync")
 					spans = append(spans, span)
+					//the engine's spans of the shared sync go under the first request,
+					//but the sync is not cancelled with it
+					if i == 0 {
+						syncCtx = trace.NewContext(syncCtx, span)
+					}
 				}
 
 				//store.Flush()
-				store.Sync()
+				syncErr := store.SyncContext(syncCtx)
 				for i := range spans {
 					spans[i].End()
 				}
 				for _, result := range results {
+					//the puts are not durable if the sync failed
+					if result.err == nil && syncErr != nil {
+						result.err = syncErr
+					}
 					result.resultChan <- result
 				}
 
-			case <-time.After(3 * time.Second):
-				store.RunSideJobOnce(64)
 			}
 		}
 	})
@@ -242,8 +270,14 @@ func ServeStore(store *storage.Storage) {
 			c.String(500, err.Error())
 			return
 		}
+		meta, err := store.GetMeta(lump.FromU64(0, id))
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
 		c.Status(200)
 		c.Header("content-length", fmt.Sprintf("%d", len(data)))
+		setMetaHeader(c, meta)
 		c.Stream(func(w io.Writer) bool {
 			_, err := w.Write(data)
 			if err != nil {
@@ -356,12 +390,27 @@ func ServeStore(store *storage.Storage) {
 
 		//ctx := context.Background()
 
+		meta := lump.LumpMeta{
+			ContentType: header.Header.Get("Content-Type"),
+			Created:     time.Now(),
+			Owner:       c.PostForm("owner"),
+		}
+		if ttl := c.PostForm("ttl"); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil || d <= 0 {
+				c.String(400, "invalid ttl")
+				return
+			}
+			meta.ExpireAt = meta.Created.Add(d)
+		}
+
 		ctx, span := trace.StartSpan(context.Background(), "PutRequest")
 		defer span.End()
 		span.Annotate(nil, "HTTP START")
 		request := PutRequest{
 			ctx:        ctx,
 			data:       ab,
+			meta:       meta,
 			id:         uint64(id),
 			isAutoId:   isAutoId,
 			resultChan: make(chan PutResult),
@@ -450,12 +499,19 @@ func main() {
 	*/
 	app.Action = func(c *cli.Context) {
 		storagePath := c.String("storage")
-		store, err := storage.OpenCannylsStorage(storagePath)
+		stdLog := logger.NewStdLogger(log.New(os.Stderr, "cannyls ", log.LstdFlags), logger.InfoLevel)
+		x.SetLogger(stdLog)
+		store, err := storage.OpenCannylsStorageWithOptions(storagePath, storage.Options{
+			Logger: stdLog,
+			//GC runs when no put comes for 3 seconds
+			GCPolicy:     journal.IdleOnlyGCPolicy{IdleAfter: 3 * time.Second},
+			BackgroundGC: time.Second,
+		})
 		if err != nil {
 			fmt.Printf("failed to open %+v", err)
 			return
 		}
-		ServeStore(store)
+		ServeStore(store, stdLog)
 	}
 
 	err := app.Run(os.Args)
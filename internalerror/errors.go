@@ -4,6 +4,9 @@ import (
 	"errors"
 )
 
+//Errors returned by the storage are these sentinels, optionally wrapped with
+//context by github.com/pkg/errors or the storage's LumpError/OffsetError. Test
+//them with errors.Is (or errors.Cause) instead of comparing err directly
 var (
 	DeviceBusy         = errors.New("Device is busy")
 	DeviceTerminated   = errors.New("Device is terminated")
@@ -15,4 +18,10 @@ var (
 	Other              = errors.New("Unknow error")
 	NoEntries          = errors.New("NoEntries")
 	StorageClosed      = errors.New("Stroage Closed")
+	StorageReadOnly    = errors.New("Storage is read-only")
+	LumpNotFound       = errors.New("Lump not found")
+	NotSupported       = errors.New("Operation not supported")
+	VersionConflict    = errors.New("Version conflict")
+	QuotaExceeded      = errors.New("Quota exceeded")
+	DataUnavailable    = errors.New("Data is unavailable")
 )
@@ -0,0 +1,115 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+)
+
+//Logger receives the leveled messages of cannyls. zap's SugaredLogger and logrus'
+//Logger/Entry implement it as they are, so they could be passed in directly
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (level Level) String() string {
+	switch level {
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	case ErrorLevel:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+//Nop discards all messages, it is the default logger
+func Nop() Logger {
+	return nopLogger{}
+}
+
+//OrNop returns l, or Nop if l is nil
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return Nop()
+	}
+	return l
+}
+
+//StdLogger writes the messages at or above the level to a standard library logger
+type StdLogger struct {
+	out   *log.Logger
+	level Level
+}
+
+func NewStdLogger(out *log.Logger, level Level) *StdLogger {
+	return &StdLogger{
+		out:   out,
+		level: level,
+	}
+}
+
+func (l *StdLogger) output(level Level, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.out.Output(3, level.String()+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *StdLogger) Debugf(format string, args ...interface{}) {
+	l.output(DebugLevel, format, args...)
+}
+
+func (l *StdLogger) Infof(format string, args ...interface{}) {
+	l.output(InfoLevel, format, args...)
+}
+
+func (l *StdLogger) Warnf(format string, args ...interface{}) {
+	l.output(WarnLevel, format, args...)
+}
+
+func (l *StdLogger) Errorf(format string, args ...interface{}) {
+	l.output(ErrorLevel, format, args...)
+}
+
+//FuncLogger adapts a logging API which takes the level as an argument,
+//e.g. func(level Level, msg string) { zapLogger.Log(...) }
+type FuncLogger func(level Level, msg string)
+
+func (f FuncLogger) Debugf(format string, args ...interface{}) {
+	f(DebugLevel, fmt.Sprintf(format, args...))
+}
+
+func (f FuncLogger) Infof(format string, args ...interface{}) {
+	f(InfoLevel, fmt.Sprintf(format, args...))
+}
+
+func (f FuncLogger) Warnf(format string, args ...interface{}) {
+	f(WarnLevel, fmt.Sprintf(format, args...))
+}
+
+func (f FuncLogger) Errorf(format string, args ...interface{}) {
+	f(ErrorLevel, fmt.Sprintf(format, args...))
+}
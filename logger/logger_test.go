@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), InfoLevel)
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Errorf("error %d", 3)
+	assert.Equal(t, "INFO info 2\nERROR error 3\n", buf.String())
+}
+
+func TestFuncLogger(t *testing.T) {
+	var levels []Level
+	var msgs []string
+	var l Logger = FuncLogger(func(level Level, msg string) {
+		levels = append(levels, level)
+		msgs = append(msgs, msg)
+	})
+	l.Warnf("disk %s", "slow")
+	l.Debugf("gc")
+	assert.Equal(t, []Level{WarnLevel, DebugLevel}, levels)
+	assert.Equal(t, []string{"disk slow", "gc"}, msgs)
+}
+
+func TestNop(t *testing.T) {
+	assert.Equal(t, Nop(), OrNop(nil))
+	Nop().Errorf("nothing %d", 1)
+}
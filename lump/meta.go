@@ -0,0 +1,100 @@
+package lump
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+const (
+	MAX_META_SIZE      = 1024
+	MAX_META_FIELD_LEN = 0xFF
+)
+
+//the tags of encoded meta fields
+const (
+	META_CONTENT_TYPE byte = 1
+	META_CREATED      byte = 2
+	META_OWNER        byte = 3
+	META_EXPIRE_AT    byte = 4
+)
+
+//LumpMeta is small user metadata kept with a lump,
+//empty fields are not stored
+type LumpMeta struct {
+	ContentType string
+	Created     time.Time
+	Owner       string
+	//the lump is not found after ExpireAt, zero means never
+	ExpireAt time.Time
+}
+
+func (meta LumpMeta) IsEmpty() bool {
+	return meta.ContentType == "" && meta.Created.IsZero() && meta.Owner == "" && meta.ExpireAt.IsZero()
+}
+
+//Encode writes meta as a list of tag|len|value fields,
+//so a field could be added without breaking the old journal
+func (meta LumpMeta) Encode() ([]byte, error) {
+	if len(meta.ContentType) > MAX_META_FIELD_LEN || len(meta.Owner) > MAX_META_FIELD_LEN {
+		return nil, errors.Wrap(internalerror.InvalidInput, "meta field is too long")
+	}
+	buf := make([]byte, 0, 2*4+len(meta.ContentType)+len(meta.Owner)+16)
+	if meta.ContentType != "" {
+		buf = append(buf, META_CONTENT_TYPE, byte(len(meta.ContentType)))
+		buf = append(buf, meta.ContentType...)
+	}
+	if !meta.Created.IsZero() {
+		buf = appendTime(buf, META_CREATED, meta.Created)
+	}
+	if meta.Owner != "" {
+		buf = append(buf, META_OWNER, byte(len(meta.Owner)))
+		buf = append(buf, meta.Owner...)
+	}
+	if !meta.ExpireAt.IsZero() {
+		buf = appendTime(buf, META_EXPIRE_AT, meta.ExpireAt)
+	}
+	return buf, nil
+}
+
+func appendTime(buf []byte, tag byte, t time.Time) []byte {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(t.UnixNano()))
+	buf = append(buf, tag, byte(len(n)))
+	return append(buf, n[:]...)
+}
+
+func readTime(value []byte) (time.Time, error) {
+	if len(value) != 8 {
+		return time.Time{}, errors.Wrap(internalerror.InvalidInput, "meta time is invalid")
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value))), nil
+}
+
+//DecodeLumpMeta parses the output of Encode, unknown fields are skipped
+func DecodeLumpMeta(buf []byte) (meta LumpMeta, err error) {
+	for len(buf) > 0 {
+		if len(buf) < 2 || len(buf) < 2+int(buf[1]) {
+			return LumpMeta{}, errors.Wrap(internalerror.InvalidInput, "meta is truncated")
+		}
+		tag, value := buf[0], buf[2:2+int(buf[1])]
+		switch tag {
+		case META_CONTENT_TYPE:
+			meta.ContentType = string(value)
+		case META_CREATED:
+			if meta.Created, err = readTime(value); err != nil {
+				return LumpMeta{}, err
+			}
+		case META_OWNER:
+			meta.Owner = string(value)
+		case META_EXPIRE_AT:
+			if meta.ExpireAt, err = readTime(value); err != nil {
+				return LumpMeta{}, err
+			}
+		}
+		buf = buf[2+len(value):]
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package lump
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLumpMetaEncode(t *testing.T) {
+	meta := LumpMeta{
+		ContentType: "image/png",
+		Created:     time.Unix(1500000000, 12345),
+		Owner:       "alice",
+		ExpireAt:    time.Unix(1500003600, 0),
+	}
+	buf, err := meta.Encode()
+	assert.Nil(t, err)
+	decoded, err := DecodeLumpMeta(buf)
+	assert.Nil(t, err)
+	assert.True(t, meta.Created.Equal(decoded.Created))
+	assert.Equal(t, meta.ContentType, decoded.ContentType)
+	assert.Equal(t, meta.Owner, decoded.Owner)
+	assert.True(t, meta.ExpireAt.Equal(decoded.ExpireAt))
+
+	//empty fields are not stored
+	buf, err = LumpMeta{Owner: "bob"}.Encode()
+	assert.Nil(t, err)
+	assert.Equal(t, 2+3, len(buf))
+	decoded, err = DecodeLumpMeta(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, LumpMeta{Owner: "bob"}, decoded)
+	assert.True(t, LumpMeta{}.IsEmpty())
+
+	//unknown fields are skipped
+	decoded, err = DecodeLumpMeta(append([]byte{99, 1, 0}, buf...))
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", decoded.Owner)
+
+	_, err = DecodeLumpMeta(buf[:3])
+	assert.Error(t, err)
+	_, err = LumpMeta{Owner: strings.Repeat("x", MAX_META_FIELD_LEN+1)}.Encode()
+	assert.Error(t, err)
+}
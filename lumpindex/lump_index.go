@@ -19,20 +19,32 @@ var _ = fmt.Println
 type LumpIndex struct {
 	tree   judy.JudyL
 	counts uint64
+	//encoded lump.LumpMeta, only lumps put with meta are here
+	meta map[uint64][]byte
+	//expire time in unix nanoseconds, only lumps put with a ttl are here
+	expire map[uint64]int64
+	//generation of the lump, only the ones bigger than 1 are here
+	version map[uint64]uint64
+	//retired is the highest generation of the lumps deleted from the index,
+	//a lump put again after its delete gets a bigger one
+	retired uint64
 }
 
 func NewIndex() *LumpIndex {
 	tree := judy.JudyL{}
 	return &LumpIndex{
-		tree:   tree,
-		counts: 0,
+		tree:    tree,
+		counts:  0,
+		meta:    make(map[uint64][]byte),
+		expire:  make(map[uint64]int64),
+		version: make(map[uint64]uint64),
 	}
 }
 
 func (index *LumpIndex) Get(id lump.LumpId) (p portion.Portion, err error) {
 	v, ok := index.tree.Get(id.U64())
 	if ok == false {
-		return nil, internalerror.InvalidInput
+		return nil, internalerror.LumpNotFound
 	}
 
 	p, _ = fromValueToPortion(v)
@@ -44,6 +56,7 @@ func (index *LumpIndex) InsertDataPortion(id lump.LumpId, data portion.DataPorti
 	n = data.Start.AsU64() | uint64(data.Len)<<40 | 1<<63
 	index.tree.Insert(id.U64(), n)
 	atomic.AddUint64(&index.counts, 1)
+	index.dropExtra(id.U64())
 }
 
 func (index *LumpIndex) InsertJournalPortion(id lump.LumpId, data portion.JournalPortion) {
@@ -51,10 +64,113 @@ func (index *LumpIndex) InsertJournalPortion(id lump.LumpId, data portion.Journa
 	n = data.Start.AsU64() | uint64(data.Len)<<40
 	index.tree.Insert(id.U64(), n)
 	atomic.AddUint64(&index.counts, 1)
+	index.dropExtra(id.U64())
+}
+
+//SetMeta attaches the encoded meta to an existing lump,
+//it is dropped when the lump is deleted or inserted again
+func (index *LumpIndex) SetMeta(id lump.LumpId, meta []byte) {
+	if len(meta) == 0 {
+		delete(index.meta, id.U64())
+		return
+	}
+	index.meta[id.U64()] = meta
+}
+
+//SetExpire sets the time in unix nanoseconds after which id is expired,
+//it is dropped when the lump is deleted or inserted again
+func (index *LumpIndex) SetExpire(id lump.LumpId, at int64) {
+	index.expire[id.U64()] = at
+}
+
+//IsExpired returns true if id is put with a ttl which is before now
+func (index *LumpIndex) IsExpired(id lump.LumpId, now int64) bool {
+	at, ok := index.expire[id.U64()]
+	return ok && at <= now
+}
+
+//Expired returns no more than max lumps which are expired at now
+func (index *LumpIndex) Expired(now int64, max int) []lump.LumpId {
+	var vec []lump.LumpId
+	for id, at := range index.expire {
+		if len(vec) >= max {
+			break
+		}
+		if at <= now {
+			vec = append(vec, lump.FromU64(0, id))
+		}
+	}
+	return vec
+}
+
+//SetVersion sets the generation of an existing lump,
+//it is reset to 1 when the lump is deleted or inserted again, a deleted lump
+//leaves its generation in Retired
+func (index *LumpIndex) SetVersion(id lump.LumpId, version uint64) {
+	if version <= 1 {
+		delete(index.version, id.U64())
+		return
+	}
+	index.version[id.U64()] = version
+}
+
+//Version returns the generation of id, the caller must make sure id exists
+func (index *LumpIndex) Version(id lump.LumpId) uint64 {
+	if v, ok := index.version[id.U64()]; ok {
+		return v
+	}
+	return 1
+}
+
+//Retired returns the highest generation of the lumps deleted from the index
+func (index *LumpIndex) Retired() uint64 {
+	return index.retired
+}
+
+//SetRetired raises Retired to retired, it is restored from the journal header
+func (index *LumpIndex) SetRetired(retired uint64) {
+	if retired > index.retired {
+		index.retired = retired
+	}
+}
+
+//retire keeps the generation of the deleted lump id in retired and drops its extra
+func (index *LumpIndex) retire(id uint64) {
+	version := uint64(1)
+	if v, ok := index.version[id]; ok {
+		version = v
+	}
+	index.SetRetired(version)
+	index.dropExtra(id)
+}
+
+func (index *LumpIndex) dropExtra(id uint64) {
+	delete(index.meta, id)
+	delete(index.expire, id)
+	delete(index.version, id)
+}
+
+//GetMeta returns the encoded meta of id, ok is false if id has no meta
+func (index *LumpIndex) GetMeta(id lump.LumpId) (meta []byte, ok bool) {
+	meta, ok = index.meta[id.U64()]
+	return
 }
 
 func (index *LumpIndex) Delete(id lump.LumpId) bool {
 	atomic.AddUint64(&index.counts, ^uint64(0))
+	if !index.tree.Delete(id.U64()) {
+		index.dropExtra(id.U64())
+		return false
+	}
+	index.retire(id.U64())
+	return true
+}
+
+//Remove is Delete which does not retire the generation of id,
+//it is used for a lump which is put again with a bigger one
+func (index *LumpIndex) Remove(id lump.LumpId) bool {
+	atomic.AddUint64(&index.counts, ^uint64(0))
+	index.dropExtra(id.U64())
 	return index.tree.Delete(id.U64())
 }
 
@@ -63,9 +179,9 @@ func (index *LumpIndex) DeleteRange(start lump.LumpId, end lump.LumpId) {
 	n := 0
 	for ok && indexNum < end.U64() {
 		if rc := index.tree.Delete(indexNum); rc == false {
-			fmt.Printf("index %d\n", indexNum)
-			panic("judy index, delete item when iterating.. should never happen")
+			panic(fmt.Sprintf("judy index, delete item %d when iterating.. should never happen", indexNum))
 		}
+		index.retire(indexNum)
 		indexNum, _, ok = index.tree.Next(indexNum)
 		n += 1
 	}
@@ -93,6 +209,10 @@ func (index *LumpIndex) Max() (id lump.LumpId, ok bool) {
 
 func (index *LumpIndex) Free() {
 	index.tree.Free()
+	index.meta = make(map[uint64][]byte)
+	index.expire = make(map[uint64]int64)
+	index.version = make(map[uint64]uint64)
+	index.retired = 0
 }
 func (index *LumpIndex) FirstEmpty() (id lump.LumpId, ok bool) {
 	ok = false
@@ -170,6 +290,26 @@ func (index *LumpIndex) RangeIter(start lump.LumpId, end lump.LumpId, fn func(lu
 	return nil
 }
 
+//RangeIterReverse is RangeIter from end-1 down to start
+func (index *LumpIndex) RangeIterReverse(start lump.LumpId, end lump.LumpId, fn func(lump.LumpId, portion.Portion) error) error {
+	if end.U64() == 0 {
+		return nil
+	}
+	indexNum, value, ok := index.tree.Last(end.U64() - 1)
+	for ok && indexNum >= start.U64() {
+		portion, _ := fromValueToPortion(value)
+		err := fn(lump.FromU64(0, indexNum), portion)
+		if err != nil {
+			return err
+		}
+		if indexNum == 0 {
+			break
+		}
+		indexNum, value, ok = index.tree.Prev(indexNum)
+	}
+	return nil
+}
+
 func (index *LumpIndex) ListRange(start lump.LumpId, end lump.LumpId, maxSize uint64) []lump.LumpId {
 	vec := make([]lump.LumpId, 0, 1024)
 	indexNum, _, ok := index.tree.First(start.U64())
@@ -8,6 +8,7 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/portion"
 )
@@ -57,7 +58,7 @@ func TestLumpIndexDelete(t *testing.T) {
 	tree.Delete(lumpid("4444"))
 	p, err = tree.Get(lumpid("4444"))
 	assert.Nil(t, p)
-	assert.Error(t, err)
+	assert.Equal(t, internalerror.LumpNotFound, err)
 
 	maxUINT64 := ^uint64(0)
 	fmt.Println(tree.ListRange(lumpid("1111"), lumpid("5555"), maxUINT64))
@@ -99,6 +100,51 @@ func TestLumpIndexRangeDelete(t *testing.T) {
 
 const N int64 = 1000000
 
+func TestLumpIndexMeta(t *testing.T) {
+	tree := NewIndex()
+	data := portion.NewDataPortion(10, 10)
+	for _, id := range []string{"1", "2", "3"} {
+		tree.InsertDataPortion(lumpid(id), data)
+		tree.SetMeta(lumpid(id), []byte(id))
+	}
+	meta, ok := tree.GetMeta(lumpid("1"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), meta)
+
+	//insert again drops the meta
+	tree.InsertDataPortion(lumpid("1"), data)
+	_, ok = tree.GetMeta(lumpid("1"))
+	assert.False(t, ok)
+
+	tree.Delete(lumpid("2"))
+	_, ok = tree.GetMeta(lumpid("2"))
+	assert.False(t, ok)
+
+	tree.DeleteRange(lumpid("0"), lumpid("4"))
+	_, ok = tree.GetMeta(lumpid("3"))
+	assert.False(t, ok)
+}
+
+func TestLumpIndexExpire(t *testing.T) {
+	tree := NewIndex()
+	data := portion.NewDataPortion(10, 10)
+	for i, id := range []string{"1", "2", "3"} {
+		tree.InsertDataPortion(lumpid(id), data)
+		tree.SetExpire(lumpid(id), int64(i*100))
+	}
+	assert.True(t, tree.IsExpired(lumpid("2"), 100))
+	assert.False(t, tree.IsExpired(lumpid("3"), 100))
+	assert.Equal(t, 2, len(tree.Expired(100, 10)))
+	assert.Equal(t, 1, len(tree.Expired(100, 1)))
+
+	//insert again drops the ttl
+	tree.InsertDataPortion(lumpid("1"), data)
+	assert.False(t, tree.IsExpired(lumpid("1"), 100))
+	tree.Delete(lumpid("2"))
+	assert.Equal(t, 0, len(tree.Expired(100, 10)))
+	assert.Equal(t, 1, len(tree.Expired(200, 10)))
+}
+
 func TestSpace(t *testing.T) {
 	var msb, msa runtime.MemStats
 	runtime.ReadMemStats(&msb)
@@ -123,3 +169,56 @@ func lumpid(s string) lump.LumpId {
 	l, _ := lump.FromString(s)
 	return l
 }
+
+func TestLumpIndexVersion(t *testing.T) {
+	tree := NewIndex()
+	data := portion.NewDataPortion(10, 10)
+	tree.InsertDataPortion(lumpid("1"), data)
+	assert.Equal(t, uint64(1), tree.Version(lumpid("1")))
+	tree.SetVersion(lumpid("1"), 5)
+	assert.Equal(t, uint64(5), tree.Version(lumpid("1")))
+
+	//insert again resets the version
+	tree.InsertDataPortion(lumpid("1"), data)
+	assert.Equal(t, uint64(1), tree.Version(lumpid("1")))
+	assert.Equal(t, uint64(0), tree.Retired())
+	tree.SetVersion(lumpid("1"), 5)
+	tree.Delete(lumpid("1"))
+	assert.Equal(t, uint64(5), tree.Retired())
+	tree.InsertDataPortion(lumpid("1"), data)
+	assert.Equal(t, uint64(1), tree.Version(lumpid("1")))
+
+	//a missing lump does not retire, a lower generation does not lower it
+	tree.Delete(lumpid("2"))
+	tree.InsertDataPortion(lumpid("3"), data)
+	tree.SetVersion(lumpid("3"), 3)
+	tree.DeleteRange(lumpid("0"), lumpid("4"))
+	assert.Equal(t, uint64(5), tree.Retired())
+	tree.InsertDataPortion(lumpid("3"), data)
+	tree.SetVersion(lumpid("3"), 6)
+	assert.True(t, tree.Remove(lumpid("3")))
+	assert.Equal(t, uint64(5), tree.Retired())
+	tree.SetRetired(7)
+	assert.Equal(t, uint64(7), tree.Retired())
+}
+
+func TestLumpIndexRangeIterReverse(t *testing.T) {
+	tree := NewIndex()
+	data := portion.NewDataPortion(10, 10)
+	for _, id := range []string{"0", "1", "5", "9"} {
+		tree.InsertDataPortion(lumpid(id), data)
+	}
+	var ids []lump.LumpId
+	collect := func(id lump.LumpId, p portion.Portion) error {
+		ids = append(ids, id)
+		return nil
+	}
+	tree.RangeIterReverse(lumpid("1"), lumpid("9"), collect)
+	assert.Equal(t, []lump.LumpId{lumpid("5"), lumpid("1")}, ids)
+	ids = nil
+	tree.RangeIterReverse(lumpid("0"), lumpid("ff"), collect)
+	assert.Equal(t, []lump.LumpId{lumpid("9"), lumpid("5"), lumpid("1"), lumpid("0")}, ids)
+	ids = nil
+	tree.RangeIterReverse(lumpid("0"), lumpid("0"), collect)
+	assert.Nil(t, ids)
+}
@@ -1,46 +1,93 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/thesues/cannyls-go/logger"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 )
 
-/*
-	TAG_PUT            byte = 3
-	TAG_EMBED          byte = 4
-	TAG_DELETE         byte = 5
-	TAG_DELETE_RANGE   byte = 6
-	//I do not support tag for now
-	RecordType, _ = tag.NewKey("type")
-*/
-
 var (
-	//This is the key indicate each record's tag
+	//RecordType is the tag of a journal record: put, embed, delete, delete_range
+	RecordType = tag.MustNewKey("type")
+	//Region is where the I/O goes: journal or data
+	Region = tag.MustNewKey("region")
+	//SizeClass is the size class of free portions in the allocator
+	SizeClass = tag.MustNewKey("class")
+
 	//Metrics  for JournalRegion
 	JournalRegionMetric = newJournalRegionMetric()
-	//Metrics for Storage
-	DataRegionMetric  = newDataRegionMetric()
+	//Metrics for DataRegion
+	DataRegionMetric = newDataRegionMetric()
+	//Metrics for Storage's API
+	StorageMetric = newStorageMetric()
+	//Metrics for the raw I/O of both regions
+	NVMMetric         = newNVMMetric()
 	PrometheusHandler *prometheus.Exporter
 )
 
+const (
+	RegionJournal = "journal"
+	RegionData    = "data"
+)
+
+// bucket boundaries used by the `buckets` golang tag
+var bucketBoundaries = map[string][]float64{
+	//milliseconds, from 10us to 5s
+	"latency": {0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	//bytes, from 512B to 32MB
+	"size": {512, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 32 << 20},
+}
+
+var tagKeys = map[string]tag.Key{
+	"type":   RecordType,
+	"region": Region,
+	"class":  SizeClass,
+}
+
 type journalRegionMetric struct {
-	Flushs       *stats.Int64Measure `aggr:"Counter"`
-	Syncs        *stats.Int64Measure `aggr:"Counter"`
-	GcQueueSize  *stats.Int64Measure `aggr:"LastValue"`
-	RecordCounts *stats.Int64Measure `aggr:"Sum"`
-	Capacity     *stats.Int64Measure `aggr:"LastValue""`
-	Reads        *stats.Int64Measure `aggr:"Counter"`
+	Flushs        *stats.Int64Measure   `aggr:"Counter"`
+	Syncs         *stats.Int64Measure   `aggr:"Counter"`
+	GcQueueSize   *stats.Int64Measure   `aggr:"LastValue"`
+	RecordCounts  *stats.Int64Measure   `aggr:"Sum"`
+	Capacity      *stats.Int64Measure   `aggr:"LastValue"`
+	Reads         *stats.Int64Measure   `aggr:"Counter"`
+	Appends       *stats.Int64Measure   `aggr:"Counter" tags:"type"`
+	GcStepLatency *stats.Float64Measure `aggr:"Distribution" buckets:"latency"`
 }
 
 type dataRegionMetric struct {
-	Reads      *stats.Int64Measure `aggr:"Counter"`
-	Writes     *stats.Int64Measure `aggr:"Counter"`
-	ReadBytes  *stats.Int64Measure `aggr:"Sum"`
-	WriteBytes *stats.Int64Measure `aggr:"Sum"`
+	Reads         *stats.Int64Measure   `aggr:"Counter"`
+	Writes        *stats.Int64Measure   `aggr:"Counter"`
+	ReadBytes     *stats.Int64Measure   `aggr:"Sum"`
+	WriteBytes    *stats.Int64Measure   `aggr:"Sum"`
+	FreeBytes     *stats.Int64Measure   `aggr:"LastValue"`
+	FreePortions  *stats.Int64Measure   `aggr:"LastValue"`
+	FreeBySize    *stats.Int64Measure   `aggr:"LastValue" tags:"class"`
+	LargestFree   *stats.Int64Measure   `aggr:"LastValue"`
+	Fragmentation *stats.Float64Measure `aggr:"LastValue"`
+}
+
+type storageMetric struct {
+	PutLatency    *stats.Float64Measure `aggr:"Distribution" buckets:"latency"`
+	GetLatency    *stats.Float64Measure `aggr:"Distribution" buckets:"latency"`
+	DeleteLatency *stats.Float64Measure `aggr:"Distribution" buckets:"latency"`
+	SyncLatency   *stats.Float64Measure `aggr:"Distribution" buckets:"latency"`
+	Expired       *stats.Int64Measure   `aggr:"Counter"`
+}
+
+type nvmMetric struct {
+	ReadLatency  *stats.Float64Measure `aggr:"Distribution" buckets:"latency" tags:"region"`
+	WriteLatency *stats.Float64Measure `aggr:"Distribution" buckets:"latency" tags:"region"`
+	IOSize       *stats.Int64Measure   `aggr:"Distribution" buckets:"size" tags:"region"`
 }
 
 func newDataRegionMetric() *dataRegionMetric {
@@ -49,27 +96,74 @@ func newDataRegionMetric() *dataRegionMetric {
 		Writes:     stats.Int64("Writes", "data writes", stats.UnitDimensionless),
 		ReadBytes:  stats.Int64("ReadBytes", "data region read bytes", stats.UnitBytes),
 		WriteBytes: stats.Int64("WriteBytes", "data region write bytes", stats.UnitBytes),
+		FreeBytes:  stats.Int64("DataFreeBytes", "free bytes of the data region", stats.UnitBytes),
+		FreePortions: stats.Int64("FreePortions", "number of free portions in the allocator",
+			stats.UnitDimensionless),
+		FreeBySize: stats.Int64("FreePortionsBySize", "number of free portions, by size class(log2 of blocks)",
+			stats.UnitDimensionless),
+		LargestFree: stats.Int64("LargestFreeBytes", "the largest free portion, the limit of a put",
+			stats.UnitBytes),
+		Fragmentation: stats.Float64("Fragmentation", "1 - largest free portion / free space",
+			stats.UnitDimensionless),
 	}
 
 }
 func newJournalRegionMetric() *journalRegionMetric {
 	return &journalRegionMetric{
-		Syncs:        stats.Int64("JournalSync", "how many time Journal syncs", "1"),
-		GcQueueSize:  stats.Int64("GcQueueSize", "how many records have be put in gcqueue", "1"),
-		RecordCounts: stats.Int64("Records in journal", "records put in the journal region since start", "1"),
-		Capacity:     stats.Int64("JournalUsage", "The usage of JournalRegion, by bytes", "byte"),
-		Flushs:       stats.Int64("JouralFlushs", "how many time Journal flushs", "1"),
-		Reads:        stats.Int64("Reads", "journal region  reads", stats.UnitDimensionless),
+		Syncs:         stats.Int64("JournalSync", "how many time Journal syncs", "1"),
+		GcQueueSize:   stats.Int64("GcQueueSize", "how many records have be put in gcqueue", "1"),
+		RecordCounts:  stats.Int64("Records in journal", "records put in the journal region since start", "1"),
+		Capacity:      stats.Int64("JournalUsage", "The usage of JournalRegion, by bytes", "byte"),
+		Flushs:        stats.Int64("JouralFlushs", "how many time Journal flushs", "1"),
+		Reads:         stats.Int64("JournalReads", "journal region  reads", stats.UnitDimensionless),
+		Appends:       stats.Int64("JournalAppends", "records appended to the journal, by record type", "1"),
+		GcStepLatency: stats.Float64("JournalGcStepLatency", "latency of one journal GC step", stats.UnitMilliseconds),
+	}
+}
+
+func newStorageMetric() *storageMetric {
+	return &storageMetric{
+		PutLatency:    stats.Float64("PutLatency", "latency of Put and PutEmbed", stats.UnitMilliseconds),
+		GetLatency:    stats.Float64("GetLatency", "latency of Get", stats.UnitMilliseconds),
+		DeleteLatency: stats.Float64("DeleteLatency", "latency of Delete and DeleteRange", stats.UnitMilliseconds),
+		SyncLatency:   stats.Float64("SyncLatency", "latency of Sync", stats.UnitMilliseconds),
+		Expired:       stats.Int64("Expired", "expired lumps deleted by the reaper", stats.UnitDimensionless),
+	}
+}
+
+func newNVMMetric() *nvmMetric {
+	return &nvmMetric{
+		ReadLatency:  stats.Float64("ReadLatency", "latency of reads from disk, by region", stats.UnitMilliseconds),
+		WriteLatency: stats.Float64("WriteLatency", "latency of writes to disk, by region", stats.UnitMilliseconds),
+		IOSize:       stats.Int64("IOSize", "size of disk I/O, by region", stats.UnitBytes),
 	}
 }
 
-//use golang tag to create views from measurements
-//https://gist.github.com/drewolson/4771479 is a great example.
+// SinceInMilliseconds is the value recorded by the latency measures
+func SinceInMilliseconds(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// RecordWithRegion records the measurements with the region tag
+func RecordWithRegion(region string, ms ...stats.Measurement) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(Region, region)}, ms...)
+}
+
+// RecordWithType records the measurements with the record type tag
+func RecordWithType(recordType string, ms ...stats.Measurement) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(RecordType, recordType)}, ms...)
+}
+
+// use golang tag to create views from measurements
+// https://gist.github.com/drewolson/4771479 is a great example.
 func createAppendViews(m interface{}, list []*view.View) []*view.View {
 	val := reflect.ValueOf(m).Elem()
 	for i := 0; i < val.NumField(); i++ {
 		typeField := val.Type().Field(i)
-		valueField, _ := val.Field(i).Interface().(*stats.Int64Measure)
+		valueField, ok := val.Field(i).Interface().(stats.Measure)
+		if !ok {
+			panic(fmt.Sprintf("%s is not a measure", typeField.Name))
+		}
 		golangTag := typeField.Tag
 		v := &view.View{
 			Name:        valueField.Name(),
@@ -85,21 +179,60 @@ func createAppendViews(m interface{}, list []*view.View) []*view.View {
 			aggr = view.LastValue()
 		case "Sum":
 			aggr = view.Sum()
+		case "Distribution":
+			bounds, ok := bucketBoundaries[golangTag.Get("buckets")]
+			if !ok {
+				panic(fmt.Sprintf("unknown buckets %q of %s", golangTag.Get("buckets"), typeField.Name))
+			}
+			aggr = view.Distribution(bounds...)
 		default:
-			panic("now we only suppport Counter and Gauge")
+			panic("now we only suppport Counter, LastValue, Sum and Distribution")
 		}
 		v.Aggregation = aggr
 
+		//tag keys
+		if tags := golangTag.Get("tags"); tags != "" {
+			for _, name := range strings.Split(tags, ",") {
+				key, ok := tagKeys[name]
+				if !ok {
+					panic(fmt.Sprintf("unknown tag %s of %s", name, typeField.Name))
+				}
+				v.TagKeys = append(v.TagKeys, key)
+			}
+		}
+
 		list = append(list, v)
 	}
 	return list
 }
 
+//exporterLog receives the errors of PrometheusHandler
+var exporterLog = struct {
+	sync.RWMutex
+	log logger.Logger
+}{log: logger.Nop()}
+
+//SetLogger sets the logger of the errors of PrometheusHandler, nothing is logged by default
+func SetLogger(log logger.Logger) {
+	exporterLog.Lock()
+	defer exporterLog.Unlock()
+	exporterLog.log = logger.OrNop(log)
+}
+
+func logExporterError(err error) {
+	exporterLog.RLock()
+	log := exporterLog.log
+	exporterLog.RUnlock()
+	log.Errorf("prometheus exporter: %v", err)
+}
+
 func init() {
 	var err error
 	viewList := make([]*view.View, 0)
 	viewList = createAppendViews(JournalRegionMetric, viewList)
 	viewList = createAppendViews(DataRegionMetric, viewList)
+	viewList = createAppendViews(StorageMetric, viewList)
+	viewList = createAppendViews(NVMMetric, viewList)
 
 	if err := view.Register(viewList...); err != nil {
 		panic("failed to register view")
@@ -107,7 +240,7 @@ func init() {
 
 	PrometheusHandler, err = prometheus.NewExporter(prometheus.Options{
 		Namespace: "cannyls",
-		OnError:   func(err error) { fmt.Printf("%v\n", err) },
+		OnError:   logExporterError,
 	})
 	if err != nil {
 		panic(fmt.Sprintf("%+v", err))
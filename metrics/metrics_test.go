@@ -1,9 +1,13 @@
 package metrics
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/logger"
 	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 )
 
 func TestCreateView(t *testing.T) {
@@ -12,3 +16,41 @@ func TestCreateView(t *testing.T) {
 	viewList := make([]*view.View, 0)
 	viewList = createAppendViews(x, viewList)
 }
+
+func TestCreateDistributionView(t *testing.T) {
+	viewList := createAppendViews(newNVMMetric(), nil)
+	assert.Equal(t, 3, len(viewList))
+	for _, v := range viewList {
+		assert.Equal(t, view.AggTypeDistribution, v.Aggregation.Type)
+		assert.Equal(t, []tag.Key{Region}, v.TagKeys)
+	}
+	assert.Equal(t, bucketBoundaries["latency"], viewList[0].Aggregation.Buckets)
+	assert.Equal(t, bucketBoundaries["size"], viewList[2].Aggregation.Buckets)
+}
+
+func TestCreateViewUnknownBuckets(t *testing.T) {
+	type badMetric struct {
+		Latency interface{} `aggr:"Distribution" buckets:"nope"`
+	}
+	m := &badMetric{Latency: StorageMetric.PutLatency}
+	assert.Panics(t, func() {
+		createAppendViews(m, nil)
+	})
+}
+
+func TestExporterErrorLogger(t *testing.T) {
+	var got []string
+	SetLogger(logger.FuncLogger(func(level logger.Level, msg string) {
+		assert.Equal(t, logger.ErrorLevel, level)
+		got = append(got, msg)
+	}))
+	defer SetLogger(nil)
+
+	logExporterError(errors.New("scrape failed"))
+	assert.Equal(t, []string{"prometheus exporter: scrape failed"}, got)
+
+	//nil discards the errors
+	SetLogger(nil)
+	logExporterError(errors.New("scrape failed"))
+	assert.Equal(t, 1, len(got))
+}
@@ -0,0 +1,305 @@
+package nvm
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/util"
+)
+
+//ErrInjected is returned by FaultyNVM when an I/O error is injected
+var ErrInjected = errors.New("injected I/O error")
+
+type CrashMode int
+
+const (
+	//only synced writes survive
+	CrashDropUnsynced CrashMode = iota
+	//synced writes and a random prefix of unsynced writes survive
+	CrashPrefix
+	//like CrashPrefix, and the first lost write is torn: a random subset
+	//of its sectors survive
+	CrashTorn
+)
+
+func (mode CrashMode) String() string {
+	switch mode {
+	case CrashDropUnsynced:
+		return "drop-unsynced"
+	case CrashPrefix:
+		return "prefix"
+	case CrashTorn:
+		return "torn"
+	default:
+		return "unknown"
+	}
+}
+
+type faultyWrite struct {
+	offset uint64
+	data   []byte
+}
+
+//faultyDisk is shared by a FaultyNVM and all its split views
+type faultyDisk struct {
+	sync.Mutex
+	current []byte        //what reads see
+	durable []byte        //what survives a crash
+	pending []faultyWrite //writes after the last sync, in order
+	writes  uint64        //number of writes since created
+	crashed bool
+
+	//-1 means disabled, otherwise the number of operations before the error
+	failRead  int
+	failWrite int
+	failSync  int
+}
+
+func countDown(n *int) bool {
+	if *n < 0 {
+		return false
+	}
+	if *n == 0 {
+		*n = -1
+		return true
+	}
+	*n--
+	return false
+}
+
+//FaultyNVM is an in-memory NonVolatileMemory for crash tests. It records every write,
+//and only synced writes are guaranteed to survive a Crash.
+//Like FileNVM, all I/O must be aligned to the block size
+type FaultyNVM struct {
+	disk      *faultyDisk
+	viewStart uint64
+	viewEnd   uint64
+	position  uint64 //relative to viewStart
+}
+
+func NewFaultyNVM(size uint64) (*FaultyNVM, error) {
+	return NewFaultyNVMFromVec(make([]byte, size))
+}
+
+//NewFaultyNVMFromVec uses vec as the durable content
+func NewFaultyNVMFromVec(vec []byte) (*FaultyNVM, error) {
+	if !block.Min().IsAligned(uint64(len(vec))) {
+		return nil, internalerror.InvalidInput
+	}
+	current := make([]byte, len(vec))
+	copy(current, vec)
+	return &FaultyNVM{
+		disk: &faultyDisk{
+			current:   current,
+			durable:   vec,
+			failRead:  -1,
+			failWrite: -1,
+			failSync:  -1,
+		},
+		viewStart: 0,
+		viewEnd:   uint64(len(vec)),
+	}, nil
+}
+
+//FailRead makes the read after n successful reads fail with ErrInjected, once
+func (f *FaultyNVM) FailRead(n int) {
+	f.disk.Lock()
+	defer f.disk.Unlock()
+	f.disk.failRead = n
+}
+
+//FailWrite makes the write after n successful writes fail with ErrInjected, once.
+//The failed write does not change the content
+func (f *FaultyNVM) FailWrite(n int) {
+	f.disk.Lock()
+	defer f.disk.Unlock()
+	f.disk.failWrite = n
+}
+
+//FailSync makes the sync after n successful syncs fail with ErrInjected, once.
+//The pending writes stay unsynced
+func (f *FaultyNVM) FailSync(n int) {
+	f.disk.Lock()
+	defer f.disk.Unlock()
+	f.disk.failSync = n
+}
+
+//Writes returns the number of writes since the device is created
+func (f *FaultyNVM) Writes() uint64 {
+	f.disk.Lock()
+	defer f.disk.Unlock()
+	return f.disk.writes
+}
+
+//Pending returns the number of unsynced writes
+func (f *FaultyNVM) Pending() int {
+	f.disk.Lock()
+	defer f.disk.Unlock()
+	return len(f.disk.pending)
+}
+
+//Crash simulates a power loss and returns the content of the whole device after it.
+//After Crash the device ignores all writes and syncs, so the storage on top of it
+//could still be closed
+func (f *FaultyNVM) Crash(mode CrashMode, rng *rand.Rand) []byte {
+	disk := f.disk
+	disk.Lock()
+	defer disk.Unlock()
+
+	image := make([]byte, len(disk.durable))
+	copy(image, disk.durable)
+
+	var survived int
+	if mode != CrashDropUnsynced && len(disk.pending) > 0 {
+		survived = rng.Intn(len(disk.pending) + 1)
+	}
+	for _, w := range disk.pending[:survived] {
+		copy(image[w.offset:], w.data)
+	}
+	if mode == CrashTorn && survived < len(disk.pending) {
+		w := disk.pending[survived]
+		sector := uint64(block.Min().AsU16())
+		for off := uint64(0); off < uint64(len(w.data)); off += sector {
+			if rng.Intn(2) == 0 {
+				copy(image[w.offset+off:], w.data[off:off+sector])
+			}
+		}
+	}
+
+	disk.crashed = true
+	disk.pending = nil
+	return image
+}
+
+func (f *FaultyNVM) Sync() error {
+	disk := f.disk
+	disk.Lock()
+	defer disk.Unlock()
+	if disk.crashed {
+		return nil
+	}
+	if countDown(&disk.failSync) {
+		return ErrInjected
+	}
+	for _, w := range disk.pending {
+		copy(disk.durable[w.offset:], w.data)
+	}
+	disk.pending = nil
+	return nil
+}
+
+func (f *FaultyNVM) Position() uint64 {
+	return f.position
+}
+
+func (f *FaultyNVM) Capacity() uint64 {
+	return f.viewEnd - f.viewStart
+}
+
+func (f *FaultyNVM) BlockSize() block.BlockSize {
+	return block.Min()
+}
+
+func (f *FaultyNVM) RawSize() int64 {
+	return int64(len(f.disk.durable))
+}
+
+func (f *FaultyNVM) Close() error {
+	return nil
+}
+
+func (f *FaultyNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	if !block.Min().IsAligned(position) || position > f.Capacity() {
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in split", position)
+	}
+	left := &FaultyNVM{
+		disk:      f.disk,
+		viewStart: f.viewStart,
+		viewEnd:   f.viewStart + position,
+	}
+	right := &FaultyNVM{
+		disk:      f.disk,
+		viewStart: f.viewStart + position,
+		viewEnd:   f.viewEnd,
+	}
+	return left, right, nil
+}
+
+func (f *FaultyNVM) Seek(offset int64, whence int) (int64, error) {
+	if !block.Min().IsAligned(uint64(offset)) {
+		return offset, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
+	}
+	abs, err := ConvertToOffset(f, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	if abs > int64(f.Capacity()) || abs < 0 {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "seek abs is wrong %d in seek", abs)
+	}
+	f.position = uint64(abs)
+	return offset, nil
+}
+
+func (f *FaultyNVM) ReadAt(buf []byte, off int64) (int, error) {
+	if !block.Min().IsAligned(uint64(off)) || !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, %d in read", off, len(buf))
+	}
+	if uint64(off) >= f.Capacity() {
+		return 0, io.EOF
+	}
+	disk := f.disk
+	disk.Lock()
+	defer disk.Unlock()
+	if countDown(&disk.failRead) {
+		return 0, ErrInjected
+	}
+	rlen := util.Min(f.Capacity()-uint64(off), uint64(len(buf)))
+	start := f.viewStart + uint64(off)
+	return copy(buf[:rlen], disk.current[start:start+rlen]), nil
+}
+
+func (f *FaultyNVM) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, int64(f.position))
+	if n > 0 {
+		f.position += uint64(n)
+	}
+	return n, err
+}
+
+func (f *FaultyNVM) WriteAt(buf []byte, off int64) (int, error) {
+	if !block.Min().IsAligned(uint64(off)) || !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, %d in write", off, len(buf))
+	}
+	if uint64(off) > f.Capacity() {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "write out of range :%d", off)
+	}
+	disk := f.disk
+	disk.Lock()
+	defer disk.Unlock()
+	wlen := util.Min(f.Capacity()-uint64(off), uint64(len(buf)))
+	if disk.crashed {
+		return int(wlen), nil
+	}
+	if countDown(&disk.failWrite) {
+		return -1, ErrInjected
+	}
+	start := f.viewStart + uint64(off)
+	data := make([]byte, wlen)
+	copy(data, buf[:wlen])
+	copy(disk.current[start:], data)
+	disk.pending = append(disk.pending, faultyWrite{offset: start, data: data})
+	disk.writes++
+	return int(wlen), nil
+}
+
+func (f *FaultyNVM) Write(buf []byte) (int, error) {
+	n, err := f.WriteAt(buf, int64(f.position))
+	if n > 0 {
+		f.position += uint64(n)
+	}
+	return n, err
+}
@@ -0,0 +1,128 @@
+package nvm
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func filled(c byte, size int) []byte {
+	buf := alignedWithSize(size)
+	fillBuf(buf, c)
+	return buf
+}
+
+func TestFaultyNVMCrashDropUnsynced(t *testing.T) {
+	f, err := NewFaultyNVM(4096)
+	assert.Nil(t, err)
+
+	_, err = f.WriteAt(filled('a', 512), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	_, err = f.WriteAt(filled('b', 512), 512)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, f.Pending())
+	assert.Equal(t, uint64(2), f.Writes())
+
+	//reads see unsynced writes
+	buf := alignedWithSize(512)
+	_, err = f.ReadAt(buf, 512)
+	assert.Nil(t, err)
+	assert.Equal(t, filled('b', 512), buf)
+
+	image := f.Crash(CrashDropUnsynced, rand.New(rand.NewSource(1)))
+	assert.Equal(t, filled('a', 512), image[:512])
+	assert.Equal(t, make([]byte, 512), image[512:1024])
+
+	//writes after crash are ignored
+	_, err = f.WriteAt(filled('c', 512), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, f.Pending())
+}
+
+func TestFaultyNVMCrashPrefix(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for round := 0; round < 20; round++ {
+		f, err := NewFaultyNVM(4096)
+		assert.Nil(t, err)
+		for i := 0; i < 8; i++ {
+			_, err = f.WriteAt(filled(byte('a'+i), 512), int64(i*512))
+			assert.Nil(t, err)
+		}
+		image := f.Crash(CrashPrefix, rng)
+		//the survived writes must be a prefix
+		lost := false
+		for i := 0; i < 8; i++ {
+			sector := image[i*512 : (i+1)*512]
+			if bytes.Equal(sector, filled(byte('a'+i), 512)) {
+				assert.False(t, lost)
+			} else {
+				assert.Equal(t, make([]byte, 512), sector)
+				lost = true
+			}
+		}
+	}
+}
+
+func TestFaultyNVMCrashTorn(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	torn := false
+	for round := 0; round < 50 && !torn; round++ {
+		f, err := NewFaultyNVM(4096)
+		assert.Nil(t, err)
+		_, err = f.WriteAt(filled('a', 4096), 0)
+		assert.Nil(t, err)
+		image := f.Crash(CrashTorn, rng)
+		var kept int
+		for i := 0; i < 8; i++ {
+			if image[i*512] == 'a' {
+				kept++
+			}
+		}
+		torn = kept > 0 && kept < 8
+	}
+	assert.True(t, torn)
+}
+
+func TestFaultyNVMSplitAndErrors(t *testing.T) {
+	f, err := NewFaultyNVM(4096)
+	assert.Nil(t, err)
+	left, right, err := f.Split(1024)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1024), left.Capacity())
+	assert.Equal(t, uint64(3072), right.Capacity())
+
+	_, err = right.Write(filled('r', 512))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(512), right.Position())
+	buf := alignedWithSize(512)
+	_, err = f.ReadAt(buf, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, filled('r', 512), buf)
+
+	//unaligned
+	_, err = left.WriteAt(make([]byte, 100), 0)
+	assert.Error(t, err)
+
+	f.FailWrite(1)
+	_, err = left.WriteAt(filled('x', 512), 0)
+	assert.Nil(t, err)
+	_, err = left.WriteAt(filled('y', 512), 0)
+	assert.Equal(t, ErrInjected, err)
+	_, err = left.WriteAt(filled('z', 512), 0)
+	assert.Nil(t, err)
+
+	f.FailRead(0)
+	_, err = right.ReadAt(buf, 0)
+	assert.Equal(t, ErrInjected, err)
+	_, err = right.ReadAt(buf, 0)
+	assert.Nil(t, err)
+
+	f.FailSync(0)
+	assert.Equal(t, ErrInjected, right.Sync())
+	assert.Equal(t, 3, f.Pending())
+	assert.Nil(t, right.Sync())
+	assert.Equal(t, 0, f.Pending())
+}
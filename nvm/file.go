@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
@@ -19,6 +20,7 @@ type FileNVM struct {
 	viewEnd         uint64
 	splited         bool //splited file is not allowd to call file.Close()
 	path            string
+	readOnly        bool
 }
 
 func fileExists(path string) bool {
@@ -95,13 +97,30 @@ func CreateIfAbsent(path string, capacity uint64) (*FileNVM, error) {
 }
 
 func Open(path string) (nvm *FileNVM, header *StorageHeader, err error) {
+	return open(path, false)
+}
+
+//OpenReadOnly opens the file with O_RDONLY and a shared lock. If another process
+//holds the exclusive lock, the file is opened without lock, the caller may see
+//a partially written state.
+//All writes to the returned FileNVM fail with internalerror.StorageReadOnly
+func OpenReadOnly(path string) (nvm *FileNVM, header *StorageHeader, err error) {
+	return open(path, true)
+}
+
+func open(path string, readOnly bool) (nvm *FileNVM, header *StorageHeader, err error) {
 	var f, parsedFile *os.File
 
 	if !strings.HasSuffix(path, "lusf") {
 		return nil, nil, internalerror.InvalidInput
 	}
 
-	if parsedFile, err = os.OpenFile(path, os.O_RDWR, 0755); err != nil {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+
+	if parsedFile, err = os.OpenFile(path, flags, 0755); err != nil {
 		return nil, nil, err
 	}
 	//read the first sector
@@ -115,11 +134,17 @@ func Open(path string) (nvm *FileNVM, header *StorageHeader, err error) {
 	//reopen the file
 	parsedFile.Close()
 
-	if f, err = openFileWithDirectIO(path, os.O_RDWR, 0755); err != nil {
+	if f, err = openFileWithDirectIO(path, flags, 0755); err != nil {
 		return nil, nil, err
 	}
 
-	if err = lockFileWithExclusiveLock(f); err != nil {
+	if readOnly {
+		if err = lockFileWithSharedLock(f); err != nil && err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, nil, err
+		}
+	} else if err = lockFileWithExclusiveLock(f); err != nil {
+		f.Close()
 		return nil, nil, err
 	}
 	err = nil
@@ -130,11 +155,19 @@ func Open(path string) (nvm *FileNVM, header *StorageHeader, err error) {
 		viewEnd:         capacity,
 		splited:         false,
 		path:            path,
+		readOnly:        readOnly,
 	}
 	return
 }
 
+func (self *FileNVM) IsReadOnly() bool {
+	return self.readOnly
+}
+
 func (self *FileNVM) Sync() error {
+	if self.readOnly {
+		return nil
+	}
 	return dataSync(self.file)
 }
 
@@ -152,6 +185,25 @@ func (nvm *FileNVM) Capacity() uint64 {
 	return nvm.viewEnd - nvm.viewStart
 }
 
+//Grow preallocates the file to capacity bytes and extends the view,
+//the views split from it before are not changed
+func (nvm *FileNVM) Grow(capacity uint64) error {
+	if nvm.readOnly {
+		return internalerror.StorageReadOnly
+	}
+	if nvm.splited {
+		return errors.Wrap(internalerror.InvalidInput, "can not grow a splited file")
+	}
+	if capacity <= nvm.Capacity() {
+		return nil
+	}
+	if err := fallocate(nvm.file, int64(nvm.viewStart+capacity)); err != nil {
+		return err
+	}
+	nvm.viewEnd = nvm.viewStart + capacity
+	return nil
+}
+
 func (nvm *FileNVM) RawSize() int64 {
 	info, _ := nvm.file.Stat()
 	return info.Size()
@@ -169,6 +221,7 @@ func (nvm *FileNVM) Split(position uint64) (sp1 NonVolatileMemory, sp2 NonVolati
 		cursor_position: nvm.viewStart,
 		viewEnd:         nvm.viewStart + position,
 		splited:         true,
+		readOnly:        nvm.readOnly,
 	}
 
 	rightNVM := &FileNVM{
@@ -177,6 +230,7 @@ func (nvm *FileNVM) Split(position uint64) (sp1 NonVolatileMemory, sp2 NonVolati
 		viewEnd:         nvm.viewEnd,
 		cursor_position: leftNVM.viewEnd,
 		splited:         true,
+		readOnly:        nvm.readOnly,
 	}
 
 	return leftNVM, rightNVM, nil
@@ -253,6 +307,9 @@ func (nvm *FileNVM) Read(buf []byte) (n int, err error) {
 }
 
 func (nvm *FileNVM) WriteAt(buf []byte, offset int64) (n int, err error) {
+	if nvm.readOnly {
+		return 0, errors.Wrap(internalerror.StorageReadOnly, "FileNVM failed to write")
+	}
 
 	if !block.Min().IsAligned(uint64(offset)) {
 		return int(offset), errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
@@ -275,6 +332,9 @@ func (nvm *FileNVM) WriteAt(buf []byte, offset int64) (n int, err error) {
 }
 
 func (nvm *FileNVM) Write(buf []byte) (n int, err error) {
+	if nvm.readOnly {
+		return 0, errors.Wrap(internalerror.StorageReadOnly, "FileNVM failed to write")
+	}
 	maxLen := nvm.Capacity() - nvm.Position()
 	bufLen := uint64(len(buf))
 
@@ -339,3 +339,46 @@ func fillBuf(buf []byte, x byte) {
 		buf[i] = x
 	}
 }
+
+func TestFileNVMOpenReadOnly(t *testing.T) {
+	nvm, err := CreateIfAbsent("foo-test.lusf", 10*1024)
+	assert.Nil(t, err)
+	defer os.Remove("foo-test.lusf")
+
+	data := new(bytes.Buffer)
+	err = DefaultStorageHeader().WriteTo(data)
+	assert.Nil(t, err)
+	_, err = nvm.Write(align(data.Bytes()))
+	assert.Nil(t, err)
+	nvm.Sync()
+
+	//the exclusive lock is held, open without lock
+	ro, _, err := OpenReadOnly("foo-test.lusf")
+	assert.Nil(t, err)
+	assert.True(t, ro.IsReadOnly())
+	ro.Close()
+	nvm.Close()
+
+	ro, header, err := OpenReadOnly("foo-test.lusf")
+	assert.Nil(t, err)
+	defer ro.Close()
+	assert.Equal(t, MAJOR_VERSION, header.MajorVersion)
+
+	//shared lock blocks writers
+	_, _, err = Open("foo-test.lusf")
+	assert.Error(t, err)
+
+	buf := alignedWithSize(512)
+	n, err := ro.Write(buf)
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+	n, err = ro.WriteAt(buf, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+	left, _, err := ro.Split(512)
+	assert.Nil(t, err)
+	_, err = left.WriteAt(buf, 0)
+	assert.Error(t, err)
+	_, err = ro.ReadAt(buf, 0)
+	assert.Nil(t, err)
+}
@@ -1,7 +1,9 @@
 package nvm
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"os"
 
@@ -32,8 +34,22 @@ import (
       |                     Data Region Size (64 bit)                 |
       |                                                               |
       +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+      |                                                               |
+      |           Journal UUID (128 bit, only if external)            |
+      |                                                               |
+      |                                                               |
+      +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+      |                     Sequence (64 bit, since minor version 3)  |
+      |                                                               |
+      +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+      |        CRC32C of the bytes above (since minor version 3)      |
+      +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
       |                     Padding (Variable)
 	  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+Since minor version 3 the header region holds two copies of the header, each one is
+padded to a block. An update writes the copy older than the new sequence, so a torn
+write leaves the other copy valid, and the valid copy of the highest sequence is used
 */
 
 const (
@@ -44,8 +60,16 @@ const (
 		8 /* journal_region_size */ +
 		8 /* data_region_size */
 	FULL_HEADER_SIZE uint16 = 4 + 2 + HEADER_SIZE
+	//the header of a storage whose journal region is in another file
+	EXTERNAL_JOURNAL_HEADER_SIZE uint16 = HEADER_SIZE + 16 /* journal UUID */
+
+	//the sequence and the checksum of a mirrored header
+	CHECKSUM_SIZE uint16 = 8 + 4
+	HEADER_COPIES        = 2
 )
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 type StorageHeader struct {
 	MajorVersion      uint16
 	MinorVersion      uint16
@@ -53,6 +77,15 @@ type StorageHeader struct {
 	UUID              uuid.UUID
 	JournalRegionSize uint64
 	DataRegionSize    uint64
+	//JournalUUID is uuid.Nil if the journal region follows the header.
+	//Otherwise the journal region is in the file whose UUID is JournalUUID,
+	//and that journal file has the same UUID and JournalUUID
+	JournalUUID uuid.UUID
+	//Sequence is bumped by every update of a checksummed header
+	Sequence uint64
+	//Mirrored is true if the header has a checksum and a mirror copy. It is decided
+	//when the storage is created, the upgrades in place keep the layout of the header
+	Mirrored bool
 }
 
 func DefaultStorageHeader() *StorageHeader {
@@ -64,13 +97,62 @@ func DefaultStorageHeader() *StorageHeader {
 		UUID:              uuid,
 		JournalRegionSize: 1024,
 		DataRegionSize:    4096,
+		Mirrored:          true,
 	}
 }
 func ReadFromFile(f *os.File) (*StorageHeader, error) {
-	return ReadFrom(f)
+	return ReadFromAt(f)
+}
+
+//ReadHeader reads the storage header at the start of nvm
+func ReadHeader(nvm NonVolatileMemory) (*StorageHeader, error) {
+	bs := nvm.BlockSize()
+	size := HEADER_COPIES * bs.CeilAlign(uint64(FULL_HEADER_SIZE+16+CHECKSUM_SIZE))
+	if size > nvm.Capacity() {
+		size = nvm.Capacity()
+	}
+	buf := block.NewAlignedBytes(int(size), bs)
+	if _, err := nvm.ReadAt(buf.AsBytes(), 0); err != nil {
+		return nil, err
+	}
+	return ReadFromAt(bytes.NewReader(buf.AsBytes()))
+}
+
+//ReadFromAt reads the valid copy of the header with the highest sequence. The second
+//copy is at the block size of the header, which is guessed if the first copy is broken
+func ReadFromAt(r io.ReaderAt) (*StorageHeader, error) {
+	first, err := ReadFrom(io.NewSectionReader(r, 0, int64(FULL_HEADER_SIZE+16+CHECKSUM_SIZE)))
+	if err == nil && !first.Checksummed() {
+		return first, nil
+	}
+	var offsets []uint64
+	if first != nil {
+		offsets = []uint64{first.copySize()}
+	} else {
+		for bs := uint64(block.MIN); bs <= 0xFFFF; bs += uint64(block.MIN) {
+			offsets = append(offsets, bs)
+		}
+	}
+	for _, offset := range offsets {
+		second, e := ReadFrom(io.NewSectionReader(r, int64(offset), int64(FULL_HEADER_SIZE+16+CHECKSUM_SIZE)))
+		if e != nil || !second.Checksummed() || second.copySize() != offset {
+			continue
+		}
+		if first == nil || second.Sequence > first.Sequence {
+			return second, nil
+		}
+		break
+	}
+	if first == nil {
+		return nil, err
+	}
+	return first, nil
 }
 
+//ReadFrom reads one copy of the header
 func ReadFrom(reader io.Reader) (*StorageHeader, error) {
+	crc := crc32.New(crc32cTable)
+	reader = io.TeeReader(reader, crc)
 
 	//magic number
 	var magicNumber [4]byte
@@ -89,6 +171,10 @@ func ReadFrom(reader io.Reader) (*StorageHeader, error) {
 		return nil, errors.Wrap(internalerror.InvalidInput, "read header size failed")
 	}
 
+	external := headerSize == EXTERNAL_JOURNAL_HEADER_SIZE || headerSize == EXTERNAL_JOURNAL_HEADER_SIZE+CHECKSUM_SIZE
+	if headerSize != HEADER_SIZE && headerSize != HEADER_SIZE+CHECKSUM_SIZE && !external {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "unknown header size %d", headerSize)
+	}
 	reader = io.LimitReader(reader, int64(headerSize))
 
 	//major version
@@ -104,9 +190,14 @@ func ReadFrom(reader io.Reader) (*StorageHeader, error) {
 	var minorVersion uint16
 	if err := binary.Read(reader, binary.BigEndian, &minorVersion); err != nil {
 		return nil, errors.Wrap(internalerror.InvalidInput, "read minor version failed")
-	} else if minorVersion != MINOR_VERSION {
+	} else if minorVersion == 0 || minorVersion > MINOR_VERSION {
 		return nil, errors.Wrapf(internalerror.InvalidInput, "read minor version not match:%v", minorVersion)
 	}
+	//a storage older than the mirrored header keeps its layout after the upgrades in place
+	checksummed := headerSize == HEADER_SIZE+CHECKSUM_SIZE || headerSize == EXTERNAL_JOURNAL_HEADER_SIZE+CHECKSUM_SIZE
+	if checksummed && minorVersion < MINOR_VERSION_MIRRORED {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "header size %d does not match minor version %d", headerSize, minorVersion)
+	}
 
 	// block size
 	var bs uint16
@@ -147,6 +238,33 @@ func ReadFrom(reader io.Reader) (*StorageHeader, error) {
 		return nil, internalerror.InvalidInput
 	}
 
+	//journal UUID
+	journalUUID := uuid.Nil
+	if external {
+		if _, err := io.ReadFull(reader, uuidBuf[:]); err != nil {
+			return nil, internalerror.InvalidInput
+		}
+		if journalUUID, err = uuid.FromBytes(uuidBuf[:]); err != nil || journalUUID == uuid.Nil {
+			return nil, internalerror.InvalidInput
+		}
+	}
+
+	//sequence and checksum
+	var sequence uint64
+	if checksummed {
+		if err := binary.Read(reader, binary.BigEndian, &sequence); err != nil {
+			return nil, internalerror.InvalidInput
+		}
+		computed := crc.Sum32()
+		var checksum uint32
+		if err := binary.Read(reader, binary.BigEndian, &checksum); err != nil {
+			return nil, internalerror.InvalidInput
+		}
+		if checksum != computed {
+			return nil, errors.Wrapf(internalerror.StorageCorrupted, "header checksum %d, computed %d", checksum, computed)
+		}
+	}
+
 	//EOF
 	var buf [1]byte
 	if _, err = reader.Read(buf[:]); err != io.EOF {
@@ -160,20 +278,24 @@ func ReadFrom(reader io.Reader) (*StorageHeader, error) {
 		UUID:              fileUUID,
 		JournalRegionSize: journalRegionSize,
 		DataRegionSize:    dataRegionSize,
+		JournalUUID:       journalUUID,
+		Sequence:          sequence,
+		Mirrored:          checksummed,
 	}
 	return sh, nil
 
 }
 
-func (self *StorageHeader) WriteTo(writer io.Writer) (err error) {
+func (self *StorageHeader) WriteTo(out io.Writer) (err error) {
 	err = nil
+	writer := new(bytes.Buffer)
 
 	//MAGIC NUMBER
 	if _, err = writer.Write(MAGIC_NUMBER[:]); err != nil {
 		return err
 	}
 	//Header Size
-	if err = binary.Write(writer, binary.BigEndian, HEADER_SIZE); err != nil {
+	if err = binary.Write(writer, binary.BigEndian, self.headerSize()); err != nil {
 		return err
 	}
 
@@ -208,35 +330,197 @@ func (self *StorageHeader) WriteTo(writer io.Writer) (err error) {
 		return err
 	}
 
+	//Journal UUID
+	if self.JournalUUID != uuid.Nil {
+		if _, err = writer.Write(self.JournalUUID.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	//Sequence and checksum
+	if self.Checksummed() {
+		if err = binary.Write(writer, binary.BigEndian, self.Sequence); err != nil {
+			return err
+		}
+		if err = binary.Write(writer, binary.BigEndian, crc32.Checksum(writer.Bytes(), crc32cTable)); err != nil {
+			return err
+		}
+	}
+
+	_, err = out.Write(writer.Bytes())
 	return
 }
 
+func (self *StorageHeader) headerSize() uint16 {
+	size := HEADER_SIZE
+	if self.JournalUUID != uuid.Nil {
+		size = EXTERNAL_JOURNAL_HEADER_SIZE
+	}
+	if self.Checksummed() {
+		size += CHECKSUM_SIZE
+	}
+	return size
+}
+
+//Checksummed returns true if the header has a checksum and a mirror copy
+func (self *StorageHeader) Checksummed() bool {
+	return self.Mirrored
+}
+
+//copySize is the size of a copy of the header with its padding
+func (self *StorageHeader) copySize() uint64 {
+	return self.BlockSize.CeilAlign(uint64(4 + 2 + self.headerSize()))
+}
+
+//Advance bumps the sequence for an update, and returns the offset of the copy which
+//should be written: the one older than the new sequence. If last is true, it is the last
+//copy, the one before the journal region, so both of them could be written at once
+func (self *StorageHeader) Advance(last bool) uint64 {
+	if !self.Checksummed() {
+		return 0
+	}
+	self.Sequence++
+	if last && self.Sequence%HEADER_COPIES != HEADER_COPIES-1 {
+		self.Sequence++
+	}
+	return (self.Sequence % HEADER_COPIES) * self.copySize()
+}
+
+//WriteHeader updates the header at the start of nvm, see Advance
+func WriteHeader(nvm NonVolatileMemory, header *StorageHeader) error {
+	offset := header.Advance(false)
+	buf := new(bytes.Buffer)
+	if err := header.WriteCopyTo(buf); err != nil {
+		return err
+	}
+	aligned := block.FromBytes(buf.Bytes(), nvm.BlockSize())
+	aligned.Align()
+	if _, err := nvm.WriteAt(aligned.AsBytes(), int64(offset)); err != nil {
+		return err
+	}
+	return nvm.Sync()
+}
+
+//HasExternalJournal returns true if the journal region is in the file whose UUID is JournalUUID
+func (self *StorageHeader) HasExternalJournal() bool {
+	return self.JournalUUID != uuid.Nil && self.JournalUUID != self.UUID
+}
+
+//HasCRC32CJournal returns true if the journal records are written with CRC32C,
+//the older minor versions use adler32 until the journal is fully GCed
+func (self *StorageHeader) HasCRC32CJournal() bool {
+	return self.MinorVersion >= MINOR_VERSION_CRC32C
+}
+
+//HasLumpMetaRecords returns true if the journal could have the records of the lump meta
+//and generation, the older minor versions are upgraded before the first one is written
+func (self *StorageHeader) HasLumpMetaRecords() bool {
+	return self.MinorVersion >= MINOR_VERSION_LUMP_META
+}
+
+//HasJournalHeadSlots returns true if the journal head has two slots in their own sectors,
+//it is decided when the storage is created
+func (self *StorageHeader) HasJournalHeadSlots() bool {
+	return self.MinorVersion >= MINOR_VERSION_HEAD_SLOTS
+}
+
+//IsJournalFile returns true if the file only holds the journal region of another storage
+func (self *StorageHeader) IsJournalFile() bool {
+	return self.JournalUUID != uuid.Nil && self.JournalUUID == self.UUID
+}
+
+//CheckJournalFile returns an error if journal is not the header of the journal file of self
+func (self *StorageHeader) CheckJournalFile(journal *StorageHeader) error {
+	if !self.HasExternalJournal() {
+		return errors.Wrap(internalerror.InvalidInput, "storage has no external journal")
+	}
+	if !journal.IsJournalFile() {
+		return errors.Wrap(internalerror.InvalidInput, "not a journal file")
+	}
+	if journal.UUID != self.JournalUUID {
+		return errors.Wrapf(internalerror.InvalidInput, "journal file %v does not belong to storage %v, it expects journal %v",
+			journal.UUID, self.UUID, self.JournalUUID)
+	}
+	//the size of the journal region is from the journal file, it is resized there first
+	if journal.BlockSize != self.BlockSize {
+		return errors.Wrapf(internalerror.StorageCorrupted, "journal file %v does not match the block size of storage %v",
+			journal.UUID, self.UUID)
+	}
+	return nil
+}
+
 func (self *StorageHeader) RegionSize() uint64 {
-	return self.BlockSize.CeilAlign(uint64(FULL_HEADER_SIZE))
+	if self.Checksummed() {
+		return HEADER_COPIES * self.copySize()
+	}
+	return self.copySize()
 }
 
+//StorageSize is the size of the file, a storage with external journal
+//and its journal file only hold one of the regions
 func (self *StorageHeader) StorageSize() uint64 {
-	return self.RegionSize() + self.JournalRegionSize + self.DataRegionSize
+	switch {
+	case self.IsJournalFile():
+		return self.RegionSize() + self.JournalRegionSize
+	case self.HasExternalJournal():
+		return self.RegionSize() + self.DataRegionSize
+	default:
+		return self.RegionSize() + self.JournalRegionSize + self.DataRegionSize
+	}
 }
 
+//WriteHeaderRegionTo writes every copy of the header
 func (self *StorageHeader) WriteHeaderRegionTo(writer io.Writer) (err error) {
+	copies := 1
+	if self.Checksummed() {
+		copies = HEADER_COPIES
+	}
+	for i := 0; i < copies; i++ {
+		if err = self.WriteCopyTo(writer); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//WriteCopyTo writes one copy of the header and its padding
+func (self *StorageHeader) WriteCopyTo(writer io.Writer) (err error) {
 	if err = self.WriteTo(writer); err != nil {
 		return
 	}
 
-	padding := make([]byte, self.RegionSize()-uint64(FULL_HEADER_SIZE))
+	padding := make([]byte, self.copySize()-uint64(4+2+self.headerSize()))
 	if _, err = writer.Write(padding); err != nil {
 		return
 	}
 	return
 }
 
+//SplitRegion returns the journal region and the data region of nvm,
+//the journal region is nil if it is external, and the data region is nil for a journal file
 func (self *StorageHeader) SplitRegion(nvm NonVolatileMemory) (NonVolatileMemory, NonVolatileMemory) {
 	headEnd := self.RegionSize()
 	_, body, err := nvm.Split(headEnd)
 	if err != nil {
 		return nil, nil
 	}
+	switch {
+	case self.IsJournalFile():
+		return body, nil
+	case self.HasExternalJournal():
+		return nil, body
+	}
 	journalNVM, dataNVM, err := body.Split(self.JournalRegionSize)
 	return journalNVM, dataNVM
 }
+
+//ReadHeaderFromPath reads the storage header of the file at path.
+//The file is neither locked nor opened for writing.
+func ReadHeaderFromPath(path string) (*StorageHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadFromFile(f)
+}
@@ -1,6 +1,7 @@
 package nvm
 
 import (
+	"bytes"
 	"testing"
 
 	"fmt"
@@ -26,10 +27,12 @@ func TestStorageHeader(t *testing.T) {
 		UUID:              uuid,
 		JournalRegionSize: 1024,
 		DataRegionSize:    4096,
+		Mirrored:          true,
 	}
 
-	assert.Equal(t, header.RegionSize(), uint64(512))
-	assert.Equal(t, header.StorageSize(), uint64(512+1024+4096))
+	//a header and its mirror
+	assert.Equal(t, header.RegionSize(), uint64(1024))
+	assert.Equal(t, header.StorageSize(), uint64(1024+1024+4096))
 
 	//read/write
 	tempfile, err := ioutil.TempFile("", "example")
@@ -59,3 +62,107 @@ func TestStorageHeader(t *testing.T) {
 	assert.Equal(t, header.DataRegionSize, otherHeader.DataRegionSize)
 
 }
+
+func TestStorageHeaderExternalJournal(t *testing.T) {
+	header := DefaultStorageHeader()
+	header.JournalUUID = uuid.NewV4()
+	assert.True(t, header.HasExternalJournal())
+	assert.False(t, header.IsJournalFile())
+	assert.Equal(t, uint64(1024), header.RegionSize())
+	assert.Equal(t, uint64(1024+4096), header.StorageSize())
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, header.WriteHeaderRegionTo(buf))
+	assert.Equal(t, 1024, buf.Len())
+	other, err := ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, header, other)
+
+	journal := *header
+	journal.UUID = header.JournalUUID
+	journal.DataRegionSize = 0
+	assert.True(t, journal.IsJournalFile())
+	assert.Equal(t, uint64(1024+1024), journal.StorageSize())
+	assert.Nil(t, header.CheckJournalFile(&journal))
+
+	//the journal of another storage
+	stranger := journal
+	stranger.UUID = uuid.NewV4()
+	stranger.JournalUUID = stranger.UUID
+	assert.Error(t, header.CheckJournalFile(&stranger))
+	assert.Error(t, header.CheckJournalFile(header))
+	assert.Error(t, DefaultStorageHeader().CheckJournalFile(&journal))
+}
+
+func TestStorageHeaderMirror(t *testing.T) {
+	header := DefaultStorageHeader()
+	assert.True(t, header.Checksummed())
+	raw := make([]byte, header.RegionSize())
+	mem, err := NewFromVec(raw)
+	assert.Nil(t, err)
+	buf := new(bytes.Buffer)
+	assert.Nil(t, header.WriteHeaderRegionTo(buf))
+	_, err = mem.WriteAt(buf.Bytes(), 0)
+	assert.Nil(t, err)
+
+	//updates go to the copies in turn
+	header.DataRegionSize = 8192
+	assert.Nil(t, WriteHeader(mem, header))
+	assert.Equal(t, uint64(1), header.Sequence)
+	header.DataRegionSize = 16384
+	assert.Nil(t, WriteHeader(mem, header))
+	assert.Equal(t, uint64(2), header.Sequence)
+	read, err := ReadHeader(mem)
+	assert.Nil(t, err)
+	assert.Equal(t, header, read)
+
+	//a torn update of the first copy, the second one is used
+	raw[20]++
+	read, err = ReadHeader(mem)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), read.Sequence)
+	assert.Equal(t, uint64(8192), read.DataRegionSize)
+
+	//the next update overwrites the broken copy
+	assert.Nil(t, WriteHeader(mem, read))
+	assert.Equal(t, uint64(2), read.Sequence)
+	again, err := ReadHeader(mem)
+	assert.Nil(t, err)
+	assert.Equal(t, read, again)
+
+	//Advance picks the last copy if it is asked
+	offset := again.Advance(true)
+	assert.Equal(t, uint64(512), offset)
+	assert.Equal(t, uint64(3), again.Sequence)
+
+	//both copies are broken
+	raw[20]++
+	raw[512+20]++
+	_, err = ReadHeader(mem)
+	assert.Error(t, err)
+}
+
+func TestStorageHeaderUnmirrored(t *testing.T) {
+	//the older minor versions have one copy and no checksum
+	header := DefaultStorageHeader()
+	header.MinorVersion = MINOR_VERSION_MIRRORED - 1
+	header.Mirrored = false
+	assert.False(t, header.Checksummed())
+	assert.Equal(t, uint64(512), header.RegionSize())
+	mem, err := New(1024)
+	assert.Nil(t, err)
+	assert.Nil(t, WriteHeader(mem, header))
+	assert.Equal(t, uint64(0), header.Sequence)
+	read, err := ReadHeader(mem)
+	assert.Nil(t, err)
+	assert.Equal(t, header, read)
+
+	//an upgrade in place keeps the layout
+	header.MinorVersion = MINOR_VERSION_LUMP_META
+	assert.Nil(t, WriteHeader(mem, header))
+	read, err = ReadHeader(mem)
+	assert.Nil(t, err)
+	assert.Equal(t, header, read)
+	assert.True(t, read.HasLumpMetaRecords())
+	assert.Equal(t, uint64(512), read.RegionSize())
+}
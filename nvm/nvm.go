@@ -25,10 +25,14 @@ var (
 )
 
 const (
-	MAJOR_VERSION           uint16 = 2
-	MINOR_VERSION           uint16 = 1
-	MAX_JOURNAL_REGION_SIZE uint64 = (1 << 40) - 1
-	MAX_DATA_REGION_SIZE    uint64 = MAX_JOURNAL_REGION_SIZE * uint64(block.MIN)
+	MAJOR_VERSION            uint16 = 2
+	MINOR_VERSION            uint16 = 5
+	MINOR_VERSION_CRC32C     uint16 = 2 //the journal records are checksummed by CRC32C since it
+	MINOR_VERSION_MIRRORED   uint16 = 3 //the header has a checksum and a mirror copy since it
+	MINOR_VERSION_LUMP_META  uint16 = 4 //the journal has the records of the lump meta and generation since it
+	MINOR_VERSION_HEAD_SLOTS uint16 = 5 //the journal head has two slots in their own sectors since it
+	MAX_JOURNAL_REGION_SIZE  uint64 = (1 << 40) - 1
+	MAX_DATA_REGION_SIZE     uint64 = MAX_JOURNAL_REGION_SIZE * uint64(block.MIN)
 )
 
 func ConvertToOffset(nvm NonVolatileMemory, offset int64, whence int) (int64, error) {
@@ -20,6 +20,10 @@ func lockFileWithExclusiveLock(f *os.File) error {
 	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
 }
 
+func lockFileWithSharedLock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+}
+
 // copy-paste from src/pkg/syscall/zsyscall_linux_amd64.go
 func fcntl(fd int, cmd int, arg int) (val int, err error) {
 	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(cmd), uintptr(arg))
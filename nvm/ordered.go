@@ -0,0 +1,29 @@
+package nvm
+
+//syncAfterNVM syncs another NVM before itself
+type syncAfterNVM struct {
+	NonVolatileMemory
+	before NonVolatileMemory
+}
+
+//SyncAfter returns nvm whose Sync syncs before first. An external journal is
+//wrapped with the data region, so a record never reaches the disk before
+//the data it points to
+func SyncAfter(nvm NonVolatileMemory, before NonVolatileMemory) NonVolatileMemory {
+	return &syncAfterNVM{NonVolatileMemory: nvm, before: before}
+}
+
+func (s *syncAfterNVM) Sync() error {
+	if err := s.before.Sync(); err != nil {
+		return err
+	}
+	return s.NonVolatileMemory.Sync()
+}
+
+func (s *syncAfterNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	left, right, err := s.NonVolatileMemory.Split(position)
+	if err != nil {
+		return nil, nil, err
+	}
+	return SyncAfter(left, s.before), SyncAfter(right, s.before), nil
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/logger"
 	"github.com/thesues/cannyls-go/util"
 	judy "github.com/thesues/go-judy"
 
@@ -405,7 +406,6 @@ func CreateBackingFile(prefix string, maxCapacity uint64, currentCapacity uint64
 
 	file.Sync()
 
-	fmt.Printf("Creating Backingfile journalSize is %d, dataStart At %d\n", header.JournalSize, 512+header.JournalSize)
 	return &BackingFile{
 		file:           file,
 		JournalStart:   512,
@@ -433,8 +433,6 @@ func OpenBackingFile(fileName string) (*BackingFile, error) {
 		panic(fmt.Sprint(err.Error()))
 	}
 
-	fmt.Printf("header is %+v\n", header)
-
 	//read all the journalEntry to
 	tree := judy.JudyL{}
 
@@ -560,7 +558,8 @@ func (self *SnapshotReader) Read(p []byte) (n int, err error) {
 			*/
 			start := int64(uint64(onOrigin[0]) * regionSize)
 			n, err = util.ReadFull(self.snap.originFile, self.buf.AsBytes(), start)
-			fmt.Printf("result of read origin %+v,raw size is %d, err is %+v\n", n, self.snap.originFile.RawSize(), err)
+			self.snap.rawSnapNVM.log.Debugf("snapshot reader: read %d bytes from origin at %d, raw size is %d, err is %v",
+				n, start, self.snap.originFile.RawSize(), err)
 			//if originFile is shorter than expected
 			if err != nil && err != io.EOF {
 				return -1, err
@@ -601,9 +600,15 @@ type SnapNVM struct {
 	prefix     string
 	splited    bool
 	rawSnapNVM *SnapNVM
+	log        logger.Logger //only the raw SnapNVM's logger is used
 }
 
 func NewSnapshotNVM(originFile *FileNVM) (*SnapNVM, error) {
+	return NewSnapshotNVMWithLogger(originFile, logger.Nop())
+}
+
+func NewSnapshotNVMWithLogger(originFile *FileNVM, log logger.Logger) (*SnapNVM, error) {
+	log = logger.OrNop(log)
 
 	if originFile.splited {
 		panic("can not create snap from splited NVM")
@@ -625,7 +630,7 @@ func NewSnapshotNVM(originFile *FileNVM) (*SnapNVM, error) {
 	if len(matches) == 0 {
 		//myBackFile, err = CreateBackingFile(prefix, uint64(originFile.RawSize()))
 	} else if len(matches) == 1 {
-		fmt.Printf("found snapshot file %s\n", matches[0])
+		log.Infof("found snapshot file %s", matches[0])
 		myBackFile, err = OpenBackingFile(matches[0])
 	}
 	if err != nil {
@@ -636,6 +641,7 @@ func NewSnapshotNVM(originFile *FileNVM) (*SnapNVM, error) {
 		myBackfile: myBackFile,
 		prefix:     prefix,
 		splited:    false,
+		log:        log,
 	}
 	//create ab for read data from
 	if myBackFile != nil {
@@ -745,7 +751,7 @@ func (self *SnapNVM) Close() error {
 	self.Lock()
 	defer self.Unlock()
 	if self.splited {
-		return errors.Errorf("can not close splited NVM")
+		return errors.Wrap(internalerror.NotSupported, "can not close splited NVM")
 	}
 	if self.myBackfile != nil {
 		self.myBackfile.Sync()
@@ -789,7 +795,7 @@ func (self *SnapNVM) GetSnapshotReader() (*SnapshotReader, error) {
 	self.Lock()
 	defer self.Unlock()
 	if self.splited {
-		return nil, errors.Errorf("can not create snapshot in splited NVM")
+		return nil, errors.Wrap(internalerror.NotSupported, "can not create snapshot in splited NVM")
 	}
 	if self.myBackfile == nil {
 		if err := self.createSnapshotIfNeeded(); err != nil {
@@ -803,14 +809,22 @@ func (self *SnapNVM) DeleteSnapshot() error {
 	self.Lock()
 	defer self.Unlock()
 	if self.splited {
-		return errors.Errorf("can not create snapshot in splited NVM")
+		return errors.Wrap(internalerror.NotSupported, "can not create snapshot in splited NVM")
 	}
 	if self.myBackfile != nil {
+		self.rawSnapNVM.log.Infof("delete snapshot file %s", self.myBackfile.fileName)
 		self.myBackfile.Delete()
 		self.myBackfile = nil
 	}
 	return nil
 }
+
+//SetLogger replaces the logger of the SnapNVM and all its split views
+func (self *SnapNVM) SetLogger(log logger.Logger) {
+	self.Lock()
+	defer self.Unlock()
+	self.rawSnapNVM.log = logger.OrNop(log)
+}
 func (self *SnapNVM) CreateSnapshotIfNeeded() (err error) {
 	self.Lock()
 	defer self.Unlock()
@@ -819,18 +833,19 @@ func (self *SnapNVM) CreateSnapshotIfNeeded() (err error) {
 
 func (self *SnapNVM) createSnapshotIfNeeded() (err error) {
 	if self.splited {
-		return errors.Errorf("can not create snapshot in splited NVM")
+		return errors.Wrap(internalerror.NotSupported, "can not create snapshot in splited NVM")
 	}
 	if self.myBackfile != nil {
-		return errors.Errorf("only one snapshot instance allowed")
+		return errors.Wrap(internalerror.DeviceBusy, "only one snapshot instance allowed")
 	}
 	size := self.originFile.Capacity()
 
 	self.myBackfile, err = CreateBackingFile(self.prefix, uint64(size), uint64(self.originFile.RawSize()))
-	fmt.Printf("backingfile is %+v\n", self.myBackfile)
 	if err != nil {
 		return err
 	}
+	self.rawSnapNVM.log.Infof("created snapshot file %s, journal size is %d",
+		self.myBackfile.fileName, self.myBackfile.journalMaxSize)
 	regionSize := self.myBackfile.RegionSize()
 	self.ab = block.NewAlignedBytes(int(regionSize), block.Min())
 	return
@@ -252,13 +252,13 @@ func TestOverWriteSnapFileReOpen(t *testing.T) {
 	//journalRegionSize
 	//dataNVM
 	var rdata [512]byte
-	_, err = snapshotReader.Seek(512, io.SeekStart)
+	_, err = snapshotReader.Seek(int64(header.RegionSize()), io.SeekStart)
 	assert.Nil(t, err)
 	n, err := snapshotReader.Read(rdata[:])
 	assert.Equal(t, 512, n)
 	assert.Equal(t, buf1[:], rdata[:])
 
-	_, err = snapshotReader.Seek(int64(512+header.JournalRegionSize), io.SeekStart)
+	_, err = snapshotReader.Seek(int64(header.RegionSize()+header.JournalRegionSize), io.SeekStart)
 	assert.Nil(t, err)
 	n, err = snapshotReader.Read(rdata[:])
 	assert.Equal(t, 512, n)
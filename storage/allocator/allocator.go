@@ -25,6 +25,8 @@ type DataPortionAlloc interface {
 	FreeCount() uint64
 	GetAllocationBitStatus(n uint64, totalBlocks uint64) []float64
 	MaxSegmentSize() uint64
+	//thread safe
+	Stats() AllocatorStats
 	Free()
 }
 
@@ -34,6 +36,7 @@ type BtreeDataPortionAlloc struct {
 	endToFree      *btree.BTree
 	freeCount      uint64
 	maxSegmentSize uint64
+	stats          freeStats
 }
 
 func (alloc *BtreeDataPortionAlloc) Free() {
@@ -57,6 +60,7 @@ func NewBtreeAlloc() *BtreeDataPortionAlloc {
 func BuildBtreeDataPortionAlloc(capacitySector uint32) *BtreeDataPortionAlloc {
 	alloc := NewBtreeAlloc()
 	alloc.addFreePortion(portion.NewFreePortion(address.AddressFromU32(0), capacitySector))
+	alloc.updateMaxSegmentSize()
 	return alloc
 }
 
@@ -78,6 +82,7 @@ func (alloc *BtreeDataPortionAlloc) addFreePortion(free portion.FreePortion) {
 	alloc.sizeToFree.ReplaceOrInsert(portion.SizeBasedPortion(free))
 	alloc.endToFree.ReplaceOrInsert(portion.EndBasedPortion(free))
 	atomic.AddUint64(&alloc.freeCount, uint64(free.Len()))
+	alloc.stats.add(free.Len())
 }
 
 func (alloc *BtreeDataPortionAlloc) deleteFreePortion(free portion.FreePortion) {
@@ -85,6 +90,7 @@ func (alloc *BtreeDataPortionAlloc) deleteFreePortion(free portion.FreePortion)
 	alloc.endToFree.Delete(portion.EndBasedPortion(free))
 	//freeCount - p.Len()
 	atomic.AddUint64(&alloc.freeCount, ^uint64(free.Len()-1))
+	alloc.stats.delete(free.Len())
 }
 
 func (alloc *BtreeDataPortionAlloc) Display() {
@@ -269,3 +275,7 @@ func (alloc *BtreeDataPortionAlloc) RestoreFromIndex(blockSize block.BlockSize,
 func (alloc *BtreeDataPortionAlloc) MaxSegmentSize() uint64 {
 	return atomic.LoadUint64(&alloc.maxSegmentSize)
 }
+
+func (alloc *BtreeDataPortionAlloc) Stats() AllocatorStats {
+	return alloc.stats.snapshot(alloc.FreeCount(), alloc.MaxSegmentSize())
+}
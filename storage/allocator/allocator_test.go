@@ -159,3 +159,49 @@ func lumpidnum(n int) lump.LumpId {
 	l := lump.FromU64(0, uint64(n))
 	return l
 }
+
+func TestAllocatorStats(t *testing.T) {
+	doTestAllocatorStats(t, BuildBtreeDataPortionAlloc(64))
+	doTestAllocatorStats(t, BuildJudyAlloc(64))
+}
+
+func doTestAllocatorStats(t *testing.T, alloc DataPortionAlloc) {
+	stats := alloc.Stats()
+	assert.Equal(t, uint64(64), stats.FreeBlocks)
+	assert.Equal(t, uint64(1), stats.FreePortions)
+	assert.Equal(t, uint64(1), stats.SizeClasses[6])
+	assert.Equal(t, float64(0), stats.Fragmentation)
+
+	for i := 0; i < 4; i++ {
+		_, err := alloc.Allocate(8)
+		assert.Nil(t, err)
+	}
+	alloc.Release(fportion(8, 8))
+
+	//free: [8, 16) and [32, 64)
+	stats = alloc.Stats()
+	assert.Equal(t, uint64(40), stats.FreeBlocks)
+	assert.Equal(t, uint64(2), stats.FreePortions)
+	assert.Equal(t, uint64(32), stats.LargestFree)
+	assert.Equal(t, uint64(1), stats.SizeClasses[3])
+	assert.Equal(t, uint64(1), stats.SizeClasses[5])
+	assert.Equal(t, uint64(0), stats.SizeClasses[6])
+	assert.InDelta(t, 0.2, stats.Fragmentation, 1e-9)
+
+	//merged into [0, 16)
+	alloc.Release(fportion(0, 8))
+	stats = alloc.Stats()
+	assert.Equal(t, uint64(2), stats.FreePortions)
+	assert.Equal(t, uint64(0), stats.SizeClasses[3])
+	assert.Equal(t, uint64(1), stats.SizeClasses[4])
+
+	_, err := alloc.Allocate(32)
+	assert.Nil(t, err)
+	_, err = alloc.Allocate(16)
+	assert.Nil(t, err)
+	stats = alloc.Stats()
+	assert.Equal(t, uint64(0), stats.FreeBlocks)
+	assert.Equal(t, uint64(0), stats.FreePortions)
+	assert.Equal(t, uint64(0), stats.LargestFree)
+	assert.Equal(t, float64(0), stats.Fragmentation)
+}
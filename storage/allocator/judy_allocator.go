@@ -23,7 +23,7 @@ type JudyPortionAlloc struct {
 	sizeBasedTree  judy.Judy1
 	freeCount      uint64 //atomic
 	maxSegmentSize uint64 //atomic
-
+	stats          freeStats
 }
 
 type JudyPortion uint64
@@ -121,6 +121,7 @@ func NewJudyAlloc() *JudyPortionAlloc {
 func BuildJudyAlloc(capacitySector uint32) *JudyPortionAlloc {
 	alloc := NewJudyAlloc()
 	alloc.addPortion(newJudyPortion(address.AddressFromU64(0), capacitySector))
+	alloc.updateMaxSegmentSize()
 	return alloc
 }
 
@@ -201,6 +202,7 @@ func (alloc *JudyPortionAlloc) updateMaxSegmentSize() {
 	n, ok := alloc.sizeBasedTree.Last(math.MaxUint64)
 	if ok == false {
 		atomic.StoreUint64(&alloc.maxSegmentSize, uint64(0))
+		return
 	}
 	size := fromSizebasedToJudy(n).Len()
 	atomic.StoreUint64(&alloc.maxSegmentSize, uint64(size))
@@ -211,12 +213,14 @@ func (alloc *JudyPortionAlloc) deletePortion(p JudyPortion) {
 	alloc.sizeBasedTree.Unset(uint64(p.ToSizeBasedUint64()))
 	//freeCount - p.Len()
 	atomic.AddUint64(&alloc.freeCount, ^uint64(p.Len()-1))
+	alloc.stats.delete(p.Len())
 }
 
 func (alloc *JudyPortionAlloc) addPortion(p JudyPortion) {
 	alloc.startBasedTree.Set(uint64(p))
 	alloc.sizeBasedTree.Set(uint64(p.ToSizeBasedUint64()))
 	atomic.AddUint64(&alloc.freeCount, uint64(p.Len()))
+	alloc.stats.add(p.Len())
 }
 
 func (alloc *JudyPortionAlloc) Release(p portion.DataPortion) {
@@ -379,3 +383,7 @@ func (alloc *JudyPortionAlloc) RestoreFromIndex(blockSize block.BlockSize,
 func (alloc *JudyPortionAlloc) MaxSegmentSize() uint64 {
 	return atomic.LoadUint64(&alloc.maxSegmentSize)
 }
+
+func (alloc *JudyPortionAlloc) Stats() AllocatorStats {
+	return alloc.stats.snapshot(alloc.FreeCount(), alloc.MaxSegmentSize())
+}
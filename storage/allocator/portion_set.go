@@ -0,0 +1,77 @@
+package allocator
+
+import (
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/go-judy"
+)
+
+const portionSetBatch = 4096
+
+type portionOp struct {
+	portion JudyPortion
+	used    bool
+}
+
+//PortionSet collects the used data portions on its own goroutine, so the allocator is
+//rebuilt while the journal is replayed into the index. Use and Release are called by
+//one goroutine, in the order the index is updated
+type PortionSet struct {
+	pending []portionOp
+	ops     chan []portionOp
+	done    chan struct{}
+	array   *judy.Judy1
+}
+
+func NewPortionSet() *PortionSet {
+	set := &PortionSet{
+		pending: make([]portionOp, 0, portionSetBatch),
+		ops:     make(chan []portionOp, 16),
+		done:    make(chan struct{}),
+		array:   &judy.Judy1{},
+	}
+	//like DataPortions of the index, the empty portion at 0 frees the front of the region
+	set.array.Set(0)
+	go set.run()
+	return set
+}
+
+func (set *PortionSet) run() {
+	for ops := range set.ops {
+		for _, op := range ops {
+			if op.used {
+				set.array.Set(uint64(op.portion))
+			} else {
+				set.array.Unset(uint64(op.portion))
+			}
+		}
+	}
+	close(set.done)
+}
+
+func (set *PortionSet) Use(p portion.DataPortion) {
+	set.push(portionOp{portion: fromDataPortionToJudy(p), used: true})
+}
+
+func (set *PortionSet) Release(p portion.DataPortion) {
+	set.push(portionOp{portion: fromDataPortionToJudy(p), used: false})
+}
+
+func (set *PortionSet) push(op portionOp) {
+	set.pending = append(set.pending, op)
+	if len(set.pending) == portionSetBatch {
+		set.ops <- set.pending
+		set.pending = make([]portionOp, 0, portionSetBatch)
+	}
+}
+
+//Done waits for the pending portions and returns them ordered by start, for
+//RestoreFromIndexWithJudy. The caller is responsible to free the array
+func (set *PortionSet) Done() *judy.Judy1 {
+	if len(set.pending) > 0 {
+		set.ops <- set.pending
+		set.pending = nil
+	}
+	close(set.ops)
+	<-set.done
+	return set.array
+}
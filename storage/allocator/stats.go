@@ -0,0 +1,68 @@
+package allocator
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+//SIZE_CLASSES is the number of size classes of free portions. A free portion
+//is at most 24bit long, class i holds portions of [2^i, 2^(i+1)) blocks
+const SIZE_CLASSES = 24
+
+//AllocatorStats describes the free space of an allocator, all sizes are in blocks.
+//Each field is read atomically, but the fields could be slightly inconsistent with
+//each other if the allocator is being changed
+type AllocatorStats struct {
+	FreeBlocks   uint64               `json:"freeblocks"`
+	FreePortions uint64               `json:"freeportions"`
+	LargestFree  uint64               `json:"largestfree"`
+	SizeClasses  [SIZE_CLASSES]uint64 `json:"sizeclasses"`
+	//Fragmentation is 1 - LargestFree/FreeBlocks, 0 means all free blocks are in one portion,
+	//close to 1 means the free blocks are scattered in small portions
+	Fragmentation float64 `json:"fragmentation"`
+}
+
+//freeStats is updated whenever a free portion is added or deleted
+type freeStats struct {
+	portions    uint64 //atomic
+	sizeClasses [SIZE_CLASSES]uint64
+}
+
+func sizeClass(length uint32) int {
+	class := bits.Len32(length) - 1
+	if class >= SIZE_CLASSES {
+		class = SIZE_CLASSES - 1
+	}
+	return class
+}
+
+func (s *freeStats) add(length uint32) {
+	if length == 0 {
+		return
+	}
+	atomic.AddUint64(&s.portions, 1)
+	atomic.AddUint64(&s.sizeClasses[sizeClass(length)], 1)
+}
+
+func (s *freeStats) delete(length uint32) {
+	if length == 0 {
+		return
+	}
+	atomic.AddUint64(&s.portions, ^uint64(0))
+	atomic.AddUint64(&s.sizeClasses[sizeClass(length)], ^uint64(0))
+}
+
+func (s *freeStats) snapshot(freeBlocks uint64, largest uint64) AllocatorStats {
+	stats := AllocatorStats{
+		FreeBlocks:   freeBlocks,
+		FreePortions: atomic.LoadUint64(&s.portions),
+		LargestFree:  largest,
+	}
+	for i := range s.sizeClasses {
+		stats.SizeClasses[i] = atomic.LoadUint64(&s.sizeClasses[i])
+	}
+	if freeBlocks > 0 && largest <= freeBlocks {
+		stats.Fragmentation = 1 - float64(largest)/float64(freeBlocks)
+	}
+	return stats
+}
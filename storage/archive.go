@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+archive format, all integers are big endian
+
+header: | magic "lusa" (4) | version (2) | source block size (2) |
+record: | kind (1) | lumpid (8) | generation (8) | meta size (2) | size (4) | meta (meta size) | data (size) | adler32 of meta and data (4) |
+end:    | kind 0 (1) | record count (8) |
+
+the records of version 1 have no generation, meta size and meta.
+meta is encoded by lump.LumpMeta.Encode, it keeps the expire time of a lump put with a TTL.
+An imported lump gets its generation back, unless the target has a bigger one for it.
+the archive does not depend on the block size or capacity of the source storage
+*/
+
+var ARCHIVE_MAGIC_NUMBER = [4]byte{'l', 'u', 's', 'a'}
+
+const (
+	ARCHIVE_VERSION uint16 = 2
+	//the archive version before the records have the generation and the meta
+	ARCHIVE_VERSION_DATA_ONLY uint16 = 1
+
+	archiveKindEnd      byte = 0
+	archiveKindData     byte = 1
+	archiveKindEmbedded byte = 2
+
+	exportPageSize = 1024
+
+	defaultImportWorkers  = 4
+	defaultImportInterval = 1024
+)
+
+type ArchiveStats struct {
+	Lumps    uint64 `json:"lumps"`
+	Embedded uint64 `json:"embedded"`
+	Bytes    uint64 `json:"bytes"`
+	//records which were skipped because of the progress file
+	Skipped uint64 `json:"skipped"`
+}
+
+type ImportOptions struct {
+	//number of goroutines writing into the storage, default is 4
+	Workers int
+	//if ProgressFile is not empty, the number of imported records is saved in it,
+	//and a later Import with the same file skips these records
+	ProgressFile string
+	//save progress every ProgressInterval records, default is 1024
+	ProgressInterval uint64
+}
+
+type archiveRecord struct {
+	embedded bool
+	id       lump.LumpId
+	data     []byte
+	lumpdata lump.LumpData
+	//opts has the generation, meta and expire time of the lump
+	opts putOptions
+}
+
+//getArchiveRecord reads the lump with its meta and generation, and tells whether
+//it is stored in the journal region
+func (store *Storage) getArchiveRecord(lumpid lump.LumpId) (*archiveRecord, error) {
+	for {
+		store.i.RLock()
+		if !store.opened {
+			store.i.RUnlock()
+			return nil, internalerror.StorageClosed
+		}
+		p, err := store.lookup(lumpid)
+		if err != nil {
+			store.i.RUnlock()
+			return nil, err
+		}
+		record := &archiveRecord{id: lumpid}
+		_, record.embedded = p.(portion.JournalPortion)
+		record.opts.meta, _ = store.index.GetMeta(lumpid)
+		record.opts.version = store.index.Version(lumpid)
+		store.i.RUnlock()
+
+		data, version, err := store.get(context.Background(), lumpid)
+		if err != nil {
+			return nil, err
+		}
+		//otherwise the lump is put again after its meta is read
+		if version == record.opts.version {
+			record.data = data
+			return record, nil
+		}
+	}
+}
+
+//Export writes all lumps into w. Lumps written during the export may or may not be included.
+func (store *Storage) Export(w io.Writer) (stats ArchiveStats, err error) {
+	bw := bufio.NewWriterSize(w, 1<<20)
+
+	var header [8]byte
+	copy(header[:4], ARCHIVE_MAGIC_NUMBER[:])
+	binary.BigEndian.PutUint16(header[4:6], ARCHIVE_VERSION)
+	binary.BigEndian.PutUint16(header[6:8], store.Header().BlockSize.AsU16())
+	if _, err = bw.Write(header[:]); err != nil {
+		return
+	}
+
+	exportOne := func(id lump.LumpId) error {
+		record, err := store.getArchiveRecord(id)
+		if err != nil {
+			if errors.Is(err, internalerror.LumpNotFound) {
+				//deleted after ListRange
+				return nil
+			}
+			return errors.Wrapf(err, "failed to export lump %s", id.String())
+		}
+		if err = writeArchiveRecord(bw, record); err != nil {
+			return err
+		}
+		stats.Lumps++
+		stats.Bytes += uint64(len(record.data))
+		if record.embedded {
+			stats.Embedded++
+		}
+		return nil
+	}
+
+	//ListRange's end is exclusive, the max lumpid is handled at last
+	end := lump.FromU64(0, math.MaxUint64)
+	start := lump.FromU64(0, 0)
+	for {
+		ids := store.ListRange(start, end, exportPageSize)
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			if err = exportOne(id); err != nil {
+				return
+			}
+		}
+		start = ids[len(ids)-1].Inc()
+	}
+	if max, ok := store.MaxId(); ok && max.IsMax() {
+		if err = exportOne(max); err != nil {
+			return
+		}
+	}
+
+	var trailer [9]byte
+	trailer[0] = archiveKindEnd
+	binary.BigEndian.PutUint64(trailer[1:], stats.Lumps)
+	if _, err = bw.Write(trailer[:]); err != nil {
+		return
+	}
+	err = bw.Flush()
+	return
+}
+
+func writeArchiveRecord(w io.Writer, record *archiveRecord) error {
+	var head [23]byte
+	head[0] = archiveKindData
+	if record.embedded {
+		head[0] = archiveKindEmbedded
+	}
+	binary.BigEndian.PutUint64(head[1:9], record.id.U64())
+	binary.BigEndian.PutUint64(head[9:17], record.opts.version)
+	binary.BigEndian.PutUint16(head[17:19], uint16(len(record.opts.meta)))
+	binary.BigEndian.PutUint32(head[19:23], uint32(len(record.data)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	sum := adler32.New()
+	for _, b := range [][]byte{record.opts.meta, record.data} {
+		sum.Write(b)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(sum.Sum(nil))
+	return err
+}
+
+//readArchiveRecord returns nil record and the record count on the end of archive,
+//version is the version of the archive
+func (store *Storage) readArchiveRecord(r io.Reader, version uint16) (*archiveRecord, uint64, error) {
+	var kind [1]byte
+	if _, err := io.ReadFull(r, kind[:]); err != nil {
+		return nil, 0, errors.Wrap(err, "archive is truncated")
+	}
+	if kind[0] == archiveKindEnd {
+		var count [8]byte
+		if _, err := io.ReadFull(r, count[:]); err != nil {
+			return nil, 0, errors.Wrap(err, "archive is truncated")
+		}
+		return nil, binary.BigEndian.Uint64(count[:]), nil
+	}
+	if kind[0] != archiveKindData && kind[0] != archiveKindEmbedded {
+		return nil, 0, errors.Wrapf(internalerror.InvalidInput, "unknown archive record kind %d", kind[0])
+	}
+
+	head := make([]byte, 22)
+	if version == ARCHIVE_VERSION_DATA_ONLY {
+		head = make([]byte, 12)
+	}
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, 0, errors.Wrap(err, "archive is truncated")
+	}
+	record := &archiveRecord{
+		embedded: kind[0] == archiveKindEmbedded,
+		id:       lump.FromU64(0, binary.BigEndian.Uint64(head[0:8])),
+	}
+	if version != ARCHIVE_VERSION_DATA_ONLY {
+		record.opts.version = binary.BigEndian.Uint64(head[8:16])
+		record.opts.meta = make([]byte, binary.BigEndian.Uint16(head[16:18]))
+		head = head[10:]
+	}
+	if record.embedded && len(record.opts.meta) > 0 {
+		return nil, 0, errors.Wrapf(internalerror.InvalidInput, "embedded lump %s has meta", record.id.String())
+	}
+	size := binary.BigEndian.Uint32(head[8:12])
+	if record.embedded {
+		if size > lump.MAX_EMBEDDED_SIZE {
+			return nil, 0, errors.Wrapf(internalerror.InvalidInput, "embedded lump %s is too big", record.id.String())
+		}
+		record.data = make([]byte, size)
+	} else {
+		if size > lump.LUMP_MAX_SIZE {
+			return nil, 0, errors.Wrapf(internalerror.InvalidInput, "lump %s is too big", record.id.String())
+		}
+		record.lumpdata = lump.NewLumpDataAligned(int(size), store.Header().BlockSize)
+		record.data = record.lumpdata.AsBytes()
+	}
+	sum := adler32.New()
+	for _, b := range [][]byte{record.opts.meta, record.data} {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, 0, errors.Wrap(err, "archive is truncated")
+		}
+		sum.Write(b)
+	}
+	var expected [4]byte
+	if _, err := io.ReadFull(r, expected[:]); err != nil {
+		return nil, 0, errors.Wrap(err, "archive is truncated")
+	}
+	if binary.BigEndian.Uint32(expected[:]) != sum.Sum32() {
+		return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "checksum of lump %s mismatch", record.id.String())
+	}
+	if len(record.opts.meta) > 0 {
+		meta, err := lump.DecodeLumpMeta(record.opts.meta)
+		if err != nil {
+			return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "meta of lump %s: %v", record.id.String(), err)
+		}
+		if !meta.ExpireAt.IsZero() {
+			record.opts.expireAt = meta.ExpireAt.UnixNano()
+		}
+	} else {
+		record.opts.meta = nil
+	}
+	return record, 0, nil
+}
+
+func loadImportProgress(path string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "invalid progress file %s", path)
+	}
+	return n, nil
+}
+
+//saveImportProgress replaces the progress file by a synced temporary file,
+//then syncs the directory, so a crash leaves either the old or the new progress
+func saveImportProgress(path string, n uint64) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(strconv.FormatUint(n, 10)); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+//Import loads an archive written by Export. Lumps which already exist are overwritten.
+//The lumps keep their meta and expire time, and their generations unless the storage
+//has bigger ones for them
+func (store *Storage) Import(r io.Reader, opts ImportOptions) (stats ArchiveStats, err error) {
+	if store.readOnly {
+		return stats, errors.Wrap(internalerror.StorageReadOnly, "failed to import")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = defaultImportWorkers
+	}
+	if opts.ProgressInterval == 0 {
+		opts.ProgressInterval = defaultImportInterval
+	}
+
+	br := bufio.NewReaderSize(r, 1<<20)
+	var header [8]byte
+	if _, err = io.ReadFull(br, header[:]); err != nil {
+		return stats, errors.Wrap(err, "failed to read archive header")
+	}
+	if string(header[:4]) != string(ARCHIVE_MAGIC_NUMBER[:]) {
+		return stats, errors.Wrap(internalerror.InvalidInput, "not an archive")
+	}
+	version := binary.BigEndian.Uint16(header[4:6])
+	if version != ARCHIVE_VERSION && version != ARCHIVE_VERSION_DATA_ONLY {
+		return stats, errors.Wrapf(internalerror.InvalidInput, "unsupported archive version %d", version)
+	}
+
+	var done uint64
+	if opts.ProgressFile != "" {
+		if done, err = loadImportProgress(opts.ProgressFile); err != nil {
+			return
+		}
+	}
+
+	//records are applied batch by batch, so every record before a saved
+	//progress is already in the storage
+	var seq, lastSaved uint64 = 0, done
+	batch := make([]*archiveRecord, 0, opts.Workers*4)
+
+	checkpoint := func() error {
+		if err := store.Sync(); err != nil {
+			return err
+		}
+		lastSaved = done
+		return saveImportProgress(opts.ProgressFile, done)
+	}
+
+	apply := func() error {
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		next := make(chan int)
+		for w := 0; w < opts.Workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					errs[i] = store.importRecord(batch[i])
+				}
+			}()
+		}
+		for i := range batch {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+
+		for i, err := range errs {
+			if err != nil {
+				return errors.Wrapf(err, "failed to import lump %s", batch[i].id.String())
+			}
+			stats.Lumps++
+			stats.Bytes += uint64(len(batch[i].data))
+			if batch[i].embedded {
+				stats.Embedded++
+			}
+		}
+		done += uint64(len(batch))
+		batch = batch[:0]
+
+		if opts.ProgressFile != "" && done-lastSaved >= opts.ProgressInterval {
+			return checkpoint()
+		}
+		return nil
+	}
+
+	for {
+		record, count, err := store.readArchiveRecord(br, version)
+		if err != nil {
+			return stats, err
+		}
+		if record == nil {
+			if count != seq {
+				return stats, errors.Wrapf(internalerror.StorageCorrupted,
+					"archive has %d records, expected %d", seq, count)
+			}
+			break
+		}
+		seq++
+		if seq <= done {
+			stats.Skipped++
+			continue
+		}
+		batch = append(batch, record)
+		if len(batch) == cap(batch) {
+			if err = apply(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err = apply(); err != nil {
+			return
+		}
+	}
+	if opts.ProgressFile != "" {
+		err = checkpoint()
+	} else {
+		err = store.Sync()
+	}
+	return
+}
+
+//importRecord puts the lump of record with its meta and generation
+func (store *Storage) importRecord(record *archiveRecord) (err error) {
+	if err = store.checkFailed("import"); err != nil {
+		return
+	}
+	if record.embedded {
+		_, err = store.putEmbed(record.id, record.data, record.opts.version)
+	} else {
+		_, _, err = store.put(context.Background(), record.id, record.lumpdata, record.opts)
+	}
+	return
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"bytes"
+	"hash/adler32"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+func TestExportImport(t *testing.T) {
+	src, err := CreateCannylsStorage("tmp11.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	defer src.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err = src.Put(lumpidnum(i), dataFromBytes(bytes.Repeat([]byte{byte(i)}, i*37)))
+		assert.Nil(t, err)
+	}
+	_, err = src.PutEmbed(lumpidnum(1000), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = src.PutEmbed(lump.FromU64(0, math.MaxUint64), []byte("max"))
+	assert.Nil(t, err)
+
+	var archive bytes.Buffer
+	stats, err := src.Export(&archive)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(102), stats.Lumps)
+	assert.Equal(t, uint64(2), stats.Embedded)
+
+	//the target has a different capacity
+	dst, err := CreateCannylsStorage("tmp12.lusf", 20<<20, 0.05)
+	assert.Nil(t, err)
+	defer os.Remove("tmp12.lusf")
+	defer dst.Close()
+
+	stats, err = dst.Import(bytes.NewReader(archive.Bytes()), ImportOptions{Workers: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(102), stats.Lumps)
+	assert.Equal(t, uint64(2), stats.Embedded)
+
+	for i := 0; i < 100; i++ {
+		data, err := dst.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, i*37), data)
+	}
+	record, err := dst.getArchiveRecord(lumpidnum(1000))
+	assert.Nil(t, err)
+	assert.True(t, record.embedded)
+	assert.Equal(t, []byte("hello"), record.data)
+	data, err := dst.Get(lump.FromU64(0, math.MaxUint64))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("max"), data)
+}
+
+func TestExportImportMeta(t *testing.T) {
+	src, err := CreateCannylsStorage("tmp11.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	defer src.Close()
+
+	created := time.Unix(1600000000, 0)
+	_, err = src.PutWithMeta(lumpidnum(1), dataFromBytes([]byte("meta")),
+		lump.LumpMeta{ContentType: "text/plain", Owner: "alice", Created: created})
+	assert.Nil(t, err)
+	_, err = src.PutWithTTL(lumpidnum(2), dataFromBytes([]byte("ttl")), time.Hour)
+	assert.Nil(t, err)
+	ttlMeta, err := src.GetMeta(lumpidnum(2))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = src.Put(lumpidnum(3), dataFromBytes([]byte{byte(i)}))
+		assert.Nil(t, err)
+		_, err = src.PutEmbed(lumpidnum(4), []byte{byte(i)})
+		assert.Nil(t, err)
+	}
+
+	var archive bytes.Buffer
+	_, err = src.Export(&archive)
+	assert.Nil(t, err)
+
+	dst, err := CreateCannylsStorage("tmp12.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp12.lusf")
+	defer dst.Close()
+	//the target has a bigger generation of lump 4, it is not taken back
+	for i := 0; i < 5; i++ {
+		_, err = dst.PutEmbed(lumpidnum(4), []byte("old"))
+		assert.Nil(t, err)
+	}
+	_, err = dst.Import(bytes.NewReader(archive.Bytes()), ImportOptions{})
+	assert.Nil(t, err)
+
+	meta, err := dst.GetMeta(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, "alice", meta.Owner)
+	assert.True(t, created.Equal(meta.Created))
+	meta, err = dst.GetMeta(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.True(t, ttlMeta.ExpireAt.Equal(meta.ExpireAt))
+	dst.i.RLock()
+	assert.False(t, dst.index.IsExpired(lumpidnum(2), ttlMeta.ExpireAt.UnixNano()-1))
+	assert.True(t, dst.index.IsExpired(lumpidnum(2), ttlMeta.ExpireAt.UnixNano()))
+	dst.i.RUnlock()
+
+	data, version, err := dst.GetWithVersion(lumpidnum(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{2}, data)
+	assert.Equal(t, uint64(3), version)
+	data, version, err = dst.GetWithVersion(lumpidnum(4))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{2}, data)
+	assert.Equal(t, uint64(6), version)
+}
+
+func TestImportDataOnlyArchive(t *testing.T) {
+	dst, err := CreateCannylsStorage("tmp12.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp12.lusf")
+	defer dst.Close()
+
+	//an archive of version 1, one record of the data lump 1
+	var archive bytes.Buffer
+	archive.Write(ARCHIVE_MAGIC_NUMBER[:])
+	archive.Write([]byte{0, 1, 2, 0})
+	archive.Write([]byte{archiveKindData, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5})
+	archive.WriteString("hello")
+	sum := adler32.Checksum([]byte("hello"))
+	archive.Write([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+	archive.Write([]byte{archiveKindEnd, 0, 0, 0, 0, 0, 0, 0, 1})
+
+	stats, err := dst.Import(bytes.NewReader(archive.Bytes()), ImportOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), stats.Lumps)
+	data, version, err := dst.GetWithVersion(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	assert.Equal(t, uint64(1), version)
+}
+
+func TestImportResume(t *testing.T) {
+	src, err := CreateCannylsStorage("tmp11.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	defer src.Close()
+	for i := 0; i < 10; i++ {
+		_, err = src.PutEmbed(lumpidnum(i), []byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	var archive bytes.Buffer
+	_, err = src.Export(&archive)
+	assert.Nil(t, err)
+
+	dst, err := CreateCannylsStorage("tmp12.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp12.lusf")
+	defer dst.Close()
+
+	//pretend the first 4 records are imported
+	defer os.Remove("import.progress")
+	assert.Nil(t, ioutil.WriteFile("import.progress", []byte("4"), 0644))
+
+	opts := ImportOptions{ProgressFile: "import.progress", ProgressInterval: 2}
+	stats, err := dst.Import(bytes.NewReader(archive.Bytes()), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), stats.Skipped)
+	assert.Equal(t, uint64(6), stats.Lumps)
+	for i := 0; i < 4; i++ {
+		_, err = dst.Get(lumpidnum(i))
+		assert.Error(t, err)
+	}
+	for i := 4; i < 10; i++ {
+		_, err = dst.Get(lumpidnum(i))
+		assert.Nil(t, err)
+	}
+	progress, err := loadImportProgress("import.progress")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), progress)
+
+	//a broken archive
+	broken := archive.Bytes()
+	broken[len(broken)-12] ^= 0xff
+	_, err = dst.Import(bytes.NewReader(broken), ImportOptions{})
+	assert.Error(t, err)
+}
+
+func TestImportSyncError(t *testing.T) {
+	src, err := CreateCannylsStorage("tmp11.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	defer src.Close()
+	for i := 0; i < 10; i++ {
+		_, err = src.PutEmbed(lumpidnum(i), []byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	var archive bytes.Buffer
+	_, err = src.Export(&archive)
+	assert.Nil(t, err)
+
+	device, err := nvm.NewFaultyNVM(4 << 20)
+	assert.Nil(t, err)
+	assert.Nil(t, formatStorage(device, 0.01))
+	dst, err := openStorageOnNVM(device)
+	assert.Nil(t, err)
+	defer dst.Close()
+
+	//the lumps are not durable, so the progress is not saved
+	defer os.Remove("import.progress")
+	device.FailSync(0)
+	opts := ImportOptions{Workers: 1, ProgressFile: "import.progress", ProgressInterval: 2}
+	_, err = dst.Import(bytes.NewReader(archive.Bytes()), opts)
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+	_, err = os.Stat("import.progress")
+	assert.True(t, os.IsNotExist(err))
+}
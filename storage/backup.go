@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+//BackupReport is the result of VerifyBackup
+type BackupReport struct {
+	Header    nvm.StorageHeader `json:"header"`
+	Lumps     uint64            `json:"lumps"`
+	Bytes     uint64            `json:"bytes"`
+	Corrupted []lump.LumpId     `json:"corrupted"`
+}
+
+func (report *BackupReport) OK() bool {
+	return len(report.Corrupted) == 0
+}
+
+//RestoreOptions controls RestoreBackup
+type RestoreOptions struct {
+	//if SourceUUID is not uuid.Nil, the backup must be taken from the storage with this UUID
+	SourceUUID uuid.UUID
+}
+
+//openToVerify opens the storage at path. A corrupted journal fails the replay with
+//StorageCorrupted, but the allocator could still panic on corrupted portions
+func openToVerify(path string) (store *Storage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			store = nil
+			err = errors.Wrapf(internalerror.StorageCorrupted, "failed to replay journal of %s: %v", path, r)
+		}
+	}()
+	return OpenCannylsStorageReadOnly(path)
+}
+
+//VerifyBackup opens the backup file read-only, replays its journal and reads every lump.
+//Lumps which could not be read are reported in BackupReport.Corrupted
+func VerifyBackup(path string) (*BackupReport, error) {
+	header, err := nvm.ReadHeaderFromPath(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read header of %s", path)
+	}
+	if err = checkBackupSize(path, header); err != nil {
+		return nil, err
+	}
+
+	store, err := openToVerify(path)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	report := &BackupReport{Header: *header}
+	for _, id := range store.List() {
+		data, err := store.Get(id)
+		if err != nil {
+			report.Corrupted = append(report.Corrupted, id)
+			continue
+		}
+		report.Lumps++
+		report.Bytes += uint64(len(data))
+	}
+	return report, nil
+}
+
+func checkBackupSize(path string, header *nvm.StorageHeader) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) < header.RegionSize()+header.JournalRegionSize {
+		return errors.Wrapf(internalerror.StorageCorrupted,
+			"backup %s is truncated, size is %d", path, info.Size())
+	}
+	return nil
+}
+
+//checkFullBackup rejects the snapshot backing file, it only has the blocks changed
+//after the snapshot and could not be restored without the storage it belongs to
+func checkFullBackup(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var magic [4]byte
+	if _, err = io.ReadFull(f, magic[:]); err != nil {
+		//too short for any header, ReadHeaderFromPath reports it
+		return nil
+	}
+	if magic == nvm.SNAP_MAGIC_NUMBER {
+		return errors.Wrapf(internalerror.NotSupported,
+			"%s is a snapshot backing file, incremental backups are not supported", path)
+	}
+	return nil
+}
+
+//RestoreBackup copies the backup file to target and makes sure the result could be
+//opened by OpenCannylsStorage. target must not exist. The backup must be a full
+//backup such as readup's /snapshot/backup, incremental chains are not supported
+//and a snapshot backing file is internalerror.NotSupported
+func RestoreBackup(backup string, target string, opts RestoreOptions) (err error) {
+	if err = checkFullBackup(backup); err != nil {
+		return err
+	}
+	header, err := nvm.ReadHeaderFromPath(backup)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read header of %s", backup)
+	}
+	if !uuid.Equal(opts.SourceUUID, uuid.Nil) && !uuid.Equal(opts.SourceUUID, header.UUID) {
+		return errors.Wrapf(internalerror.InvalidInput,
+			"backup's uuid is %s, expected %s", header.UUID, opts.SourceUUID)
+	}
+	if err = checkBackupSize(backup, header); err != nil {
+		return err
+	}
+
+	src, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(target)
+		}
+	}()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return errors.Wrap(err, "failed to copy backup")
+	}
+	//the backup may stop at the end of journal region, extend the file
+	//so that the data region is fully addressable
+	info, err := dst.Stat()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if uint64(info.Size()) < header.StorageSize() {
+		if err = dst.Truncate(int64(header.StorageSize())); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	if err = dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	report, err := VerifyBackup(target)
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return errors.Wrapf(internalerror.StorageCorrupted,
+			"%d lumps are corrupted", len(report.Corrupted))
+	}
+	return nil
+}
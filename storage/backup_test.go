@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+func createBackup(t *testing.T, path string, backupPath string) uuid.UUID {
+	store, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+
+	_, err = store.PutEmbed(lumpid("00"), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = store.Put(lumpid("01"), dataFromBytes([]byte("world")))
+	assert.Nil(t, err)
+	store.Sync()
+
+	reader, err := store.GetSnapshotReader()
+	assert.Nil(t, err)
+
+	//changes after the snapshot are not in the backup
+	_, err = store.PutEmbed(lumpid("02"), []byte("quux"))
+	assert.Nil(t, err)
+	store.Sync()
+
+	backup, err := os.OpenFile(backupPath, os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = io.Copy(backup, reader)
+	assert.Nil(t, err)
+	backup.Close()
+
+	store.DeleteSnapshot()
+	id := store.Header().UUID
+	store.Close()
+	return id
+}
+
+func TestRestoreBackup(t *testing.T) {
+	defer os.Remove("tmp11.lusf")
+	defer os.Remove("backup.lusf")
+	defer os.Remove("restored.lusf")
+	sourceID := createBackup(t, "tmp11.lusf", "backup.lusf")
+
+	report, err := VerifyBackup("backup.lusf")
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, uint64(2), report.Lumps)
+	assert.Equal(t, uint64(10), report.Bytes)
+	assert.Equal(t, sourceID, report.Header.UUID)
+
+	//wrong source
+	err = RestoreBackup("backup.lusf", "restored.lusf", RestoreOptions{SourceUUID: uuid.NewV4()})
+	assert.Error(t, err)
+	_, err = os.Stat("restored.lusf")
+	assert.True(t, os.IsNotExist(err))
+
+	err = RestoreBackup("backup.lusf", "restored.lusf", RestoreOptions{SourceUUID: sourceID})
+	assert.Nil(t, err)
+	info, err := os.Stat("restored.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0), info.Mode().Perm()&0111, "restored storage is not executable")
+
+	//target exists
+	err = RestoreBackup("backup.lusf", "restored.lusf", RestoreOptions{})
+	assert.Error(t, err)
+
+	store, err := OpenCannylsStorage("restored.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+
+	data, err := store.Get(lumpid("00"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	data, err = store.Get(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), data)
+	_, err = store.Get(lumpid("02"))
+	assert.Error(t, err)
+}
+
+func TestRestoreTruncatedBackup(t *testing.T) {
+	defer os.Remove("tmp11.lusf")
+	defer os.Remove("backup.lusf")
+	defer os.Remove("restored.lusf")
+	createBackup(t, "tmp11.lusf", "backup.lusf")
+
+	assert.Nil(t, os.Truncate("backup.lusf", 1024))
+	_, err := VerifyBackup("backup.lusf")
+	assert.Error(t, err)
+
+	err = RestoreBackup("backup.lusf", "restored.lusf", RestoreOptions{})
+	assert.Error(t, err)
+	_, err = os.Stat("restored.lusf")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreSnapshotBackingFile(t *testing.T) {
+	defer os.Remove("backing.snap")
+	defer os.Remove("restored.lusf")
+	buf := make([]byte, 4096)
+	copy(buf, nvm.SNAP_MAGIC_NUMBER[:])
+	assert.Nil(t, ioutil.WriteFile("backing.snap", buf, 0644))
+
+	err := RestoreBackup("backing.snap", "restored.lusf", RestoreOptions{})
+	assert.True(t, errors.Is(err, internalerror.NotSupported))
+	_, err = os.Stat("restored.lusf")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"go.opencensus.io/trace"
+)
+
+//startSpan creates a child span only if the caller is traced, so the storage costs
+//nothing more when tracing is off. The returned span could be nil, which is safe to End
+func startSpan(ctx context.Context, name string) (context.Context, *trace.Span) {
+	if trace.FromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return trace.StartSpan(ctx, name)
+}
+
+//lockContext acquires l, or returns ctx.Err() if ctx is done before that.
+//If the lock is acquired after ctx is done, it is released in background.
+//A context which is never done, e.g. context.Background(), takes the lock directly
+func lockContext(ctx context.Context, l sync.Locker) error {
+	if ctx.Done() == nil {
+		l.Lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	acquired := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			l.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
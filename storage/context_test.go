@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, s.Name)
+}
+
+func (r *spanRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := r.names
+	r.names = nil
+	return names
+}
+
+func TestStorageContextSpans(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp11.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	defer store.Close()
+
+	recorder := &spanRecorder{}
+	trace.RegisterExporter(recorder)
+	defer trace.UnregisterExporter(recorder)
+
+	//without a parent span, the storage creates no span
+	_, err = store.PutContext(context.Background(), lumpid("00"), zeroedData(1000))
+	assert.Nil(t, err)
+	assert.Nil(t, store.SyncContext(context.Background()))
+	assert.Equal(t, 0, len(recorder.take()))
+
+	ctx, root := trace.StartSpan(context.Background(), "root", trace.WithSampler(trace.AlwaysSample()))
+	_, err = store.PutContext(ctx, lumpid("01"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = store.GetContext(ctx, lumpid("01"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.SyncContext(ctx))
+	root.End()
+
+	assert.Equal(t, []string{"cannyls.allocate", "cannyls.data_write", "cannyls.journal_append",
+		"cannyls.data_read", "cannyls.flush", "cannyls.fsync", "root"}, recorder.take())
+}
+
+func TestStorageContextCancel(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp11.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.PutContext(ctx, lumpid("00"), zeroedData(1000))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, store.SyncContext(ctx))
+
+	//waiting for a lock held by others
+	ctx, cancel = context.WithCancel(context.Background())
+	store.jr.Lock()
+	done := make(chan error)
+	go func() {
+		done <- store.SyncContext(ctx)
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	store.jr.Unlock()
+
+	//the lock is released after the cancelled waiter gets it
+	assert.Nil(t, store.Sync())
+	_, err = store.Get(lumpid("00"))
+	assert.Error(t, err)
+}
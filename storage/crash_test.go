@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+//crashModel is the expected content of the storage
+type crashModel map[uint64][]byte
+
+func (model crashModel) clone() crashModel {
+	m := make(crashModel, len(model))
+	for k, v := range model {
+		m[k] = v
+	}
+	return m
+}
+
+func (model crashModel) equal(other crashModel) bool {
+	if len(model) != len(other) {
+		return false
+	}
+	for k, v := range model {
+		o, ok := other[k]
+		if !ok || string(o) != string(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func randomPayload(rng *rand.Rand, min, max int) []byte {
+	buf := make([]byte, min+rng.Intn(max-min+1))
+	rng.Read(buf)
+	return buf
+}
+
+//run a random workload on a FaultyNVM, crash at a random point, reopen the
+//crashed image from a file and check the storage is in a state between the last
+//sync and the crash
+func runCrashWorkload(t *testing.T, seed int64, mode nvm.CrashMode) {
+	rng := rand.New(rand.NewSource(seed))
+	tag := fmt.Sprintf("seed %d, mode %s", seed, mode)
+
+	device, err := nvm.NewFaultyNVM(4 << 20)
+	assert.Nil(t, err)
+	assert.Nil(t, formatStorage(device, 0.01))
+	store, err := openStorageOnNVM(device)
+	if !assert.Nil(t, err, tag) {
+		return
+	}
+
+	model := crashModel{}
+	//history[i] is the state after i-th mutation, history[synced] is durable
+	history := []crashModel{model.clone()}
+	synced := 0
+
+	steps := 50 + rng.Intn(250)
+	for step := 0; step < steps; step++ {
+		id := uint64(rng.Intn(64))
+		switch n := rng.Intn(100); {
+		case n < 40:
+			data := randomPayload(rng, 1, 3000)
+			_, err = store.Put(lumpidnum(int(id)), dataFromBytes(data))
+			model[id] = data
+		case n < 60:
+			data := randomPayload(rng, 1, 200)
+			_, err = store.PutEmbed(lumpidnum(int(id)), data)
+			model[id] = data
+		case n < 75:
+			_, _, err = store.Delete(lumpidnum(int(id)))
+			delete(model, id)
+		case n < 80:
+			end := id + 1 + uint64(rng.Intn(8))
+			err = store.DeleteRange(lumpidnum(int(id)), lumpidnum(int(end)), true)
+			for i := id; i < end; i++ {
+				delete(model, i)
+			}
+		case n < 85:
+			if !assert.Nil(t, store.JournalGC(), tag) {
+				return
+			}
+			continue
+		default:
+			if !assert.Nil(t, store.Sync(), tag) {
+				return
+			}
+			synced = len(history) - 1
+			continue
+		}
+		if !assert.Nil(t, err, tag) {
+			return
+		}
+		history = append(history, model.clone())
+	}
+
+	image := device.Crash(mode, rng)
+	store.Close()
+
+	path := fmt.Sprintf("crash%d.lusf", seed)
+	assert.Nil(t, ioutil.WriteFile(path, image, 0644))
+	defer os.Remove(path)
+
+	//a torn journal record fails the checksum, it is the tail so drop it
+	opts := Options{}
+	if mode == nvm.CrashTorn {
+		opts.Recovery = journal.RecoverTruncateTail
+	}
+	reopened, err := OpenCannylsStorageWithOptions(path, opts)
+	if !assert.Nil(t, err, tag) {
+		return
+	}
+	defer reopened.Close()
+	if mode != nvm.CrashTorn {
+		assert.True(t, reopened.RecoveryReport().Clean(), tag)
+	}
+
+	got := crashModel{}
+	for _, id := range reopened.List() {
+		data, err := reopened.Get(id)
+		if !assert.Nil(t, err, "%s, lump %s", tag, id.String()) {
+			return
+		}
+		got[id.U64()] = data
+	}
+
+	matched := false
+	for _, expected := range history[synced:] {
+		if got.equal(expected) {
+			matched = true
+			break
+		}
+	}
+	assert.True(t, matched, "%s: recovered %d lumps, synced state has %d lumps",
+		tag, len(got), len(history[synced]))
+
+	//the recovered storage is still writable
+	_, err = reopened.Put(lump.FromU64(0, 1000), dataFromBytes([]byte("after crash")))
+	assert.Nil(t, err, tag)
+	data, err := reopened.Get(lump.FromU64(0, 1000))
+	assert.Nil(t, err, tag)
+	assert.Equal(t, []byte("after crash"), data, tag)
+}
+
+func TestStorageCrashConsistency(t *testing.T) {
+	rounds := 30
+	if testing.Short() {
+		rounds = 5
+	}
+	for _, mode := range []nvm.CrashMode{nvm.CrashDropUnsynced, nvm.CrashPrefix, nvm.CrashTorn} {
+		for seed := int64(0); seed < int64(rounds); seed++ {
+			runCrashWorkload(t, seed, mode)
+		}
+	}
+}
+
+//crash at every sync of a journal resize, the crashed storage has either the old
+//journal or the resized one, and every lump
+func TestStorageResizeJournalCrash(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; ; n++ {
+		tag := fmt.Sprintf("sync %d", n)
+		device, err := nvm.NewFaultyNVM(4 << 20)
+		assert.Nil(t, err)
+		assert.Nil(t, formatStorage(device, 0.01))
+		store, err := openStorageOnNVM(device)
+		if !assert.Nil(t, err, tag) {
+			return
+		}
+		oldSize := store.Header().JournalRegionSize
+		model := crashModel{}
+		for i := 0; i < 20; i++ {
+			data := randomPayload(rng, 1, 3000)
+			_, err = store.Put(lumpidnum(i), dataFromBytes(data))
+			assert.Nil(t, err, tag)
+			model[uint64(i)] = data
+		}
+		data := randomPayload(rng, 1, 200)
+		_, err = store.PutEmbed(lumpidnum(20), data)
+		assert.Nil(t, err, tag)
+		model[20] = data
+		assert.Nil(t, store.Sync(), tag)
+
+		device.FailSync(n)
+		resizeErr := store.ResizeJournal(256 << 10)
+		image := device.Crash(nvm.CrashTorn, rng)
+		store.Close()
+
+		path := fmt.Sprintf("resize-crash%d.lusf", n)
+		assert.Nil(t, ioutil.WriteFile(path, image, 0644))
+		reopened, err := OpenCannylsStorage(path)
+		os.Remove(path)
+		if !assert.Nil(t, err, tag) {
+			return
+		}
+		size := reopened.Header().JournalRegionSize
+		if resizeErr == nil {
+			assert.Equal(t, uint64(256<<10), size, tag)
+		} else {
+			assert.True(t, size == oldSize || size == 256<<10, tag)
+		}
+		got := crashModel{}
+		for _, id := range reopened.List() {
+			data, err := reopened.Get(id)
+			assert.Nil(t, err, "%s, lump %s", tag, id.String())
+			got[id.U64()] = data
+		}
+		assert.True(t, got.equal(model), "%s: recovered %d lumps of %d", tag, len(got), len(model))
+		reopened.Close()
+		if resizeErr == nil {
+			return
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
@@ -26,6 +27,9 @@ type DataRegion struct {
 	allocator  allocator.DataPortionAlloc
 	nvm        nvm.NonVolatileMemory
 	block_size block.BlockSize
+	//portions freed after the last journal sync. The durable journal may still
+	//point to them, so they could not be reused until the next sync
+	pendingRelease []portion.DataPortion
 }
 
 func NewDataRegion(alloc allocator.DataPortionAlloc, nvm nvm.NonVolatileMemory) *DataRegion {
@@ -58,6 +62,10 @@ func (region *DataRegion) shiftBlockSize(size uint32) uint32 {
 //WARNING: this PUT would CHANGE (data *lump.LumpData),
 //thread-safe
 func (region *DataRegion) Put(data lump.LumpData) (portion.DataPortion, error) {
+	return region.PutContext(context.Background(), data)
+}
+
+func (region *DataRegion) PutContext(ctx context.Context, data lump.LumpData) (portion.DataPortion, error) {
 
 	size := data.Inner.Len() + LUMP_DATA_TRAILER_SIZE
 
@@ -74,9 +82,11 @@ func (region *DataRegion) Put(data lump.LumpData) (portion.DataPortion, error) {
 
 	requiredBlocks := region.shiftBlockSize(data.Inner.Len())
 
+	_, span := startSpan(ctx, "cannyls.allocate")
 	region.Lock()
 	data_portion, err := region.allocator.Allocate(uint16(requiredBlocks))
 	region.Unlock()
+	span.End()
 
 	if err != nil {
 		return portion.DataPortion{}, err
@@ -96,12 +106,18 @@ func (region *DataRegion) Put(data lump.LumpData) (portion.DataPortion, error) {
 			return data_portion, err
 		}
 	*/
-	_, err = region.nvm.WriteAt(data.Inner.AsBytes(), int64(offset))
+	_, span = startSpan(ctx, "cannyls.data_write")
+	_, err = region.writeAt(data.Inner.AsBytes(), int64(offset))
+	span.End()
+	if err != nil {
+		region.Release(data_portion)
+		return portion.DataPortion{}, errors.Wrapf(err, "failed to write data region at %d", offset)
+	}
 
 	ostats.Record(context.Background(), x.DataRegionMetric.WriteBytes.M(int64(data.Inner.Len())))
 	ostats.Record(context.Background(), x.DataRegionMetric.Writes.M(1))
 
-	return data_portion, err
+	return data_portion, nil
 }
 
 //thread-safe
@@ -109,7 +125,7 @@ func (region *DataRegion) readBlocks(readOffset int64, blockCount int) ([]byte,
 	ab := block.NewAlignedBytes(blockCount*int(region.block_size), region.block_size)
 	ab.Align()
 
-	_, err := region.nvm.ReadAt(ab.AsBytes(), readOffset)
+	_, err := region.readAt(ab.AsBytes(), readOffset)
 	if err != nil {
 		return nil, err
 	}
@@ -162,10 +178,12 @@ func (region *DataRegion) Update(dataPortion portion.DataPortion,
 		// data is already aligned since it's returned from AlignedBytes
 		_, err = region.nvm.Write(data)
 	*/
-	region.nvm.WriteAt(data, int64(readOffset))
+	if _, err = region.writeAt(data, int64(readOffset)); err != nil {
+		return errors.Wrapf(err, "failed to update data region at %d", readOffset)
+	}
 	ostats.Record(context.Background(), x.DataRegionMetric.WriteBytes.M(int64(len(data))))
 	ostats.Record(context.Background(), x.DataRegionMetric.Writes.M(1))
-	return err
+	return nil
 }
 
 //thread safe
@@ -175,6 +193,39 @@ func (region *DataRegion) Release(portion portion.DataPortion) {
 	region.allocator.Release(portion)
 }
 
+//DeferRelease frees the portion on the next ReleasePending.
+//thread safe
+func (region *DataRegion) DeferRelease(portion portion.DataPortion) {
+	region.Lock()
+	defer region.Unlock()
+	region.pendingRelease = append(region.pendingRelease, portion)
+}
+
+//ReleasePending must be called after the journal is synced
+//thread safe
+func (region *DataRegion) ReleasePending() {
+	region.Lock()
+	defer region.Unlock()
+	for _, p := range region.pendingRelease {
+		region.allocator.Release(p)
+	}
+	region.pendingRelease = region.pendingRelease[:0]
+}
+
+//thread safe
+func (region *DataRegion) AllocationStatus(n uint64, totalBlocks uint64) []float64 {
+	region.Lock()
+	defer region.Unlock()
+	return region.allocator.GetAllocationBitStatus(n, totalBlocks)
+}
+
+//thread safe
+func (region *DataRegion) HasPendingRelease() bool {
+	region.Lock()
+	defer region.Unlock()
+	return len(region.pendingRelease) > 0
+}
+
 //read/write threadSafe
 func (region *DataRegion) GetSize(dataPortion portion.DataPortion) (size uint32, err error) {
 	/*
@@ -222,10 +273,14 @@ func (region *DataRegion) Get(dataPortion portion.DataPortion) (lump.LumpData, e
 	*/
 	ab := block.NewAlignedBytes(int(len), region.block_size)
 	//_, err := util.ReadFull(region.nvm, ab.AsBytes(), int64(offset))
-	if _, err := region.nvm.ReadAt(ab.AsBytes(), int64(offset)); err != nil {
+	if _, err := region.readAt(ab.AsBytes(), int64(offset)); err != nil {
 		return lump.LumpData{}, err
 	}
 	paddingSize := uint32(util.GetUINT16(ab.AsBytes()[ab.Len()-2:]))
+	if paddingSize+LUMP_DATA_TRAILER_SIZE > ab.Len() {
+		return lump.LumpData{}, errors.Wrapf(internalerror.StorageCorrupted,
+			"invalid padding size %d at offset %d", paddingSize, offset)
+	}
 
 	ab.Resize(ab.Len() - paddingSize - LUMP_DATA_TRAILER_SIZE)
 
@@ -273,3 +328,20 @@ func (region *DataRegion) GetWithOffset(dataPortion portion.DataPortion,
 	ostats.Record(context.Background(), x.DataRegionMetric.Reads.M(1))
 	return data[prefixPadding:realFileSize], nil
 }
+
+//readAt and writeAt record the latency of the data region I/O
+func (region *DataRegion) readAt(buf []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := region.nvm.ReadAt(buf, off)
+	x.RecordWithRegion(x.RegionData, x.NVMMetric.ReadLatency.M(x.SinceInMilliseconds(start)),
+		x.NVMMetric.IOSize.M(int64(len(buf))))
+	return n, err
+}
+
+func (region *DataRegion) writeAt(buf []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := region.nvm.WriteAt(buf, off)
+	x.RecordWithRegion(x.RegionData, x.NVMMetric.WriteLatency.M(x.SinceInMilliseconds(start)),
+		x.NVMMetric.IOSize.M(int64(len(buf))))
+	return n, err
+}
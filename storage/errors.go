@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+//LumpError records the lump which an operation failed on.
+//Use errors.As to get the LumpId, and errors.Is to match the underlying sentinel
+type LumpError struct {
+	Op  string
+	Id  lump.LumpId
+	Err error
+}
+
+func (e *LumpError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Id.String(), e.Err)
+}
+
+func (e *LumpError) Unwrap() error {
+	return e.Err
+}
+
+//Cause keeps errors.Cause of github.com/pkg/errors working
+func (e *LumpError) Cause() error {
+	return e.Err
+}
+
+//OffsetError records a partial read or write of a lump out of its range
+type OffsetError struct {
+	Op     string
+	Id     lump.LumpId
+	Offset uint32
+	Length uint32
+	Err    error
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("%s %s [offset %d, length %d]: %v", e.Op, e.Id.String(), e.Offset, e.Length, e.Err)
+}
+
+func (e *OffsetError) Unwrap() error {
+	return e.Err
+}
+
+func (e *OffsetError) Cause() error {
+	return e.Err
+}
+
+//VersionError is returned by the conditional writes if the generation of the lump is not expected
+type VersionError struct {
+	Op       string
+	Id       lump.LumpId
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s %s: expected version %d, actual %d: %v", e.Op, e.Id.String(), e.Expected, e.Actual, internalerror.VersionConflict)
+}
+
+func (e *VersionError) Unwrap() error {
+	return internalerror.VersionConflict
+}
+
+func (e *VersionError) Cause() error {
+	return internalerror.VersionConflict
+}
+
+//lumpError wraps err in a LumpError, nil stays nil
+func lumpError(op string, id lump.LumpId, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &LumpError{Op: op, Id: id, Err: err}
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+const DEFAULT_ITER_PAGE_SIZE = 1024
+
+const (
+	cursorReverse byte = 1 << iota
+	cursorHasLast
+)
+
+var errPageFull = errors.New("page is full")
+
+type IterOptions struct {
+	//Reverse walks from end-1 down to start
+	Reverse bool
+	//PageSize is the count of ids read each time store.i is held, DEFAULT_ITER_PAGE_SIZE if 0
+	PageSize int
+	//Prefetch reads the data of a page after the page is read from the index
+	Prefetch bool
+	//Cursor is from Iterator.Cursor, the walk resumes after the lump the cursor
+	//was taken at. Give the same start, end and Reverse as the first walk
+	Cursor string
+}
+
+type LumpInfo struct {
+	Id lump.LumpId
+	//Size is the exact size if the lump is embedded or prefetched,
+	//otherwise the size on disk like GetSizeOnDisk
+	Size     uint32
+	Embedded bool
+	//Data is only set by Prefetch
+	Data []byte
+}
+
+//Iterator walks the lumps of [start, end) page by page. store.i is only held
+//while a page is read, so the lumps put or deleted during the walk may or may not
+//be seen, but each lump is seen at most once and in order.
+//
+//	it := store.Iter(start, end, IterOptions{})
+//	for it.Next() {
+//		info := it.Lump()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type Iterator struct {
+	store *Storage
+	start uint64
+	end   uint64
+	opts  IterOptions
+
+	page []LumpInfo
+	pos  int
+	done bool
+	err  error
+
+	cur     LumpInfo
+	hasLast bool
+}
+
+func (store *Storage) Iter(start lump.LumpId, end lump.LumpId, opts IterOptions) *Iterator {
+	it := &Iterator{
+		store: store,
+		start: start.U64(),
+		end:   end.U64(),
+		opts:  opts,
+	}
+	if it.opts.PageSize <= 0 {
+		it.opts.PageSize = DEFAULT_ITER_PAGE_SIZE
+	}
+	if opts.Cursor != "" {
+		it.err = it.resume(opts.Cursor)
+	}
+	return it
+}
+
+//Next moves to the next lump, it returns false at the end or on error
+func (it *Iterator) Next() bool {
+	for it.pos >= len(it.page) {
+		if it.err != nil || it.done {
+			return false
+		}
+		it.err = it.fetch()
+	}
+	it.cur = it.page[it.pos]
+	it.pos++
+	it.hasLast = true
+	return true
+}
+
+//Lump returns the current lump
+func (it *Iterator) Lump() LumpInfo {
+	return it.cur
+}
+
+//Err returns the error which stopped the walk, nil if the walk is finished
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+//Cursor returns an opaque position after the current lump, see IterOptions.Cursor
+func (it *Iterator) Cursor() string {
+	var buf [9]byte
+	if it.opts.Reverse {
+		buf[0] |= cursorReverse
+	}
+	if it.hasLast {
+		buf[0] |= cursorHasLast
+		binary.BigEndian.PutUint64(buf[1:], it.cur.Id.U64())
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+func (it *Iterator) resume(cursor string) error {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != 9 {
+		return errors.Wrap(internalerror.InvalidInput, "invalid cursor")
+	}
+	if (buf[0]&cursorReverse != 0) != it.opts.Reverse {
+		return errors.Wrap(internalerror.InvalidInput, "cursor is from a walk of the other direction")
+	}
+	if buf[0]&cursorHasLast == 0 {
+		return nil
+	}
+	last := binary.BigEndian.Uint64(buf[1:])
+	if it.opts.Reverse {
+		if last < it.end {
+			it.end = last
+		}
+	} else if last == math.MaxUint64 {
+		it.done = true
+	} else if last+1 > it.start {
+		it.start = last + 1
+	}
+	return nil
+}
+
+//fetch reads the next page, and moves start (or end if reverse) after it
+func (it *Iterator) fetch() error {
+	store := it.store
+	if err := store.checkFailed("iter"); err != nil {
+		return err
+	}
+	it.page = it.page[:0]
+	it.pos = 0
+	if it.start >= it.end {
+		it.done = true
+		return nil
+	}
+	var lastId uint64
+	now := time.Now().UnixNano()
+	collect := func(id lump.LumpId, p portion.Portion) error {
+		if len(it.page) == it.opts.PageSize {
+			return errPageFull
+		}
+		lastId = id.U64()
+		if store.index.IsExpired(id, now) {
+			return nil
+		}
+		info := LumpInfo{Id: id, Size: p.SizeOnDisk(block.Min())}
+		_, info.Embedded = p.(portion.JournalPortion)
+		it.page = append(it.page, info)
+		return nil
+	}
+
+	store.i.RLock()
+	if !store.opened {
+		store.i.RUnlock()
+		return internalerror.StorageClosed
+	}
+	var err error
+	start, end := lump.FromU64(0, it.start), lump.FromU64(0, it.end)
+	if it.opts.Reverse {
+		err = store.index.RangeIterReverse(start, end, collect)
+	} else {
+		err = store.index.RangeIter(start, end, collect)
+	}
+	store.i.RUnlock()
+
+	if err != errPageFull {
+		//the range is finished
+		it.done = true
+	} else if it.opts.Reverse {
+		it.end = lastId
+	} else if lastId == math.MaxUint64 {
+		it.done = true
+	} else {
+		it.start = lastId + 1
+	}
+
+	if it.opts.Prefetch {
+		return it.prefetch()
+	}
+	return nil
+}
+
+//prefetch reads the data of the page, the lumps deleted after the page is read are dropped
+func (it *Iterator) prefetch() error {
+	page := it.page[:0]
+	for _, info := range it.page {
+		data, err := it.store.Get(info.Id)
+		if errors.Is(err, internalerror.LumpNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info.Data = data
+		info.Size = uint32(len(data))
+		page = append(page, info)
+	}
+	it.page = page
+	return nil
+}
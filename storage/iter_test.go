@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func collectIter(t *testing.T, it *Iterator) (ids []lump.LumpId) {
+	for it.Next() {
+		ids = append(ids, it.Lump().Id)
+	}
+	assert.Nil(t, it.Err())
+	return
+}
+
+func TestStorageIter(t *testing.T) {
+	storage, err := CreateCannylsStorage("iter.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("iter.lusf")
+	defer storage.Close()
+
+	var all []lump.LumpId
+	for i := uint64(1); i <= 10; i++ {
+		id := lump.FromU64(0, i)
+		all = append(all, id)
+		if i%2 == 0 {
+			_, err = storage.PutEmbed(id, []byte("embed"))
+		} else {
+			_, err = storage.Put(id, dataFromBytes([]byte("data")))
+		}
+		assert.Nil(t, err)
+	}
+
+	//pages of 3
+	ids := collectIter(t, storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 100), IterOptions{PageSize: 3}))
+	assert.Equal(t, all, ids)
+
+	ids = collectIter(t, storage.Iter(lump.FromU64(0, 3), lump.FromU64(0, 7), IterOptions{Reverse: true, PageSize: 2}))
+	assert.Equal(t, []lump.LumpId{all[5], all[4], all[3], all[2]}, ids)
+
+	//prefetch returns the data and exact size
+	it := storage.Iter(lump.FromU64(0, 1), lump.FromU64(0, 3), IterOptions{Prefetch: true})
+	assert.True(t, it.Next())
+	assert.Equal(t, []byte("data"), it.Lump().Data)
+	assert.Equal(t, uint32(4), it.Lump().Size)
+	assert.False(t, it.Lump().Embedded)
+	assert.True(t, it.Next())
+	assert.Equal(t, []byte("embed"), it.Lump().Data)
+	assert.True(t, it.Lump().Embedded)
+	assert.False(t, it.Next())
+
+	//resume from a cursor, the lumps changed behind the cursor are not seen
+	it = storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 100), IterOptions{PageSize: 4})
+	for i := 0; i < 5; i++ {
+		assert.True(t, it.Next())
+	}
+	cursor := it.Cursor()
+	_, _, err = storage.Delete(all[0])
+	assert.Nil(t, err)
+	_, _, err = storage.Delete(all[7])
+	assert.Nil(t, err)
+	ids = collectIter(t, storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 100), IterOptions{Cursor: cursor}))
+	assert.Equal(t, []lump.LumpId{all[5], all[6], all[8], all[9]}, ids)
+
+	it = storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 100), IterOptions{Reverse: true})
+	assert.True(t, it.Next())
+	assert.True(t, it.Next())
+	ids = collectIter(t, storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 100), IterOptions{Reverse: true, Cursor: it.Cursor()}))
+	assert.Equal(t, []lump.LumpId{all[6], all[5], all[4], all[3], all[2], all[1]}, ids)
+
+	//a cursor before any lump starts from the beginning
+	ids = collectIter(t, storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 3), IterOptions{Cursor: storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 3), IterOptions{}).Cursor()}))
+	assert.Equal(t, []lump.LumpId{all[1]}, ids)
+
+	it = storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 100), IterOptions{Cursor: cursor, Reverse: true})
+	assert.False(t, it.Next())
+	assert.True(t, errors.Is(it.Err(), internalerror.InvalidInput))
+	it = storage.Iter(lump.FromU64(0, 0), lump.FromU64(0, 100), IterOptions{Cursor: "bad"})
+	assert.False(t, it.Next())
+	assert.True(t, errors.Is(it.Err(), internalerror.InvalidInput))
+}
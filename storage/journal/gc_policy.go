@@ -0,0 +1,107 @@
+package journal
+
+import "time"
+
+const (
+	//SIDE_JOB_GC_STEP is the count of live entries relocated by a side job of the default policy
+	SIDE_JOB_GC_STEP = 64
+)
+
+//GCState is what a GCPolicy knows about the journal region when it decides
+type GCState struct {
+	Usage    uint64
+	Capacity uint64
+	//Queued is the count of entries in the GC queue
+	Queued int
+	//Unsynced is the count of records appended since the last sync
+	Unsynced int
+	//SideJob is true in RunSideJobOnce, false right after a record is appended
+	SideJob bool
+	//SinceAppend is the time since the last record was appended
+	SinceAppend time.Duration
+}
+
+//GCPolicy decides when the journal region is garbage collected and synced
+type GCPolicy interface {
+	//ShouldFill returns true if the empty GC queue should be filled from the head of the journal
+	ShouldFill(state GCState) bool
+	//StepSize returns how many live entries a GC step relocates, 0 skips the step
+	StepSize(state GCState) int
+	//ShouldSync returns true if the appended records should be synced now
+	ShouldSync(state GCState) bool
+}
+
+//DefaultGCPolicy fills the GC queue after an append when half of the journal is used,
+//relocates one entry per append and syncs every SYNC_INTERVAL appends.
+//A side job fills the queue whenever it is empty and syncs every unsynced record
+type DefaultGCPolicy struct{}
+
+func (DefaultGCPolicy) ShouldFill(state GCState) bool {
+	return state.SideJob || state.Capacity < state.Usage*2
+}
+
+func (DefaultGCPolicy) StepSize(state GCState) int {
+	if state.SideJob {
+		return SIDE_JOB_GC_STEP
+	}
+	return 1
+}
+
+func (DefaultGCPolicy) ShouldSync(state GCState) bool {
+	if state.SideJob {
+		return state.Unsynced > 0
+	}
+	return state.Unsynced > SYNC_INTERVAL
+}
+
+//AggressiveGCPolicy starts GC when a quarter of the journal is used, and relocates
+//more entries per step, it keeps the journal short at the cost of write amplification
+type AggressiveGCPolicy struct{}
+
+func (AggressiveGCPolicy) ShouldFill(state GCState) bool {
+	return state.SideJob || state.Capacity < state.Usage*4
+}
+
+func (AggressiveGCPolicy) StepSize(state GCState) int {
+	if state.SideJob {
+		return SIDE_JOB_GC_STEP * 4
+	}
+	return 4
+}
+
+func (AggressiveGCPolicy) ShouldSync(state GCState) bool {
+	return DefaultGCPolicy{}.ShouldSync(state)
+}
+
+//IdleOnlyGCPolicy runs GC in the side jobs when nothing is appended for IdleAfter,
+//so the writes are not slowed down by GC. The appends still run GC when the journal
+//is nearly full, otherwise they would fail with JournalStorageFull
+type IdleOnlyGCPolicy struct {
+	IdleAfter time.Duration
+}
+
+func (policy IdleOnlyGCPolicy) idle(state GCState) bool {
+	return state.SideJob && state.SinceAppend >= policy.IdleAfter
+}
+
+func nearlyFull(state GCState) bool {
+	return state.Usage*8 > state.Capacity*7
+}
+
+func (policy IdleOnlyGCPolicy) ShouldFill(state GCState) bool {
+	return policy.idle(state) || nearlyFull(state)
+}
+
+func (policy IdleOnlyGCPolicy) StepSize(state GCState) int {
+	if policy.idle(state) {
+		return SIDE_JOB_GC_STEP
+	}
+	if nearlyFull(state) {
+		return 1
+	}
+	return 0
+}
+
+func (policy IdleOnlyGCPolicy) ShouldSync(state GCState) bool {
+	return DefaultGCPolicy{}.ShouldSync(state)
+}
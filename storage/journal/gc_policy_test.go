@@ -0,0 +1,61 @@
+package journal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultGCPolicy(t *testing.T) {
+	policy := DefaultGCPolicy{}
+	put := GCState{Usage: 100, Capacity: 1000}
+	assert.False(t, policy.ShouldFill(put))
+	put.Usage = 501
+	assert.True(t, policy.ShouldFill(put))
+	assert.Equal(t, 1, policy.StepSize(put))
+	put.Unsynced = SYNC_INTERVAL
+	assert.False(t, policy.ShouldSync(put))
+	put.Unsynced++
+	assert.True(t, policy.ShouldSync(put))
+
+	side := GCState{Usage: 0, Capacity: 1000, SideJob: true}
+	assert.True(t, policy.ShouldFill(side))
+	assert.Equal(t, SIDE_JOB_GC_STEP, policy.StepSize(side))
+	assert.False(t, policy.ShouldSync(side))
+	side.Unsynced = 1
+	assert.True(t, policy.ShouldSync(side))
+}
+
+func TestAggressiveGCPolicy(t *testing.T) {
+	policy := AggressiveGCPolicy{}
+	state := GCState{Usage: 251, Capacity: 1000}
+	assert.True(t, policy.ShouldFill(state))
+	assert.False(t, DefaultGCPolicy{}.ShouldFill(state))
+	assert.Equal(t, 4, policy.StepSize(state))
+	state.SideJob = true
+	assert.True(t, policy.StepSize(state) > DefaultGCPolicy{}.StepSize(state))
+}
+
+func TestIdleOnlyGCPolicy(t *testing.T) {
+	policy := IdleOnlyGCPolicy{IdleAfter: time.Second}
+	//the appends do not run GC
+	state := GCState{Usage: 800, Capacity: 1000}
+	assert.False(t, policy.ShouldFill(state))
+	assert.Equal(t, 0, policy.StepSize(state))
+
+	//neither the side jobs while the storage is busy
+	state.SideJob = true
+	state.SinceAppend = time.Millisecond
+	assert.False(t, policy.ShouldFill(state))
+	assert.Equal(t, 0, policy.StepSize(state))
+
+	state.SinceAppend = 2 * time.Second
+	assert.True(t, policy.ShouldFill(state))
+	assert.Equal(t, SIDE_JOB_GC_STEP, policy.StepSize(state))
+
+	//a nearly full journal is collected anyway
+	full := GCState{Usage: 900, Capacity: 1000}
+	assert.True(t, policy.ShouldFill(full))
+	assert.Equal(t, 1, policy.StepSize(full))
+}
@@ -1,36 +1,80 @@
 package journal
 
 import (
+	"encoding/binary"
+	"hash/crc32"
 	"io"
 
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/nvm"
 	"github.com/thesues/cannyls-go/util"
 )
 
-func NewJournalHeadRegion(nvm nvm.NonVolatileMemory) *JournalHeaderRegion {
-	ab := block.NewAlignedBytes(int(block.MIN), block.Min())
+/*
+The journal header is at the start of the journal region. HeadSector is one sector
+whose first 8 bytes are the head, the storages older than nvm.MINOR_VERSION_HEAD_SLOTS
+have it. HeadSlots is two sectors, each of them holds one slot:
+
+	magic "jhed" (4) | sequence (8) | size (8) | head (8) | retired (8) | crc32c of the bytes before (4)
+
+A write only writes the sector of the slot of the next sequence, so a torn write could
+only break that slot, the other one keeps the previous head. The valid slot of the highest
+sequence is the head. size is the size of the journal region the slot is written for, a slot
+of another size is not valid, so the head of a resized journal could be written before the
+storage header is switched to the new size. retired is the highest generation of the deleted lumps, their delete
+records are released with the head. HeadSector keeps it after the head
+*/
+
+//HeadLayout is the layout of the journal header
+type HeadLayout int
+
+const (
+	HeadSector HeadLayout = iota
+	HeadSlots
+)
+
+//Sectors returns the count of sectors of the journal header
+func (layout HeadLayout) Sectors() int {
+	if layout == HeadSlots {
+		return 2
+	}
+	return 1
+}
+
+var headSlotMagic = [4]byte{'j', 'h', 'e', 'd'}
+
+//NewJournalHeadRegion returns the journal header in nvm of the journal region of size bytes
+func NewJournalHeadRegion(nvm nvm.NonVolatileMemory, layout HeadLayout, size uint64) *JournalHeaderRegion {
+	ab := block.NewAlignedBytes(int(nvm.BlockSize().AsU16()), nvm.BlockSize())
 	ab.Align()
 	return &JournalHeaderRegion{
-		nvm: nvm,
-		ab:  ab,
+		nvm:    nvm,
+		ab:     ab,
+		layout: layout,
+		size:   size,
 	}
 }
 
 type JournalHeaderRegion struct {
 	nvm nvm.NonVolatileMemory
-	ab  *block.AlignedBytes
+	//ab is one sector
+	ab     *block.AlignedBytes
+	layout HeadLayout
+	//size is the size of the journal region
+	size uint64
+	//seq is the sequence of the newest slot
+	seq uint64
+	//retired is read with the head
+	retired uint64
 }
 
-func (headerRegion *JournalHeaderRegion) WriteTo(head uint64) (err error) {
-	buf := headerRegion.ab.AsBytes()
-	util.PutUINT64(buf[:8], head)
-	if _, err = headerRegion.nvm.Seek(0, io.SeekStart); err != nil {
-		return
-	}
-	if _, err = headerRegion.nvm.Write(buf); err != nil {
+func (headerRegion *JournalHeaderRegion) WriteTo(head uint64, retired uint64) (err error) {
+	if err = headerRegion.writeSlot(headerRegion.size, head, retired); err != nil {
 		return
 	}
+	headerRegion.seq++
 
 	return nil
 	//if storage crashed, and the headerRegion did not SYNC to disk.
@@ -39,15 +83,105 @@ func (headerRegion *JournalHeaderRegion) WriteTo(head uint64) (err error) {
 	//return headerRegion.nvm.Sync()
 }
 
+//WriteResized writes the head of the journal region resized to size bytes, and syncs it.
+//It takes the slot of the next sequence, which is not valid until the journal region
+//is size bytes. The sequence is not bumped, the next WriteTo overwrites the slot
+func (headerRegion *JournalHeaderRegion) WriteResized(size uint64, head uint64, retired uint64) error {
+	if headerRegion.layout != HeadSlots {
+		return errors.Wrap(internalerror.NotSupported, "the journal header has no head slots")
+	}
+	if err := headerRegion.writeSlot(size, head, retired); err != nil {
+		return err
+	}
+	return headerRegion.nvm.Sync()
+}
+
+//writeSlot writes the slot of the next sequence for the journal region of size bytes
+func (headerRegion *JournalHeaderRegion) writeSlot(size uint64, head uint64, retired uint64) (err error) {
+	buf := headerRegion.ab.AsBytes()
+	offset := putHead(buf, headerRegion.layout, headerRegion.seq+1, size, head, retired)
+	if _, err = headerRegion.nvm.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	_, err = headerRegion.nvm.Write(buf)
+	return
+}
+
+//WriteJournalHeader writes every sector of the journal header of the journal region
+//of size bytes whose head is head
+func WriteJournalHeader(writer io.Writer, sector block.BlockSize, layout HeadLayout, size uint64, head uint64, retired uint64) error {
+	slot := make([]byte, sector.AsU16())
+	offset := putHead(slot, layout, 1, size, head, retired)
+	buf := make([]byte, len(slot)*layout.Sectors())
+	copy(buf[offset:], slot)
+	_, err := writer.Write(buf)
+	return err
+}
+
 func (headerRegion *JournalHeaderRegion) ReadFrom() (head uint64, err error) {
 	head = 0
 	buf := headerRegion.ab.AsBytes()
-	if _, err = headerRegion.nvm.Seek(0, io.SeekStart); err != nil {
-		return
+	if headerRegion.layout == HeadSector {
+		if _, err = headerRegion.nvm.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = headerRegion.nvm.Read(buf); err != nil {
+			return
+		}
+		head = util.GetUINT64(buf[:8])
+		headerRegion.retired = util.GetUINT64(buf[8:16])
+		return head, nil
 	}
-	if _, err = headerRegion.nvm.Read(buf); err != nil {
-		return
+	found := false
+	for slot := 0; slot < 2; slot++ {
+		if _, err = headerRegion.nvm.Seek(int64(slot*len(buf)), io.SeekStart); err != nil {
+			return
+		}
+		if _, err = headerRegion.nvm.Read(buf); err != nil {
+			return
+		}
+		seq, size, h, retired, valid := getHeadSlot(buf)
+		if valid && size == headerRegion.size && (!found || seq > headerRegion.seq) {
+			found = true
+			headerRegion.seq = seq
+			headerRegion.retired = retired
+			head = h
+		}
+	}
+	if !found {
+		return 0, errors.Wrap(internalerror.StorageCorrupted, "both journal head slots are broken")
 	}
-	head = util.GetUINT64(buf[:8])
 	return head, nil
 }
+
+//Retired returns the highest generation of the deleted lumps read by ReadFrom
+func (headerRegion *JournalHeaderRegion) Retired() uint64 {
+	return headerRegion.retired
+}
+
+//putHead puts the head of sequence seq into sector, and returns the offset of the sector
+func putHead(sector []byte, layout HeadLayout, seq uint64, size uint64, head uint64, retired uint64) int64 {
+	if layout == HeadSector {
+		util.PutUINT64(sector[:8], head)
+		util.PutUINT64(sector[8:16], retired)
+		return 0
+	}
+	copy(sector[:4], headSlotMagic[:])
+	binary.BigEndian.PutUint64(sector[4:12], seq)
+	binary.BigEndian.PutUint64(sector[12:20], size)
+	binary.BigEndian.PutUint64(sector[20:28], head)
+	binary.BigEndian.PutUint64(sector[28:36], retired)
+	binary.BigEndian.PutUint32(sector[36:40], crc32.Checksum(sector[:36], crc32cTable))
+	return int64(seq%2) * int64(len(sector))
+}
+
+func getHeadSlot(buf []byte) (seq uint64, size uint64, head uint64, retired uint64, valid bool) {
+	if string(buf[:4]) != string(headSlotMagic[:]) {
+		return 0, 0, 0, 0, false
+	}
+	if binary.BigEndian.Uint32(buf[36:40]) != crc32.Checksum(buf[:36], crc32cTable) {
+		return 0, 0, 0, 0, false
+	}
+	return binary.BigEndian.Uint64(buf[4:12]), binary.BigEndian.Uint64(buf[12:20]),
+		binary.BigEndian.Uint64(buf[20:28]), binary.BigEndian.Uint64(buf[28:36]), true
+}
@@ -1,19 +1,97 @@
 package journal
 
 import (
+	"bytes"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/nvm"
 )
 
 func TestJournalHeaderRegion(t *testing.T) {
 	f, _ := nvm.New(1024)
-	region := NewJournalHeadRegion(f)
-	region.WriteTo(1234)
+	region := NewJournalHeadRegion(f, HeadSlots, 1024)
+	region.WriteTo(1234, 5)
 
 	head, err := region.ReadFrom()
 	assert.Nil(t, err)
 	assert.Equal(t, uint64(1234), head)
+	assert.Equal(t, uint64(5), region.Retired())
+}
+
+func TestJournalHeaderRegionSlots(t *testing.T) {
+	raw := make([]byte, 1024)
+	f, _ := nvm.NewFromVec(raw)
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteJournalHeader(buf, block.Min(), HeadSlots, 1024, 0, 0))
+	copy(raw, buf.Bytes())
+	region := NewJournalHeadRegion(f, HeadSlots, 1024)
+	_, err := region.ReadFrom()
+	assert.Nil(t, err)
+
+	//each write only changes the sector of its slot
+	before := append([]byte(nil), raw...)
+	assert.Nil(t, region.WriteTo(100, 0))
+	assert.Equal(t, before[512:], raw[512:])
+	before = append([]byte(nil), raw...)
+	assert.Nil(t, region.WriteTo(200, 7))
+	assert.Equal(t, before[:512], raw[:512])
+
+	reopened := NewJournalHeadRegion(f, HeadSlots, 1024)
+	head, err := reopened.ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(200), head)
+	assert.Equal(t, uint64(7), reopened.Retired())
+
+	//a torn write of the newest slot, the sequence 3 is in the second sector
+	raw[512+14]++
+	reopened = NewJournalHeadRegion(f, HeadSlots, 1024)
+	head, err = reopened.ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), head)
+
+	//the next write replaces the broken slot
+	assert.Nil(t, reopened.WriteTo(300, 0))
+	head, err = NewJournalHeadRegion(f, HeadSlots, 1024).ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(300), head)
 
+	//the head of the resized journal is only valid for the new size
+	region = NewJournalHeadRegion(f, HeadSlots, 1024)
+	_, err = region.ReadFrom()
+	assert.Nil(t, err)
+	assert.Nil(t, region.WriteResized(2048, 400, 0))
+	head, err = NewJournalHeadRegion(f, HeadSlots, 1024).ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(300), head)
+	head, err = NewJournalHeadRegion(f, HeadSlots, 2048).ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(400), head)
+
+	raw[14]++
+	raw[512+14]++
+	_, err = NewJournalHeadRegion(f, HeadSlots, 1024).ReadFrom()
+	assert.True(t, errors.Is(err, internalerror.StorageCorrupted))
+}
+
+func TestJournalHeaderRegionSector(t *testing.T) {
+	//the head is the first 8 bytes of the sector
+	raw := make([]byte, 512)
+	raw[7] = 42
+	f, _ := nvm.NewFromVec(raw)
+	region := NewJournalHeadRegion(f, HeadSector, 512)
+	head, err := region.ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), head)
+	assert.Equal(t, uint64(0), region.Retired())
+
+	assert.Nil(t, region.WriteTo(43, 3))
+	region = NewJournalHeadRegion(f, HeadSector, 512)
+	head, err = region.ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(43), head)
+	assert.Equal(t, uint64(3), region.Retired())
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/internalerror"
@@ -81,17 +82,20 @@ func (jb *JournalNvmBuffer) Read(buf []byte) (n int, err error) {
 	readBufEnd := jb.nvm.BlockSize().CeilAlign(jb.position + uint64(len(buf)))
 	jb.readBuf.AlignResize(uint32(readBufEnd - readBufStart))
 
-	x.JournalRegionMetric.Reads.M(1)
+	ostats.Record(context.Background(), x.JournalRegionMetric.Reads.M(1))
 	//fmt.Printf("len: ", jb.readBuf.Len())
 	//Seek the aligned sector and read from disk
 	if _, err := jb.nvm.Seek(int64(readBufStart), io.SeekStart); err != nil {
 		return -1, err
 	}
 
+	readStart := time.Now()
 	innerReadSize, err := jb.nvm.Read(jb.readBuf.AsBytes())
 	if err != nil && err != io.EOF {
 		return -1, err
 	}
+	x.RecordWithRegion(x.RegionJournal, x.NVMMetric.ReadLatency.M(x.SinceInMilliseconds(readStart)),
+		x.NVMMetric.IOSize.M(int64(jb.readBuf.Len())))
 
 	start := jb.position - readBufStart
 	end := util.Min(uint64(innerReadSize), start+uint64(len(buf)))
@@ -181,9 +185,12 @@ func (jb *JournalNvmBuffer) flushWriteBuffer() error {
 	if _, err := jb.nvm.Seek(int64(jb.writeBufOffset), io.SeekStart); err != nil {
 		return err
 	}
+	start := time.Now()
 	if _, err := jb.nvm.Write(jb.writeBuf.AsBytes()); err != nil {
 		return err
 	}
+	x.RecordWithRegion(x.RegionJournal, x.NVMMetric.WriteLatency.M(x.SinceInMilliseconds(start)),
+		x.NVMMetric.IOSize.M(int64(jb.writeBuf.Len())))
 	/*
 		x := jb.nvm.(*nvm.SnapNVM)
 		x.CreateSnapshotIfNeeded()
@@ -0,0 +1,106 @@
+package journal
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+//PointInTime is the index replayed from the journal up to a position
+type PointInTime struct {
+	Index *lumpindex.LumpIndex
+	//Position is where the replay stopped, Records is the count of the replayed records
+	Position uint64
+	Records  int64
+	//allocated are the data portions put after Position which were not used by
+	//the same lump before, or were updated in place, ordered by start
+	allocated []portion.DataPortion
+}
+
+//ReplayUntil replays the journal from the unreleased head into a new index. It stops
+//before the record at position until, or after records records, a negative until or
+//records of 0 does not stop it. The journal region is not changed.
+//The records relocated by journal GC after the position are not in the index,
+//their copies are after it
+func (journal *JournalRegion) ReplayUntil(until int64, records int64) (*PointInTime, error) {
+	pit := &PointInTime{Index: lumpindex.NewIndex()}
+	//state follows the index after the position, a put whose portion is not the one
+	//of the lump in state allocates it again
+	state := lumpindex.NewIndex()
+	defer state.Free()
+	stopped := false
+	end, err := journal.ring.walk(journal.ring.unreleasedHead, func(entry JournalEntry, sum RecordChecksum) (bool, error) {
+		position := entry.Start.AsU64()
+		if !sum.Valid() {
+			return false, errors.Wrapf(internalerror.StorageCorrupted, "failed to read journal record at %d: checksum mismatch", position)
+		}
+		if !stopped && (until >= 0 && position == uint64(until) || records > 0 && pit.Records == records) {
+			stopped = true
+			pit.Position = position
+		}
+		if !stopped {
+			applyEntry(pit.Index, entry, nil)
+			pit.Records++
+		} else if id, data, version, ok := putPortion(entry.Record); ok {
+			//the same portion with a newer generation is an update in place
+			if p, err := state.Get(id); err != nil || p != data || version > state.Version(id) {
+				pit.allocated = append(pit.allocated, data)
+			}
+		}
+		applyEntry(state, entry, nil)
+		return true, nil
+	})
+	if err == nil && !stopped {
+		pit.Position = end
+		if until >= 0 && uint64(until) != end {
+			err = errors.Wrapf(internalerror.InvalidInput, "no journal record at position %d", until)
+		}
+	}
+	if err != nil {
+		pit.Index.Free()
+		return nil, err
+	}
+	sort.Slice(pit.allocated, func(i, j int) bool {
+		return pit.allocated[i].Start < pit.allocated[j].Start
+	})
+	return pit, nil
+}
+
+func putPortion(record JournalRecord) (lump.LumpId, portion.DataPortion, uint64, bool) {
+	switch v := record.(type) {
+	case PutRecord:
+		return v.LumpID, v.DataPortion, 1, true
+	case PutWithMetaRecord:
+		return v.LumpID, v.DataPortion, 1, true
+	case PutVersionRecord:
+		return v.LumpID, v.DataPortion, v.Version, true
+	default:
+		return lump.EmptyLump(), portion.DataPortion{}, 0, false
+	}
+}
+
+//Overwritten returns true if a part of p is allocated again or updated in place after the position
+func (pit *PointInTime) Overwritten(p portion.DataPortion) bool {
+	//a portion is shorter than 1<<16 blocks, so the ones starting before from end before p
+	from := uint64(0)
+	if p.Start.AsU64() > 1<<16 {
+		from = p.Start.AsU64() - 1<<16
+	}
+	i := sort.Search(len(pit.allocated), func(i int) bool {
+		return pit.allocated[i].Start.AsU64() >= from
+	})
+	for ; i < len(pit.allocated) && pit.allocated[i].Start.AsU64() < p.End(); i++ {
+		if pit.allocated[i].End() > p.Start.AsU64() {
+			return true
+		}
+	}
+	return false
+}
+
+func (pit *PointInTime) Free() {
+	pit.Index.Free()
+}
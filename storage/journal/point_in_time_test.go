@@ -0,0 +1,24 @@
+package journal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func TestPointInTimeOverwritten(t *testing.T) {
+	pit := &PointInTime{allocated: []portion.DataPortion{
+		portion.NewDataPortion(10, 5),
+		portion.NewDataPortion(100, 0xFFFF),
+		portion.NewDataPortion(1<<20, 1),
+	}}
+	assert.False(t, pit.Overwritten(portion.NewDataPortion(0, 10)))
+	assert.True(t, pit.Overwritten(portion.NewDataPortion(0, 11)))
+	assert.True(t, pit.Overwritten(portion.NewDataPortion(14, 1)))
+	assert.False(t, pit.Overwritten(portion.NewDataPortion(15, 85)))
+	//a long portion which starts far before
+	assert.True(t, pit.Overwritten(portion.NewDataPortion(0xFFFF+99, 1)))
+	assert.False(t, pit.Overwritten(portion.NewDataPortion(0xFFFF+100, 1)))
+	assert.True(t, pit.Overwritten(portion.NewDataPortion(1<<20, 1)))
+}
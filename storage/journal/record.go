@@ -1,9 +1,12 @@
 package journal
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"hash/adler32"
+	"hash/crc32"
 	"io"
 
 	"github.com/pkg/errors"
@@ -23,14 +26,71 @@ const (
 	TAG_EMBED          byte = 4
 	TAG_DELETE         byte = 5
 	TAG_DELETE_RANGE   byte = 6
+	TAG_PUT_WITH_META  byte = 7
+	TAG_PUT_VERSION    byte = 8
+	TAG_EMBED_VERSION  byte = 9
+
+	//TAG_CRC32C is set in the tag of a record whose checksum is CRC32C of the tag and
+	//the rest of the record, instead of adler32. EndOfRecords and GoToFront never have it
+	TAG_CRC32C byte = 0x80
 )
+
+//RecordFormat is the checksum of the appended records, both formats are always read
+type RecordFormat int
+
+const (
+	RecordAdler32 RecordFormat = iota
+	RecordCRC32C
+)
+
+func (format RecordFormat) String() string {
+	switch format {
+	case RecordAdler32:
+		return "adler32"
+	case RecordCRC32C:
+		return "crc32c"
+	default:
+		return "unknown"
+	}
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+//TagName returns the name of a record tag, it is used by metrics and tools
+func TagName(tag byte) string {
+	switch tag {
+	case TAG_END_OF_RECORDS:
+		return "end_of_records"
+	case TAG_GO_TO_FRONT:
+		return "go_to_front"
+	case TAG_PUT:
+		return "put"
+	case TAG_EMBED:
+		return "embed"
+	case TAG_DELETE:
+		return "delete"
+	case TAG_DELETE_RANGE:
+		return "delete_range"
+	case TAG_PUT_WITH_META:
+		return "put_with_meta"
+	case TAG_PUT_VERSION:
+		return "put_version"
+	case TAG_EMBED_VERSION:
+		return "embed_version"
+	default:
+		return "unknown"
+	}
+}
 const (
 	RECORD_HEADER_SIZE   = 1 + 4 // TAG size + Checksum size
 	LUMPID_SIZE          = 8
 	LENGTH_SIZE          = 2
 	PORTION_SIZE         = 5
 	END_OF_RECORDS_SIZE  = 1 + 4 //Tag Size + Checksum size //GO_TO_FRONT and END_OF_RECORD
+	VERSION_SIZE         = 8
 	EMBEDDED_DATA_OFFSET = RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE
+	//EMBEDDED_VERSION_DATA_OFFSET is the offset of the data in an EmbedVersionRecord
+	EMBEDDED_VERSION_DATA_OFFSET = EMBEDDED_DATA_OFFSET + VERSION_SIZE
 )
 
 type JournalRecord interface {
@@ -38,6 +98,8 @@ type JournalRecord interface {
 	ExternalSize() uint32
 	CheckSum() uint32
 	Tag() byte
+	//writeBody writes the record after its checksum and tag
+	writeBody(io.Writer) error
 }
 
 type EndOfRecords struct{}
@@ -49,6 +111,22 @@ type PutRecord struct {
 	DataPortion portion.DataPortion
 }
 
+//PutWithMetaRecord is a PutRecord followed by the encoded lump.LumpMeta
+type PutWithMetaRecord struct {
+	LumpID      lump.LumpId
+	DataPortion portion.DataPortion
+	Meta        []byte
+}
+
+//PutVersionRecord is a PutWithMetaRecord with the generation of the lump,
+//it is only used if the generation is bigger than 1
+type PutVersionRecord struct {
+	LumpID      lump.LumpId
+	DataPortion portion.DataPortion
+	Version     uint64
+	Meta        []byte
+}
+
 type DeleteRecord struct {
 	LumpID lump.LumpId
 }
@@ -56,6 +134,13 @@ type EmbedRecord struct {
 	LumpID lump.LumpId
 	Data   []byte
 }
+//EmbedVersionRecord is an EmbedRecord with the generation of the lump,
+//it is only used if the generation is bigger than 1
+type EmbedVersionRecord struct {
+	LumpID  lump.LumpId
+	Version uint64
+	Data    []byte
+}
 type DeleteRange struct {
 	Start lump.LumpId
 	End   lump.LumpId
@@ -73,7 +158,7 @@ func (entry JournalEntry) End() uint64 {
 //
 
 func (record EndOfRecords) WriteTo(writer io.Writer) (err error) {
-	return writeRecordHeader(record, writer)
+	return encodeRecord(writer, record, RecordAdler32)
 }
 
 func (record EndOfRecords) ExternalSize() uint32 {
@@ -92,13 +177,17 @@ func (record EndOfRecords) Tag() byte {
 	return TAG_END_OF_RECORDS
 }
 
+func (record EndOfRecords) writeBody(writer io.Writer) error {
+	return nil
+}
+
 //
 func (record GoToFront) ExternalSize() uint32 {
 	return RECORD_HEADER_SIZE
 }
 
 func (record GoToFront) WriteTo(writer io.Writer) error {
-	return writeRecordHeader(record, writer)
+	return encodeRecord(writer, record, RecordAdler32)
 }
 
 func (record GoToFront) CheckSum() uint32 {
@@ -113,27 +202,30 @@ func (record GoToFront) Tag() byte {
 	return TAG_GO_TO_FRONT
 }
 
+func (record GoToFront) writeBody(writer io.Writer) error {
+	return nil
+}
+
 //
 func (record PutRecord) ExternalSize() uint32 {
 	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE
 }
 
 func (record PutRecord) WriteTo(writer io.Writer) error {
-	if err := writeRecordHeader(record, writer); err != nil {
-		return err
-	}
+	return encodeRecord(writer, record, RecordAdler32)
+}
+
+func (record PutRecord) writeBody(writer io.Writer) error {
 	if _, err := record.LumpID.Write(writer); err != nil {
 		return err
 	}
-	offset, len := record.DataPortion.AsInts()
-	//len + offset is 7 byte
+	offset, len := record.DataPortion.AsInts() //offset is always 40bit wide
+	// uint40 + uint16 = 7 bytes
 	var buf [7]byte
-	util.PutUINT16(buf[:2], len)
-	util.PutUINT40(buf[2:], offset)
-	if _, err := writer.Write(buf[:]); err != nil {
-		return err
-	}
-	return nil
+	util.PutUINT16(buf[:2], len)    //16bit
+	util.PutUINT40(buf[2:], offset) //40bit
+	_, err := writer.Write(buf[:])
+	return err
 }
 
 func (record PutRecord) Tag() byte {
@@ -141,41 +233,105 @@ func (record PutRecord) Tag() byte {
 }
 
 func (record PutRecord) CheckSum() uint32 {
-	var tag = []byte{TAG_PUT}
-	hash := adler32.New()
-	hash.Write(tag)
-	record.LumpID.Write(hash)
-	offset, len := record.DataPortion.AsInts() //offset is always 40bit wide
-	// uint40 + uint16 = 7 bytes
-	var buf [7]byte
-	util.PutUINT16(buf[:2], len)    //16bit
-	util.PutUINT40(buf[2:], offset) //40bit
-	hash.Write(buf[:])
-	return hash.Sum32()
+	return adler32Of(record)
 }
 
 //
 
-func (record DeleteRecord) ExternalSize() uint32 {
-	return RECORD_HEADER_SIZE + LUMPID_SIZE
+func (record PutWithMetaRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE + LENGTH_SIZE + uint32(len(record.Meta))
 }
 
-func (record DeleteRecord) WriteTo(writer io.Writer) error {
-	if err := writeRecordHeader(record, writer); err != nil {
+func (record PutWithMetaRecord) WriteTo(writer io.Writer) error {
+	return encodeRecord(writer, record, RecordAdler32)
+}
+
+func (record PutWithMetaRecord) writeBody(writer io.Writer) error {
+	if _, err := record.LumpID.Write(writer); err != nil {
 		return err
 	}
+	buf := record.portionAndMetaLen()
+	if _, err := writer.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := writer.Write(record.Meta)
+	return err
+}
+
+func (record PutWithMetaRecord) Tag() byte {
+	return TAG_PUT_WITH_META
+}
+
+func (record PutWithMetaRecord) CheckSum() uint32 {
+	return adler32Of(record)
+}
+
+//len + offset + len of meta is 9 bytes
+func (record PutWithMetaRecord) portionAndMetaLen() (buf [9]byte) {
+	offset, length := record.DataPortion.AsInts()
+	util.PutUINT16(buf[:2], length)
+	util.PutUINT40(buf[2:7], offset)
+	util.PutUINT16(buf[7:], uint16(len(record.Meta)))
+	return
+}
+
+//
+
+func (record PutVersionRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE + VERSION_SIZE + LENGTH_SIZE + uint32(len(record.Meta))
+}
+
+func (record PutVersionRecord) WriteTo(writer io.Writer) error {
+	return encodeRecord(writer, record, RecordAdler32)
+}
+
+func (record PutVersionRecord) writeBody(writer io.Writer) error {
 	if _, err := record.LumpID.Write(writer); err != nil {
 		return err
 	}
-	return nil
+	buf := record.portionVersionAndMetaLen()
+	if _, err := writer.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := writer.Write(record.Meta)
+	return err
+}
+
+func (record PutVersionRecord) Tag() byte {
+	return TAG_PUT_VERSION
+}
+
+func (record PutVersionRecord) CheckSum() uint32 {
+	return adler32Of(record)
+}
+
+//len + offset + version + len of meta is 17 bytes
+func (record PutVersionRecord) portionVersionAndMetaLen() (buf [17]byte) {
+	offset, length := record.DataPortion.AsInts()
+	util.PutUINT16(buf[:2], length)
+	util.PutUINT40(buf[2:7], offset)
+	binary.BigEndian.PutUint64(buf[7:15], record.Version)
+	util.PutUINT16(buf[15:], uint16(len(record.Meta)))
+	return
+}
+
+//
+
+func (record DeleteRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE
+}
+
+func (record DeleteRecord) WriteTo(writer io.Writer) error {
+	return encodeRecord(writer, record, RecordAdler32)
+}
+
+func (record DeleteRecord) writeBody(writer io.Writer) error {
+	_, err := record.LumpID.Write(writer)
+	return err
 }
 
 func (record DeleteRecord) CheckSum() uint32 {
-	var tag = []byte{TAG_DELETE}
-	hash := adler32.New()
-	hash.Write(tag)
-	record.LumpID.Write(hash)
-	return hash.Sum32()
+	return adler32Of(record)
 }
 
 func (record DeleteRecord) Tag() byte {
@@ -189,25 +345,23 @@ func (record EmbedRecord) ExternalSize() uint32 {
 }
 
 func (record EmbedRecord) WriteTo(w io.Writer) error {
-	if err := writeRecordHeader(record, w); err != nil {
-		return err
-	}
+	return encodeRecord(w, record, RecordAdler32)
+}
+
+func (record EmbedRecord) writeBody(w io.Writer) error {
 	if _, err := record.LumpID.Write(w); err != nil {
 		return err
 	}
 
 	//len is 2 bytes
-	if err := binary.Write(w, binary.BigEndian,
-		uint16(len(record.Data))); err != nil {
-		return err
-	}
-
-	if _, err := w.Write(record.Data); err != nil {
+	var buf [2]byte
+	util.PutUINT16(buf[:], uint16(len(record.Data)))
+	if _, err := w.Write(buf[:]); err != nil {
 		return err
 	}
 
-	return nil
-
+	_, err := w.Write(record.Data)
+	return err
 }
 
 func (record EmbedRecord) Tag() byte {
@@ -215,41 +369,62 @@ func (record EmbedRecord) Tag() byte {
 }
 
 func (record EmbedRecord) CheckSum() uint32 {
-	var tag = []byte{TAG_EMBED}
-	hash := adler32.New()
-	//tag
-	hash.Write(tag)
-	//lumpID
-	record.LumpID.Write(hash)
-	//length of data
-	var buf [2]byte
-	util.PutUINT16(buf[:], uint16(len(record.Data)))
-	hash.Write(buf[:])
-	//data
-	hash.Write(record.Data)
-	return hash.Sum32()
+	return adler32Of(record)
+}
+
+//
+
+func (record EmbedVersionRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + VERSION_SIZE + LENGTH_SIZE + uint32(len(record.Data))
+}
+
+func (record EmbedVersionRecord) WriteTo(w io.Writer) error {
+	return encodeRecord(w, record, RecordAdler32)
+}
+
+func (record EmbedVersionRecord) writeBody(w io.Writer) error {
+	if _, err := record.LumpID.Write(w); err != nil {
+		return err
+	}
+	buf := record.versionAndLen()
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(record.Data)
+	return err
+}
+
+func (record EmbedVersionRecord) Tag() byte {
+	return TAG_EMBED_VERSION
+}
+
+func (record EmbedVersionRecord) CheckSum() uint32 {
+	return adler32Of(record)
+}
+
+//version + len of data is 10 bytes
+func (record EmbedVersionRecord) versionAndLen() (buf [10]byte) {
+	binary.BigEndian.PutUint64(buf[:8], record.Version)
+	util.PutUINT16(buf[8:], uint16(len(record.Data)))
+	return
 }
 
 //
 
 func (record DeleteRange) CheckSum() uint32 {
-	var tag = []byte{TAG_DELETE_RANGE}
-	hash := adler32.New()
-	//tag
-	hash.Write(tag)
-	record.Start.Write(hash)
-	record.End.Write(hash)
-	return hash.Sum32()
+	return adler32Of(record)
 }
 
 func (record DeleteRange) WriteTo(w io.Writer) error {
-	if err := writeRecordHeader(record, w); err != nil {
+	return encodeRecord(w, record, RecordAdler32)
+}
+
+func (record DeleteRange) writeBody(w io.Writer) error {
+	if _, err := record.Start.Write(w); err != nil {
 		return err
 	}
-	record.Start.Write(w)
-	record.End.Write(w)
-
-	return nil
+	_, err := record.End.Write(w)
+	return err
 }
 
 func (record DeleteRange) ExternalSize() uint32 {
@@ -260,15 +435,91 @@ func (record DeleteRange) Tag() byte {
 	return TAG_DELETE_RANGE
 }
 
+//WriteRecord writes record with the checksum of format
+func WriteRecord(writer io.Writer, record JournalRecord, format RecordFormat) error {
+	return encodeRecord(writer, record, format)
+}
+
+//encodeRecord writes the header and the body of record in one write. Only the checksum
+//of format is computed, EndOfRecords and GoToFront always have their adler32 constants
+func encodeRecord(writer io.Writer, record JournalRecord, format RecordFormat) error {
+	tag := record.Tag()
+	if tag == TAG_END_OF_RECORDS || tag == TAG_GO_TO_FRONT {
+		return writeRecordHeader(record, writer)
+	}
+	buf := bytes.NewBuffer(make([]byte, RECORD_HEADER_SIZE, record.ExternalSize()))
+	if err := record.writeBody(buf); err != nil {
+		return err
+	}
+	raw := buf.Bytes()
+	raw[4] = tag
+	if format == RecordCRC32C {
+		raw[4] |= TAG_CRC32C
+		binary.BigEndian.PutUint32(raw[:4], crc32.Checksum(raw[4:], crc32cTable))
+	} else {
+		binary.BigEndian.PutUint32(raw[:4], adler32.Checksum(raw[4:]))
+	}
+	_, err := writer.Write(raw)
+	return err
+}
+
+//adler32Of is the adler32 of the tag and the body of record
+func adler32Of(record JournalRecord) uint32 {
+	hash := adler32.New()
+	hash.Write([]byte{record.Tag()})
+	record.writeBody(hash)
+	return hash.Sum32()
+}
+
 /*
 All the io.Read() should be io.ReadExact(), which means in parser, we
 expect read up 10 bytes, It must return 10 bytes, no more no less.
 */
 func ReadRecordFrom(reader io.Reader) (JournalRecord, error) {
-	checksum, tag, err := readRecordHeader(reader)
+	record, sum, err := readRecord(reader)
 	if err != nil {
 		return nil, err
 	}
+	if sum.Valid() {
+		return record, nil
+	}
+	if sum.Format == RecordCRC32C {
+		return nil, errors.Wrapf(internalerror.StorageCorrupted,
+			"tag: %d, on disk crc32c: %d , computed %d, mem: %+v", record.Tag(), sum.OnDisk, sum.Computed, record)
+	}
+	return nil, errors.Wrapf(internalerror.StorageCorrupted,
+		"tag: %d, on checksum disk: %d , computed %d, mem: %+v", record.Tag(), sum.OnDisk, sum.Computed, record)
+}
+
+//RecordChecksum is the checksum of a decoded record on disk, and the one computed from it
+type RecordChecksum struct {
+	Format   RecordFormat
+	OnDisk   uint32
+	Computed uint32
+}
+
+func (sum RecordChecksum) Valid() bool {
+	return sum.OnDisk == sum.Computed
+}
+
+//readRecord decodes a record without verifying its checksum
+func readRecord(reader io.Reader) (JournalRecord, RecordChecksum, error) {
+	var sum RecordChecksum
+	checksum, tag, err := readRecordHeader(reader)
+	if err != nil {
+		return nil, sum, err
+	}
+	//the checksum of a CRC32C record is computed over the bytes read
+	var crc hash.Hash32
+	if tag&TAG_CRC32C != 0 {
+		crc = crc32.New(crc32cTable)
+		crc.Write([]byte{tag})
+		reader = io.TeeReader(reader, crc)
+		tag &^= TAG_CRC32C
+		if tag == TAG_END_OF_RECORDS || tag == TAG_GO_TO_FRONT {
+			return nil, sum, errors.Wrapf(internalerror.StorageCorrupted, "unknown record tag %d", tag|TAG_CRC32C)
+		}
+	}
 	var record JournalRecord
 	var lumpID, start, end lump.LumpId
 
@@ -279,55 +530,103 @@ func ReadRecordFrom(reader io.Reader) (JournalRecord, error) {
 		record = GoToFront{}
 	case TAG_PUT:
 		if lumpID, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 		var buf [7]byte
 		if _, err := io.ReadFull(reader, buf[:]); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 		dataLen := util.GetUINT16(buf[:2])
 		dataOffset := util.GetUINT40(buf[2:])
 		portion := portion.NewDataPortion(dataOffset, dataLen)
 		record = PutRecord{LumpID: lumpID, DataPortion: portion}
+	case TAG_PUT_WITH_META:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, sum, err
+		}
+		var buf [9]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, sum, err
+		}
+		dataLen := util.GetUINT16(buf[:2])
+		dataOffset := util.GetUINT40(buf[2:7])
+		meta := make([]byte, util.GetUINT16(buf[7:]))
+		if _, err = io.ReadFull(reader, meta); err != nil {
+			return nil, sum, err
+		}
+		portion := portion.NewDataPortion(dataOffset, dataLen)
+		record = PutWithMetaRecord{LumpID: lumpID, DataPortion: portion, Meta: meta}
+	case TAG_PUT_VERSION:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, sum, err
+		}
+		var buf [17]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, sum, err
+		}
+		dataLen := util.GetUINT16(buf[:2])
+		dataOffset := util.GetUINT40(buf[2:7])
+		version := binary.BigEndian.Uint64(buf[7:15])
+		meta := make([]byte, util.GetUINT16(buf[15:]))
+		if _, err = io.ReadFull(reader, meta); err != nil {
+			return nil, sum, err
+		}
+		portion := portion.NewDataPortion(dataOffset, dataLen)
+		record = PutVersionRecord{LumpID: lumpID, DataPortion: portion, Version: version, Meta: meta}
 	case TAG_EMBED:
 		if lumpID, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 
 		var dataLenBuf [2]byte
 		if _, err := io.ReadFull(reader, dataLenBuf[:]); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 		dataLen := binary.BigEndian.Uint16(dataLenBuf[:])
 
 		data := make([]byte, dataLen)
 		if _, err = io.ReadFull(reader, data); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 		record = EmbedRecord{LumpID: lumpID, Data: data}
+	case TAG_EMBED_VERSION:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, sum, err
+		}
+		var buf [10]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, sum, err
+		}
+		version := binary.BigEndian.Uint64(buf[:8])
+		data := make([]byte, util.GetUINT16(buf[8:]))
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, sum, err
+		}
+		record = EmbedVersionRecord{LumpID: lumpID, Version: version, Data: data}
 	case TAG_DELETE:
 		if lumpID, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 		record = DeleteRecord{LumpID: lumpID}
 	case TAG_DELETE_RANGE:
 		if start, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 		if end, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, sum, err
 		}
 		record = DeleteRange{Start: start, End: end}
 	default:
-		panic("read tag error")
+		return nil, sum, errors.Wrapf(internalerror.StorageCorrupted, "unknown record tag %d", tag)
 	}
 
-	if checksum != record.CheckSum() {
-		return nil, errors.Wrapf(internalerror.StorageCorrupted,
-			"tag: %d, on checksum disk: %d , computed %d, mem: %+v", tag, checksum, record.CheckSum(), record)
+	sum.OnDisk = checksum
+	if crc != nil {
+		sum.Format, sum.Computed = RecordCRC32C, crc.Sum32()
+	} else {
+		sum.Format, sum.Computed = RecordAdler32, record.CheckSum()
 	}
-
-	return record, nil
+	return record, sum, nil
 }
 
 //helper
@@ -366,3 +665,46 @@ func readRecordHeader(reader io.Reader) (uint32, byte, error) {
 
 	return checksum, tag, nil
 }
+
+//recordSize returns the size of the record at the front of buf from its tag and length
+//fields, the checksum is not verified. If buf is too short to know it, the returned size
+//is bigger than len(buf). ok is false if the tag is unknown
+func recordSize(buf []byte) (size int, ok bool) {
+	if len(buf) < RECORD_HEADER_SIZE {
+		return RECORD_HEADER_SIZE, true
+	}
+	tag := buf[4]
+	if tag&TAG_CRC32C != 0 {
+		tag &^= TAG_CRC32C
+		if tag == TAG_END_OF_RECORDS || tag == TAG_GO_TO_FRONT {
+			return 0, false
+		}
+	}
+	//lengthAt is the offset of the length field which follows the fixed part
+	var lengthAt int
+	switch tag {
+	case TAG_END_OF_RECORDS, TAG_GO_TO_FRONT:
+		return END_OF_RECORDS_SIZE, true
+	case TAG_PUT:
+		return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE, true
+	case TAG_DELETE:
+		return RECORD_HEADER_SIZE + LUMPID_SIZE, true
+	case TAG_DELETE_RANGE:
+		return RECORD_HEADER_SIZE + 2*LUMPID_SIZE, true
+	case TAG_EMBED:
+		lengthAt = RECORD_HEADER_SIZE + LUMPID_SIZE
+	case TAG_PUT_WITH_META:
+		lengthAt = RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE
+	case TAG_PUT_VERSION:
+		lengthAt = RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE + VERSION_SIZE
+	case TAG_EMBED_VERSION:
+		lengthAt = RECORD_HEADER_SIZE + LUMPID_SIZE + VERSION_SIZE
+	default:
+		return 0, false
+	}
+	fixed := lengthAt + LENGTH_SIZE
+	if len(buf) < fixed {
+		return fixed, true
+	}
+	return fixed + int(binary.BigEndian.Uint16(buf[lengthAt:])), true
+}
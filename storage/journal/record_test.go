@@ -2,12 +2,16 @@ package journal
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/adler32"
 	"testing"
 
 	"encoding/hex"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/portion"
 )
@@ -25,6 +29,28 @@ func TestRecordWork(t *testing.T) {
 			LumpID:      lumpID("0A"),
 			DataPortion: portion.NewDataPortion((1<<40)-1, 0xFFFF),
 		},
+		PutWithMetaRecord{
+			LumpID:      lumpID("0B"),
+			DataPortion: portion.NewDataPortion(100, 10),
+			Meta:        []byte{3, 5, 'a', 'l', 'i', 'c', 'e'},
+		},
+		PutWithMetaRecord{
+			LumpID:      lumpID("0B"),
+			DataPortion: portion.NewDataPortion(100, 10),
+			Meta:        []byte{},
+		},
+		PutVersionRecord{
+			LumpID:      lumpID("0C"),
+			DataPortion: portion.NewDataPortion((1<<40)-1, 0xFFFF),
+			Version:     1 << 40,
+			Meta:        []byte{},
+		},
+		PutVersionRecord{
+			LumpID:      lumpID("0C"),
+			DataPortion: portion.NewDataPortion(100, 10),
+			Version:     2,
+			Meta:        []byte{3, 3, 'b', 'o', 'b'},
+		},
 		EmbedRecord{
 			LumpID: lumpID("1111"),
 			Data:   []byte("2222"),
@@ -48,6 +74,7 @@ func TestRecordWork(t *testing.T) {
 
 	for _, c := range cases {
 		c.WriteTo(buf)
+		assert.Equal(t, int(c.ExternalSize()), buf.Len())
 		c0, err := ReadRecordFrom(buf)
 		assert.Nil(t, err)
 		assert.Equal(t, c, c0)
@@ -68,6 +95,52 @@ func TestRecordCheckSum(t *testing.T) {
 	readSlice[6] += 1
 	_, err = ReadRecordFrom(bytes.NewBuffer(readSlice))
 	assert.Error(t, err)
+
+	//unknown tag is corrupted, not a panic
+	readSlice[4] = 99
+	_, err = ReadRecordFrom(bytes.NewBuffer(readSlice))
+	assert.True(t, errors.Is(err, internalerror.StorageCorrupted))
+}
+
+func TestRecordCRC32C(t *testing.T) {
+	cases := []JournalRecord{
+		PutRecord{LumpID: lumpID("0A"), DataPortion: portion.NewDataPortion(7, 10)},
+		PutVersionRecord{LumpID: lumpID("0B"), DataPortion: portion.NewDataPortion(1, 2), Version: 3, Meta: []byte("meta")},
+		EmbedRecord{LumpID: lumpID("1111"), Data: make([]byte, 0xFFFF)},
+		DeleteRange{Start: lumpID("123A"), End: lumpID("456B")},
+	}
+	for _, c := range cases {
+		buf := new(bytes.Buffer)
+		assert.Nil(t, WriteRecord(buf, c, RecordCRC32C))
+		assert.Equal(t, int(c.ExternalSize()), buf.Len())
+		raw := append([]byte{}, buf.Bytes()...)
+		assert.Equal(t, c.Tag()|TAG_CRC32C, raw[4])
+		c0, err := ReadRecordFrom(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, c, c0)
+
+		//both formats have the same body, each one has only its own checksum
+		plain := new(bytes.Buffer)
+		assert.Nil(t, WriteRecord(plain, c, RecordAdler32))
+		assert.Equal(t, raw[5:], plain.Bytes()[5:])
+		assert.Equal(t, c.Tag(), plain.Bytes()[4])
+		assert.Equal(t, c.CheckSum(), binary.BigEndian.Uint32(plain.Bytes()[:4]))
+		assert.Equal(t, adler32.Checksum(plain.Bytes()[4:]), c.CheckSum())
+
+		//the last byte is covered, including the embedded data
+		raw[len(raw)-1]++
+		_, err = ReadRecordFrom(bytes.NewReader(raw))
+		assert.True(t, errors.Is(err, internalerror.StorageCorrupted))
+	}
+
+	//EndOfRecords keeps its format, so the old readers find the end
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteRecord(buf, EndOfRecords{}, RecordCRC32C))
+	assert.Equal(t, TAG_END_OF_RECORDS, buf.Bytes()[4])
+	raw := append([]byte{}, buf.Bytes()...)
+	raw[4] |= TAG_CRC32C
+	_, err := ReadRecordFrom(bytes.NewReader(raw))
+	assert.True(t, errors.Is(err, internalerror.StorageCorrupted))
 }
 
 //helper funcion
@@ -0,0 +1,184 @@
+package journal
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+//RecoveryPolicy decides what the replay does with a journal record which could not be decoded
+type RecoveryPolicy int
+
+const (
+	//RecoverStrict fails the replay with StorageCorrupted, it is the default
+	RecoverStrict RecoveryPolicy = iota
+	//RecoverTruncateTail stops at the last valid record, the records after it are dropped
+	RecoverTruncateTail
+	//RecoverSkipCorrupted skips the corrupted bytes if a later valid record leads to the
+	//end of the journal, otherwise it truncates like RecoverTruncateTail
+	RecoverSkipCorrupted
+)
+
+func (policy RecoveryPolicy) String() string {
+	switch policy {
+	case RecoverStrict:
+		return "strict"
+	case RecoverTruncateTail:
+		return "truncate-tail"
+	case RecoverSkipCorrupted:
+		return "skip-corrupted"
+	default:
+		return "unknown"
+	}
+}
+
+//SkippedRange is [Start, End) of the ring buffer, End is less than Start if it wraps
+type SkippedRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+//RecoveryReport is the outcome of RestoreIndex
+type RecoveryReport struct {
+	Policy RecoveryPolicy `json:"policy"`
+	//Records is the count of replayed records
+	Records int64          `json:"records"`
+	Skipped []SkippedRange `json:"skipped"`
+	//Truncated is true if the journal is cut at TruncatedAt, the next record is written there
+	Truncated   bool   `json:"truncated"`
+	TruncatedAt uint64 `json:"truncatedat"`
+	//BytesLost counts the skipped bytes and the bytes of the dropped tail
+	BytesLost uint64 `json:"byteslost"`
+	//Cause is the decode error of the first corrupted record
+	Cause string `json:"cause,omitempty"`
+}
+
+//Clean returns true if every record of the journal is replayed
+func (report RecoveryReport) Clean() bool {
+	return !report.Truncated && len(report.Skipped) == 0
+}
+
+const (
+	resyncWindow  = 1 << 20
+	maxRecordSize = RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + lump.MAX_EMBEDDED_SIZE
+)
+
+func corruptedRecord(err error, pos uint64) error {
+	if errors.Is(err, internalerror.StorageCorrupted) {
+		return errors.Wrapf(err, "failed to read journal record at %d", pos)
+	}
+	return errors.Wrapf(internalerror.StorageCorrupted, "failed to read journal record at %d: %v", pos, err)
+}
+
+//distance is the count of bytes walking from a to b in the ring
+func (ring *JournalRingBuffer) distance(a, b uint64) uint64 {
+	if a <= b {
+		return b - a
+	}
+	return ring.Capacity() - a + b
+}
+
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	c.n += uint64(n)
+	return n, err
+}
+
+//badRecordSize returns the bytes read from pos before the record fails to decode
+func (ring *JournalRingBuffer) badRecordSize(pos uint64) uint64 {
+	readBuf := createSeekableReader(ring.nvm, 8*1024)
+	if _, err := readBuf.Seek(int64(pos), io.SeekStart); err != nil {
+		return 0
+	}
+	reader := &countingReader{r: readBuf}
+	ReadRecordFrom(reader)
+	return reader.n
+}
+
+//chainEnd follows the records from pos, and returns the position of EndOfRecords.
+//ok is false if a record fails to decode before it
+func (ring *JournalRingBuffer) chainEnd(pos uint64) (end uint64, ok bool) {
+	reader := createSeekableReader(ring.nvm, 8*1024)
+	if _, err := reader.Seek(int64(pos), io.SeekStart); err != nil {
+		return 0, false
+	}
+	var walked uint64
+	wrapped := false
+	for walked <= ring.Capacity() {
+		record, err := ReadRecordFrom(reader)
+		if err != nil {
+			return 0, false
+		}
+		switch record.(type) {
+		case EndOfRecords:
+			return pos, true
+		case GoToFront:
+			if wrapped {
+				return 0, false
+			}
+			wrapped = true
+			walked += ring.Capacity() - pos
+			pos = 0
+			if _, err = reader.Seek(0, io.SeekStart); err != nil {
+				return 0, false
+			}
+		default:
+			size := uint64(record.ExternalSize())
+			pos += size
+			walked += size
+		}
+	}
+	return 0, false
+}
+
+//resync looks for the first position after the corrupted record at bad, from which
+//the records lead to EndOfRecords. Only the bytes which could belong to the journal
+//are scanned: from bad to head, wrapping at the end of the ring
+func (ring *JournalRingBuffer) resync(bad uint64) (next uint64, end uint64, ok bool) {
+	spans := [][2]uint64{{bad + 1, ring.head}}
+	if bad >= ring.head {
+		spans = [][2]uint64{{bad + 1, ring.Capacity()}, {0, ring.head}}
+	}
+	buf := make([]byte, resyncWindow+maxRecordSize)
+	for _, span := range spans {
+		for start := span[0]; start < span[1]; start += resyncWindow {
+			n := uint64(len(buf))
+			if start+n > ring.Capacity() {
+				n = ring.Capacity() - start
+			}
+			if _, err := ring.nvm.Seek(int64(start), io.SeekStart); err != nil {
+				return 0, 0, false
+			}
+			read, err := ring.nvm.Read(buf[:n])
+			if err != nil {
+				return 0, 0, false
+			}
+			limit := span[1] - start
+			if limit > resyncWindow {
+				limit = resyncWindow
+			}
+			for off := uint64(0); off < limit && off < uint64(read); off++ {
+				record, err := ReadRecordFrom(bytes.NewReader(buf[off:read]))
+				if err != nil {
+					continue
+				}
+				//a lonely EndOfRecords replays nothing, it is not a valid record to resume from
+				if _, isEnd := record.(EndOfRecords); isEnd {
+					continue
+				}
+				if end, ok = ring.chainEnd(start + off); ok {
+					return start + off, end, true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -2,11 +2,12 @@ package journal
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/phf/go-queue/queue"
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
@@ -18,7 +19,6 @@ import (
 )
 
 const (
-	//GC_COUNT_IN_SIDE_JOB = 64
 	//performance related
 	GC_QUEUE_SIZE = 0x2000
 	SYNC_INTERVAL = 0x2000
@@ -28,39 +28,118 @@ type JournalRegion struct {
 	headerRegion  *JournalHeaderRegion
 	ring          *JournalRingBuffer
 	gcQueue       *queue.Queue
-	syncCountDown int
+	unsynced      int
+	lastAppend    time.Time
 	gcAfterAppend bool
+	policy        GCPolicy
 }
 
 func (journal *JournalRegion) SetAutomaticGcMode(gc bool) {
 	journal.gcAfterAppend = gc
 }
 
-func InitialJournalRegion(writer io.Writer, sector block.BlockSize) {
-	//journal header, in sector one
-	padding := sector.AsU16() - 8
-	var buf = make([]byte, padding)
-	writer.Write(buf)
+func (journal *JournalRegion) AutomaticGcMode() bool {
+	return journal.gcAfterAppend
+}
+
+//SetGCPolicy replaces the GC policy, nil restores DefaultGCPolicy
+func (journal *JournalRegion) SetGCPolicy(policy GCPolicy) {
+	if policy == nil {
+		policy = DefaultGCPolicy{}
+	}
+	journal.policy = policy
+}
+
+//SetRecordFormat sets the checksum of the records appended from now, the records
+//already in the journal are rewritten by GcAllEntries
+func (journal *JournalRegion) SetRecordFormat(format RecordFormat) {
+	journal.ring.format = format
+}
+
+func (journal *JournalRegion) RecordFormat() RecordFormat {
+	return journal.ring.format
+}
+
+func (journal *JournalRegion) GCPolicy() GCPolicy {
+	return journal.policy
+}
 
-	binary.Write(writer, binary.BigEndian, uint64(0))
+func (journal *JournalRegion) gcState(sideJob bool) GCState {
+	return GCState{
+		Usage:       journal.ring.Usage(),
+		Capacity:    journal.ring.Capacity(),
+		Queued:      journal.gcQueue.Len(),
+		Unsynced:    journal.unsynced,
+		SideJob:     sideJob,
+		SinceAppend: time.Since(journal.lastAppend),
+	}
+}
 
-	//first record in sector two
+//RelocationWindow returns a block aligned position of a ring buffer of capacity bytes,
+//which starts where this ring buffer starts. size bytes could be written there without
+//touching the records from the durable head to EndOfRecords, nor the ranges in used.
+//Flush the journal first
+func (journal *JournalRegion) RelocationWindow(capacity uint64, size uint64, used ...[2]uint64) (uint64, bool) {
+	ring := journal.ring
+	bs := ring.nvm.BlockSize()
+	head := bs.FloorAlign(ring.unreleasedHead)
+	tail := bs.CeilAlign(ring.tail + END_OF_RECORDS_SIZE)
+	busy := [][2]uint64{{head, tail}}
+	if ring.unreleasedHead > ring.tail {
+		busy = [][2]uint64{{0, tail}, {head, bs.CeilAlign(ring.Capacity())}}
+	}
+	busy = append(busy, used...)
+	candidates := []uint64{0}
+	for _, r := range busy {
+		candidates = append(candidates, r[1])
+	}
+	for _, start := range candidates {
+		end := start + size
+		if end > capacity {
+			continue
+		}
+		free := true
+		for _, r := range busy {
+			if start < r[1] && r[0] < end {
+				free = false
+			}
+		}
+		if free {
+			return start, true
+		}
+	}
+	return 0, false
+}
+
+//WriteRelocatedHead writes the head of the records moved to head of the journal region
+//resized to size bytes, see RelocationWindow. The current head stays valid until the storage
+//header is switched to the new size
+func (journal *JournalRegion) WriteRelocatedHead(size uint64, head uint64, retired uint64) error {
+	return journal.headerRegion.WriteResized(size, head, retired)
+}
+
+//InitialJournalRegion writes the empty journal region of size bytes
+func InitialJournalRegion(writer io.Writer, sector block.BlockSize, layout HeadLayout, size uint64) {
+	//journal header, in the first sectors
+	WriteJournalHeader(writer, sector, layout, size, 0, 0)
+
+	//first record in the sector after them
 	r := EndOfRecords{}
 	if err := r.WriteTo(writer); err != nil {
 		panic("failed to initialize JournalRegion")
 	}
 }
 
-func OpenJournalRegion(nvm nvm.NonVolatileMemory) (*JournalRegion, error) {
+func OpenJournalRegion(nvm nvm.NonVolatileMemory, layout HeadLayout) (*JournalRegion, error) {
 
 	blockSize := nvm.BlockSize()
 
-	headerNVM, ringNVM, err := nvm.Split(uint64(blockSize.AsU16()))
+	headerNVM, ringNVM, err := nvm.Split(uint64(blockSize.AsU16()) * uint64(layout.Sectors()))
 	if err != nil {
 		return nil, err
 	}
 
-	headerRegion := NewJournalHeadRegion(headerNVM)
+	headerRegion := NewJournalHeadRegion(headerNVM, layout, nvm.Capacity())
 	header, err := headerRegion.ReadFrom()
 	if err != nil {
 		return nil, err
@@ -79,51 +158,122 @@ func OpenJournalRegion(nvm nvm.NonVolatileMemory) (*JournalRegion, error) {
 		headerRegion:  headerRegion,
 		ring:          ring,
 		gcQueue:       q,
-		syncCountDown: SYNC_INTERVAL,
+		lastAppend:    time.Now(),
 		gcAfterAppend: true,
+		policy:        DefaultGCPolicy{},
 	}, nil
 }
 
-func (journal *JournalRegion) RestoreIndex(index *lumpindex.LumpIndex) {
-	var entry JournalEntry
-	var err error
-	iter := journal.ring.BufferedIter()
-	var i int64 = 0
-	for {
-		entry, err = iter.PopFront()
-		if err != nil {
-			if err != internalerror.NoEntries {
-				panic(fmt.Sprintf("Can not restore journal :%v", err))
-			}
-			break
-		}
-		switch record := entry.Record.(type) {
-		case PutRecord:
-			index.InsertDataPortion(record.LumpID, record.DataPortion)
-		case EmbedRecord:
-			portionOnJournal := portion.NewJournalPortion(entry.Start.AsU64()+EMBEDDED_DATA_OFFSET, uint16(len(record.Data)))
-			index.InsertJournalPortion(record.LumpID, portionOnJournal)
-		case DeleteRange:
-			index.DeleteRange(record.Start, record.End)
-		case DeleteRecord:
-			index.Delete(record.LumpID)
-		case EndOfRecords, GoToFront:
-			panic("read out an unexpected record")
-		default:
-			panic("never be here")
-		}
-		i++
+//RestoreIndex replays the journal into index on the calling goroutine, see ReplayIndex
+func (journal *JournalRegion) RestoreIndex(index *lumpindex.LumpIndex, policy RecoveryPolicy) (RecoveryReport, error) {
+	return journal.ReplayIndex(index, ReplayOptions{Policy: policy})
+}
 
+//ReplayIndex replays the journal into index. A record which could not be decoded
+//fails the replay with StorageCorrupted, unless opts.Policy recovers from it.
+//The journal is not written, PersistRecovery writes the outcome of the recovery.
+//With more than one worker, the journal is read ahead and decoded in parallel, and the
+//records are applied in order. From a broken record on, it is replayed serially
+func (journal *JournalRegion) ReplayIndex(index *lumpindex.LumpIndex, opts ReplayOptions) (RecoveryReport, error) {
+	report := RecoveryReport{Policy: opts.Policy}
+	ring := journal.ring
+	//the delete records before the head are released, their generations are in the header
+	if journal.headerRegion != nil {
+		index.SetRetired(journal.headerRegion.Retired())
+	}
+	if opts.Workers <= 1 || !journal.replayParallel(index, opts, &report) {
+		if err := journal.replaySerial(index, opts, &report); err != nil {
+			return report, err
+		}
 	}
 
 	//metric
-	ostats.Record(context.Background(), x.JournalRegionMetric.RecordCounts.M(i))
+	ostats.Record(context.Background(), x.JournalRegionMetric.RecordCounts.M(report.Records))
 	//update usage
-	journal.ring.DoStoreUsage()
+	ring.DoStoreUsage()
+	return report, nil
+}
 
+//replaySerial replays the journal from ring.tail
+func (journal *JournalRegion) replaySerial(index *lumpindex.LumpIndex, opts ReplayOptions, report *RecoveryReport) error {
+	policy := opts.Policy
+	ring := journal.ring
+	iter := ring.bufferedIterAt(ring.tail)
 	//this iter has more than one goroutine to read data from nvm
 	//It must be sure all the goroutines are closed before normal operations
-	iter.Close()
+	defer func() {
+		iter.Close()
+	}()
+	for {
+		entry, err := iter.PopFront()
+		if err == internalerror.NoEntries {
+			break
+		}
+		if err != nil {
+			//ring.tail is the start of the corrupted record
+			bad := ring.tail
+			if policy == RecoverStrict {
+				return corruptedRecord(err, bad)
+			}
+			if report.Cause == "" {
+				report.Cause = corruptedRecord(err, bad).Error()
+			}
+			//the read ahead goroutine must not read the ring while it is scanned
+			iter.Close()
+			next, end, found := ring.resync(bad)
+			if policy == RecoverSkipCorrupted && found {
+				report.Skipped = append(report.Skipped, SkippedRange{Start: bad, End: next})
+				report.BytesLost += ring.distance(bad, next)
+				ring.skips[bad] = next
+				ring.tail = next
+				iter = ring.bufferedIterAt(next)
+				continue
+			}
+			report.Truncated = true
+			report.TruncatedAt = bad
+			if found {
+				report.BytesLost += ring.distance(bad, end)
+			} else {
+				report.BytesLost += ring.badRecordSize(bad)
+			}
+			break
+		}
+		applyEntry(index, entry, opts.Tracker)
+		report.Records++
+	}
+	return nil
+}
+
+//PersistRecovery writes the outcome of a recovered replay, so the next open does not
+//meet the corrupted records again: a truncated journal ends with EndOfRecords at
+//TruncatedAt, and the live records are relocated by a full GC, so the head passes the
+//skipped ranges. The journal is synced
+func (journal *JournalRegion) PersistRecovery(index *lumpindex.LumpIndex, report RecoveryReport) error {
+	ring := journal.ring
+	if report.Truncated {
+		if _, err := ring.nvm.Seek(int64(ring.tail), io.SeekStart); err != nil {
+			return err
+		}
+		if err := (EndOfRecords{}).WriteTo(ring.nvm); err != nil {
+			return errors.Wrap(err, "failed to truncate journal")
+		}
+		if err := ring.Flush(); err != nil {
+			return errors.Wrap(err, "failed to truncate journal")
+		}
+	}
+	if len(report.Skipped) > 0 {
+		if err := journal.GcAllEntries(index); err != nil {
+			return err
+		}
+	}
+	return journal.Sync()
+}
+
+func restoreMeta(index *lumpindex.LumpIndex, id lump.LumpId, encoded []byte) {
+	index.SetMeta(id, encoded)
+	if meta, err := lump.DecodeLumpMeta(encoded); err == nil && !meta.ExpireAt.IsZero() {
+		index.SetExpire(id, meta.ExpireAt.UnixNano())
+	}
 }
 
 func (journal *JournalRegion) append(index *lumpindex.LumpIndex, record JournalRecord) error {
@@ -137,6 +287,9 @@ func (journal *JournalRegion) append(index *lumpindex.LumpIndex, record JournalR
 	switch v := record.(type) {
 	case EmbedRecord:
 		index.InsertJournalPortion(v.LumpID, embeded)
+	case EmbedVersionRecord:
+		index.InsertJournalPortion(v.LumpID, embeded)
+		index.SetVersion(v.LumpID, v.Version)
 	}
 	return nil
 }
@@ -144,15 +297,37 @@ func (journal *JournalRegion) append(index *lumpindex.LumpIndex, record JournalR
 func (journal *JournalRegion) appendWithGC(index *lumpindex.LumpIndex, record JournalRecord) (err error) {
 	//metric
 	ostats.Record(context.Background(), x.JournalRegionMetric.RecordCounts.M(+1))
+	x.RecordWithType(TagName(record.Tag()), x.JournalRegionMetric.Appends.M(1))
 
 	if err = journal.append(index, record); err != nil {
 		return err
 	}
+	journal.unsynced++
+	journal.lastAppend = time.Now()
 	if journal.gcAfterAppend {
-		journal.gcOnce(index)
+		state := journal.gcState(false)
+		if journal.gcQueue.Len() == 0 && journal.policy.ShouldFill(state) {
+			if err = journal.fillGCQueue(index); err != nil {
+				return err
+			}
+		}
+		if err = journal.gcOnce(index, journal.policy.StepSize(state)); err != nil {
+			return err
+		}
 	}
-	journal.trySync()
-	return
+	return journal.trySync()
+}
+
+//UnreleasedHead is the position of the oldest record which is kept in the journal
+func (journal *JournalRegion) UnreleasedHead() uint64 {
+	return journal.ring.unreleasedHead
+}
+
+//Retained returns true if position is between the unreleased head and the tail,
+//the bytes there are not overwritten until the head is released past them
+func (journal *JournalRegion) Retained(position uint64) bool {
+	ring := journal.ring
+	return ring.distance(ring.unreleasedHead, position) < ring.distance(ring.unreleasedHead, ring.tail)
 }
 
 //thread safe
@@ -168,6 +343,8 @@ func (Journal *JournalRegion) isGarbage(index *lumpindex.LumpIndex, entry Journa
 	var ok bool
 	record := entry.Record.(JournalRecord)
 	switch v := record.(type) {
+	//an update in place puts the same portion again with the next generation,
+	//the records of the previous generations are garbage
 	case PutRecord:
 		if p, err = index.Get(v.LumpID); err != nil {
 			return true
@@ -177,7 +354,23 @@ func (Journal *JournalRegion) isGarbage(index *lumpindex.LumpIndex, entry Journa
 			return true
 		}
 
-		return dataPortion != v.DataPortion
+		return dataPortion != v.DataPortion || index.Version(v.LumpID) != 1
+	case PutWithMetaRecord:
+		if p, err = index.Get(v.LumpID); err != nil {
+			return true
+		}
+		if dataPortion, ok = p.(portion.DataPortion); !ok {
+			return true
+		}
+		return dataPortion != v.DataPortion || index.Version(v.LumpID) != 1
+	case PutVersionRecord:
+		if p, err = index.Get(v.LumpID); err != nil {
+			return true
+		}
+		if dataPortion, ok = p.(portion.DataPortion); !ok {
+			return true
+		}
+		return dataPortion != v.DataPortion || index.Version(v.LumpID) != v.Version
 	case EmbedRecord:
 		//not found in current index, is garbage
 		if p, err = index.Get(v.LumpID); err != nil {
@@ -193,35 +386,46 @@ func (Journal *JournalRegion) isGarbage(index *lumpindex.LumpIndex, entry Journa
 		} else {
 			return true
 		}
+	case EmbedVersionRecord:
+		if p, err = index.Get(v.LumpID); err != nil {
+			return true
+		}
+		if journalPortion, ok = p.(portion.JournalPortion); !ok {
+			return true
+		}
+		return journalPortion.Start != entry.Start+EMBEDDED_VERSION_DATA_OFFSET || int(journalPortion.Len) != len(v.Data)
 	default: /*delete, delete range are garbage*/
 		return true
 	}
 }
 
-func (journal *JournalRegion) gcOnce(index *lumpindex.LumpIndex) {
-	if journal.gcQueue.Len() == 0 && journal.ring.Capacity() < journal.ring.Usage()*2 {
-		journal.fillGCQueue()
+//gcOnce pops the GC queue until live entries are relocated, or the queue is empty
+func (journal *JournalRegion) gcOnce(index *lumpindex.LumpIndex, live int) error {
+	if live <= 0 {
+		return nil
 	}
-
-	for {
-		if e := journal.gcQueue.PopFront(); e != nil {
-			entry := e.(JournalEntry)
-
-			if journal.isGarbage(index, entry) == false {
-				record := entry.Record
-				journal.append(index, record)
-				goto ENDFOR
-			}
-			//metric, if record is garbage, the recordCount should decrease
-			ostats.Record(context.Background(), x.JournalRegionMetric.RecordCounts.M(-1))
-
-		} else {
+	start := time.Now()
+	for live > 0 {
+		e := journal.gcQueue.PopFront()
+		if e == nil {
 			break
 		}
+		entry := e.(JournalEntry)
+		if journal.isGarbage(index, entry) == false {
+			if err := journal.append(index, entry.Record); err != nil {
+				//keep the entry, it is still live
+				journal.gcQueue.PushFront(entry)
+				return err
+			}
+			live--
+			continue
+		}
+		//metric, if record is garbage, the recordCount should decrease
+		ostats.Record(context.Background(), x.JournalRegionMetric.RecordCounts.M(-1))
 	}
 
-ENDFOR:
-	ostats.Record(context.Background(), x.JournalRegionMetric.GcQueueSize.M(int64(journal.gcQueue.Len())))
+	ostats.Record(context.Background(), x.JournalRegionMetric.GcQueueSize.M(int64(journal.gcQueue.Len())),
+		x.JournalRegionMetric.GcStepLatency.M(x.SinceInMilliseconds(start)))
 
 	/*
 		front := journal.gcQueue.Front()
@@ -235,25 +439,32 @@ ENDFOR:
 			journal.ring.ReleaseBytesUntil(head)
 		}
 	*/
-
+	return nil
 }
 
-func (journal *JournalRegion) writeUnusedJournalHeader(head uint64) {
-	journal.headerRegion.WriteTo(head)
+//writeUnusedJournalHeader releases the journal before head, the delete records
+//released leave the generations of their lumps in the retired of the header
+func (journal *JournalRegion) writeUnusedJournalHeader(index *lumpindex.LumpIndex, head uint64) error {
+	if err := journal.headerRegion.WriteTo(head, index.Retired()); err != nil {
+		return errors.Wrap(err, "failed to write journal header")
+	}
 	journal.ring.ReleaseBytesUntil(head)
+	return nil
 }
 
-func (journal *JournalRegion) fillGCQueue() {
+func (journal *JournalRegion) fillGCQueue(index *lumpindex.LumpIndex) error {
 
 	var err error
 	if journal.ring.isEmpty() {
-		return
+		return nil
 	}
 
 	if err = journal.ring.Flush(); err != nil {
-		panic(fmt.Sprintf("fillGCQueue %+v", err))
+		return errors.Wrap(err, "failed to flush journal before GC")
+	}
+	if err = journal.writeUnusedJournalHeader(index, journal.ring.head); err != nil {
+		return err
 	}
-	journal.writeUnusedJournalHeader(journal.ring.head)
 
 	var i int
 	i = 0
@@ -265,35 +476,35 @@ func (journal *JournalRegion) fillGCQueue() {
 			break
 		}
 		if err != nil {
-			panic(fmt.Sprintf("Journal failed to read entries %+v", err))
+			return errors.Wrap(err, "journal failed to read entries")
 		}
 		journal.gcQueue.PushBack(entry)
 		i++
 	}
 	//metric
 	ostats.Record(context.Background(), x.JournalRegionMetric.GcQueueSize.M(int64(journal.gcQueue.Len())))
+	return nil
 }
 
-func (journal *JournalRegion) Sync() {
-	var err error
-	if err = journal.ring.Sync(); err != nil {
-		panic(fmt.Sprintf("journal sync failed: %v", err))
+func (journal *JournalRegion) Sync() error {
+	if err := journal.ring.Sync(); err != nil {
+		return errors.Wrap(err, "journal sync failed")
 	}
-	journal.syncCountDown = SYNC_INTERVAL
+	journal.unsynced = 0
 	//metric
 	ostats.Record(context.Background(), x.JournalRegionMetric.Syncs.M(1))
+	return nil
 }
 
 func (journal *JournalRegion) Flush() error {
 	return journal.ring.Flush()
 }
 
-func (journal *JournalRegion) trySync() {
-	if journal.syncCountDown <= 0 {
-		journal.Sync()
-	} else {
-		journal.syncCountDown -= 1
+func (journal *JournalRegion) trySync() error {
+	if journal.policy.ShouldSync(journal.gcState(false)) {
+		return journal.Sync()
 	}
+	return nil
 }
 
 //Write Journal, Update Index
@@ -305,6 +516,33 @@ func (journal *JournalRegion) RecordPut(index *lumpindex.LumpIndex, id lump.Lump
 	return journal.appendWithGC(index, record)
 }
 
+//RecordPutWithMeta records a put and the encoded lump.LumpMeta of the lump
+func (journal *JournalRegion) RecordPutWithMeta(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion, meta []byte) error {
+	if len(meta) > lump.MAX_META_SIZE {
+		return errors.Wrap(internalerror.InvalidInput, "meta is too large")
+	}
+	record := PutWithMetaRecord{
+		LumpID:      id,
+		DataPortion: data,
+		Meta:        meta,
+	}
+	return journal.appendWithGC(index, record)
+}
+
+//RecordPutVersion records a put with the generation of the lump and its encoded lump.LumpMeta
+func (journal *JournalRegion) RecordPutVersion(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion, version uint64, meta []byte) error {
+	if len(meta) > lump.MAX_META_SIZE {
+		return errors.Wrap(internalerror.InvalidInput, "meta is too large")
+	}
+	record := PutVersionRecord{
+		LumpID:      id,
+		DataPortion: data,
+		Version:     version,
+		Meta:        meta,
+	}
+	return journal.appendWithGC(index, record)
+}
+
 //WARNING: this will update the INDEX
 func (journal *JournalRegion) RecordEmbed(index *lumpindex.LumpIndex, id lump.LumpId, data []byte) error {
 	if len(data) > lump.MAX_EMBEDDED_SIZE {
@@ -317,6 +555,19 @@ func (journal *JournalRegion) RecordEmbed(index *lumpindex.LumpIndex, id lump.Lu
 	return journal.appendWithGC(index, record)
 }
 
+//RecordEmbedVersion is RecordEmbed with the generation of the lump, it updates the INDEX too
+func (journal *JournalRegion) RecordEmbedVersion(index *lumpindex.LumpIndex, id lump.LumpId, data []byte, version uint64) error {
+	if len(data) > lump.MAX_EMBEDDED_SIZE {
+		return internalerror.InvalidInput
+	}
+	record := EmbedVersionRecord{
+		LumpID:  id,
+		Version: version,
+		Data:    data,
+	}
+	return journal.appendWithGC(index, record)
+}
+
 func (journal *JournalRegion) RecordDelete(index *lumpindex.LumpIndex, id lump.LumpId) error {
 	record := DeleteRecord{
 		LumpID: id,
@@ -332,17 +583,21 @@ func (journal *JournalRegion) RecordDeleteRange(index *lumpindex.LumpIndex, star
 	return journal.appendWithGC(index, record)
 }
 
-func (journal *JournalRegion) RunSideJobOnce(index *lumpindex.LumpIndex, countSideJob int) {
-	if journal.gcQueue.Len() == 0 {
-		journal.fillGCQueue()
-	} else if journal.syncCountDown != SYNC_INTERVAL {
-		journal.Sync()
-	} else {
-		for i := 0; i < countSideJob; i++ {
-			journal.gcOnce(index)
-		}
-		journal.trySync()
+//RunSideJobOnce fills the GC queue, or syncs, or relocates countSideJob live entries,
+//as the policy decides. countSideJob <= 0 takes the step size of the policy, and a
+//policy returning 0 skips the step whatever countSideJob is
+func (journal *JournalRegion) RunSideJobOnce(index *lumpindex.LumpIndex, countSideJob int) error {
+	state := journal.gcState(true)
+	if journal.gcQueue.Len() == 0 && journal.policy.ShouldFill(state) {
+		return journal.fillGCQueue(index)
+	} else if journal.policy.ShouldSync(state) {
+		return journal.Sync()
 	}
+	step := journal.policy.StepSize(state)
+	if step > 0 && countSideJob > 0 {
+		step = countSideJob
+	}
+	return journal.gcOnce(index, step)
 }
 
 func (journal *JournalRegion) GetEmbededData(embeded portion.JournalPortion) (buf []byte, err error) {
@@ -353,10 +608,13 @@ func (journal *JournalRegion) GetEmbededData(embeded portion.JournalPortion) (bu
 	return
 }
 
-func (journal *JournalRegion) gcAllEntriesInQueue(index *lumpindex.LumpIndex) {
+func (journal *JournalRegion) gcAllEntriesInQueue(index *lumpindex.LumpIndex) error {
 	for journal.gcQueue.Len() != 0 {
-		journal.gcOnce(index)
+		if err := journal.gcOnce(index, journal.gcQueue.Len()); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (journal *JournalRegion) JournalEntries() (uint64, uint64, uint64, []JournalEntry) {
@@ -375,23 +633,57 @@ func (journal *JournalRegion) JournalEntries() (uint64, uint64, uint64, []Journa
 	return journal.ring.unreleasedHead, journal.ring.head, journal.ring.tail, entries
 }
 
+//DumpEntry is a journal record read by DumpEntries
+type DumpEntry struct {
+	Position uint64
+	Record   JournalRecord
+	//Checksum is not valid if the record is corrupted, the walk goes on after it
+	Checksum RecordChecksum
+	//Garbage is true if the index does not need the record
+	Garbage bool
+}
+
+//DumpEntries calls fn for each record from position from to EndOfRecords, one at a time.
+//A record which could not be decoded fails the walk with StorageCorrupted
+func (journal *JournalRegion) DumpEntries(index *lumpindex.LumpIndex, from uint64, fn func(DumpEntry) error) error {
+	_, err := journal.ring.walk(from, func(entry JournalEntry, sum RecordChecksum) (bool, error) {
+		err := fn(DumpEntry{
+			Position: entry.Start.AsU64(),
+			Record:   entry.Record,
+			Checksum: sum,
+			Garbage:  journal.isGarbage(index, entry),
+		})
+		return err == nil, err
+	})
+	return err
+}
+
 //maybe sync
-func (journal *JournalRegion) GcAllEntries(index *lumpindex.LumpIndex) {
+func (journal *JournalRegion) GcAllEntries(index *lumpindex.LumpIndex) error {
 	tail := journal.ring.Tail()
 	for {
 		before_head := journal.ring.Head()
 
 		if journal.gcQueue.Len() == 0 {
-			journal.fillGCQueue()
+			if err := journal.fillGCQueue(index); err != nil {
+				return err
+			}
 		}
 
-		journal.gcAllEntriesInQueue(index)
+		if err := journal.gcAllEntriesInQueue(index); err != nil {
+			return err
+		}
 
 		if between(before_head, tail, journal.ring.Head()) {
 			break
 		}
 	}
-	journal.writeUnusedJournalHeader(journal.ring.Head())
+	//the live entries are relocated into the write buffer, they must reach the
+	//disk before the header points after their old position
+	if err := journal.ring.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush journal after GC")
+	}
+	return journal.writeUnusedJournalHeader(index, journal.ring.Head())
 	//assert head == unreleased_head
 	//journal.headerRegion.WriteTo(journal.ring.Head())
 	//journal.Sync()
@@ -0,0 +1,279 @@
+package journal
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/thesues/cannyls-go/address"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+//PortionTracker follows the data portions of the index while the journal is replayed,
+//it is called in journal order on the goroutine which inserts into the index
+type PortionTracker interface {
+	Use(p portion.DataPortion)
+	Release(p portion.DataPortion)
+}
+
+//ReplayOptions tunes ReplayIndex
+type ReplayOptions struct {
+	Policy RecoveryPolicy
+	//Workers is the count of goroutines decoding the records, 0 or 1 replays the
+	//journal on the calling goroutine
+	Workers int
+	//Tracker is told about every data portion used or released by the replay, it may be nil
+	Tracker PortionTracker
+}
+
+const replayChunkSize = 1 << 20
+
+//replayBatch is the records framed in one chunk of the ring. The reader cuts the chunk
+//at the record boundaries, a worker decodes it, and the records are applied in order
+type replayBatch struct {
+	//start is the position of buf[0] in the ring
+	start uint64
+	buf   []byte
+	//ends are the end offsets of the records in buf
+	ends []int
+	//next is where the replay continues after the batch
+	next uint64
+	//last is true if the batch is the last one, complete is true if it ends at EndOfRecords,
+	//otherwise the journal is replayed serially from next
+	last     bool
+	complete bool
+	entries  []JournalEntry
+	done     chan struct{}
+}
+
+func newReplayBatch(start uint64, buf []byte) *replayBatch {
+	return &replayBatch{
+		start: start,
+		buf:   buf,
+		done:  make(chan struct{}),
+	}
+}
+
+func (batch *replayBatch) decode() {
+	off := 0
+	for _, end := range batch.ends {
+		record, err := ReadRecordFrom(bytes.NewReader(batch.buf[off:end]))
+		if err != nil {
+			batch.next = batch.start + uint64(off)
+			batch.last = true
+			batch.complete = false
+			break
+		}
+		batch.entries = append(batch.entries, JournalEntry{
+			Start:  address.AddressFromU64(batch.start + uint64(off)),
+			Record: record,
+		})
+		off = end
+	}
+	batch.buf = nil
+	close(batch.done)
+}
+
+//readBatches reads the ring from position, and sends the framed batches to ordered and
+//work. The last batch stops at EndOfRecords or at the first record which could not be
+//framed, both channels are closed when it returns
+func (ring *JournalRingBuffer) readBatches(position uint64, ordered chan<- *replayBatch,
+	work chan<- *replayBatch, stop <-chan struct{}) {
+
+	defer close(ordered)
+	defer close(work)
+	send := func(batch *replayBatch) bool {
+		select {
+		case ordered <- batch:
+		case <-stop:
+			return false
+		}
+		select {
+		case work <- batch:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	//carry is the head of a record which is cut by the end of the previous chunk
+	var carry []byte
+	wrapped := false
+read:
+	for {
+		readAt := position + uint64(len(carry))
+		size := uint64(replayChunkSize)
+		if readAt+size > ring.Capacity() {
+			size = ring.Capacity() - readAt
+		}
+		buf := make([]byte, uint64(len(carry))+size)
+		copy(buf, carry)
+		var err error
+		if size > 0 {
+			if _, err = ring.nvm.Seek(int64(readAt), 0); err == nil {
+				_, err = ring.nvm.Read(buf[len(carry):])
+			}
+		}
+		batch := newReplayBatch(position, buf)
+		off := 0
+	frame:
+		for err == nil {
+			recordLen, ok := recordSize(buf[off:])
+			if !ok {
+				break
+			}
+			if off+recordLen > len(buf) {
+				if size == 0 {
+					//the record runs over the end of the ring
+					break
+				}
+				carry = buf[off:]
+				batch.next = position + uint64(off)
+				if !send(batch) {
+					return
+				}
+				position = batch.next
+				continue read
+			}
+			switch buf[off+4] {
+			case TAG_END_OF_RECORDS, TAG_GO_TO_FRONT:
+				if _, err = ReadRecordFrom(bytes.NewReader(buf[off : off+recordLen])); err != nil {
+					break frame
+				}
+			}
+			switch buf[off+4] {
+			case TAG_END_OF_RECORDS:
+				batch.next = position + uint64(off)
+				batch.last, batch.complete = true, true
+				send(batch)
+				return
+			case TAG_GO_TO_FRONT:
+				if wrapped {
+					break frame
+				}
+				wrapped = true
+				batch.next = 0
+				if !send(batch) {
+					return
+				}
+				position, carry = 0, nil
+				continue read
+			}
+			off += recordLen
+			batch.ends = append(batch.ends, off)
+		}
+		//the serial replay reads the broken record again and handles it by the policy
+		batch.next = position + uint64(off)
+		batch.last = true
+		send(batch)
+		return
+	}
+}
+
+//replayParallel applies the batches decoded by the workers in journal order. It returns
+//true if the journal is replayed to EndOfRecords, otherwise ring.tail is where the
+//serial replay continues
+func (journal *JournalRegion) replayParallel(index *lumpindex.LumpIndex, opts ReplayOptions, report *RecoveryReport) bool {
+	ring := journal.ring
+	stop := make(chan struct{})
+	ordered := make(chan *replayBatch, 2*opts.Workers)
+	work := make(chan *replayBatch, opts.Workers)
+	var wg sync.WaitGroup
+	wg.Add(1 + opts.Workers)
+	go func() {
+		defer wg.Done()
+		ring.readBatches(ring.tail, ordered, work, stop)
+	}()
+	for i := 0; i < opts.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range work {
+				batch.decode()
+			}
+		}()
+	}
+	//the reader uses ring.nvm, it must exit before the serial replay
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for batch := range ordered {
+		<-batch.done
+		for _, entry := range batch.entries {
+			applyEntry(index, entry, opts.Tracker)
+			report.Records++
+		}
+		ring.tail = batch.next
+		if batch.last {
+			return batch.complete
+		}
+	}
+	return false
+}
+
+//applyEntry replays entry into index, tracker may be nil
+func applyEntry(index *lumpindex.LumpIndex, entry JournalEntry, tracker PortionTracker) {
+	switch record := entry.Record.(type) {
+	case PutRecord:
+		releasePortion(index, record.LumpID, tracker)
+		index.InsertDataPortion(record.LumpID, record.DataPortion)
+		usePortion(record.DataPortion, tracker)
+	case PutWithMetaRecord:
+		releasePortion(index, record.LumpID, tracker)
+		index.InsertDataPortion(record.LumpID, record.DataPortion)
+		usePortion(record.DataPortion, tracker)
+		restoreMeta(index, record.LumpID, record.Meta)
+	case PutVersionRecord:
+		releasePortion(index, record.LumpID, tracker)
+		index.InsertDataPortion(record.LumpID, record.DataPortion)
+		usePortion(record.DataPortion, tracker)
+		restoreMeta(index, record.LumpID, record.Meta)
+		index.SetVersion(record.LumpID, record.Version)
+	case EmbedRecord:
+		releasePortion(index, record.LumpID, tracker)
+		portionOnJournal := portion.NewJournalPortion(entry.Start.AsU64()+EMBEDDED_DATA_OFFSET, uint16(len(record.Data)))
+		index.InsertJournalPortion(record.LumpID, portionOnJournal)
+	case EmbedVersionRecord:
+		releasePortion(index, record.LumpID, tracker)
+		portionOnJournal := portion.NewJournalPortion(entry.Start.AsU64()+EMBEDDED_VERSION_DATA_OFFSET, uint16(len(record.Data)))
+		index.InsertJournalPortion(record.LumpID, portionOnJournal)
+		index.SetVersion(record.LumpID, record.Version)
+	case DeleteRange:
+		if tracker != nil {
+			index.RangeIter(record.Start, record.End, func(_ lump.LumpId, p portion.Portion) error {
+				if data, ok := p.(portion.DataPortion); ok {
+					tracker.Release(data)
+				}
+				return nil
+			})
+		}
+		index.DeleteRange(record.Start, record.End)
+	case DeleteRecord:
+		releasePortion(index, record.LumpID, tracker)
+		index.Delete(record.LumpID)
+	case EndOfRecords, GoToFront:
+		panic("read out an unexpected record")
+	default:
+		panic("never be here")
+	}
+}
+
+func usePortion(p portion.DataPortion, tracker PortionTracker) {
+	if tracker != nil {
+		tracker.Use(p)
+	}
+}
+
+//releasePortion tells tracker that the data portion of id is no longer used
+func releasePortion(index *lumpindex.LumpIndex, id lump.LumpId, tracker PortionTracker) {
+	if tracker == nil {
+		return
+	}
+	if p, err := index.Get(id); err == nil {
+		if data, ok := p.(portion.DataPortion); ok {
+			tracker.Release(data)
+		}
+	}
+}
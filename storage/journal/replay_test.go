@@ -0,0 +1,203 @@
+package journal
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/allocator"
+)
+
+var replayRecords = flag.Int("replay-records", 10000000, "count of the records in the journal of BenchmarkReplayIndex")
+
+type portionMap map[portion.DataPortion]bool
+
+func (m portionMap) Use(p portion.DataPortion) {
+	m[p] = true
+}
+
+func (m portionMap) Release(p portion.DataPortion) {
+	delete(m, p)
+}
+
+//replayTestRecords returns n records over about n/4 lumps, every kind of record is there
+func replayTestRecords(n int) []JournalRecord {
+	records := make([]JournalRecord, 0, n)
+	for i := 0; i < n; i++ {
+		id := lump.FromU64(0, uint64(i*7%(n/4+1)))
+		data := portion.NewDataPortion(uint64(i)*10, 5)
+		switch i % 50 {
+		case 7:
+			records = append(records, EmbedRecord{LumpID: id, Data: bytes.Repeat([]byte{byte(i)}, i%100)})
+		case 13:
+			records = append(records, DeleteRecord{LumpID: id})
+		case 29:
+			records = append(records, PutWithMetaRecord{LumpID: id, DataPortion: data, Meta: []byte("meta")})
+		case 31:
+			records = append(records, PutVersionRecord{LumpID: id, DataPortion: data, Version: uint64(i), Meta: []byte("v")})
+		default:
+			records = append(records, PutRecord{LumpID: id, DataPortion: data})
+		}
+		if i%10000 == 9999 {
+			records = append(records, DeleteRange{Start: id, End: lump.FromU64(0, id.U64()+100)})
+		}
+	}
+	return records
+}
+
+//newReplayTestRing enqueues records from start of a ring of capacity, the records in
+//odd positions are CRC32C records. It returns the start of each record
+func newReplayTestRing(t *testing.T, capacity uint64, start uint64, records []JournalRecord) (*nvm.MemoryNVM, []uint64) {
+	f, err := nvm.New(capacity)
+	assert.Nil(t, err)
+	ring := NewJournalRingBuffer(NewJournalNvmBuffer(f), start)
+	positions := make([]uint64, 0, len(records))
+	for i, record := range records {
+		ring.format = RecordFormat(i % 2)
+		if ring.isOverFlow(record) {
+			positions = append(positions, 0)
+		} else {
+			positions = append(positions, ring.tail)
+		}
+		_, err := ring.Enqueue(record)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, ring.Sync())
+	return f, positions
+}
+
+func replayTestIndex(f nvm.NonVolatileMemory, start uint64, opts ReplayOptions) (*lumpindex.LumpIndex, *JournalRegion, RecoveryReport, error) {
+	journal := &JournalRegion{ring: NewJournalRingBuffer(NewJournalNvmBuffer(f), start)}
+	index := lumpindex.NewIndex()
+	report, err := journal.ReplayIndex(index, opts)
+	return index, journal, report, err
+}
+
+func dumpIndex(index *lumpindex.LumpIndex) map[uint64]portion.Portion {
+	dump := make(map[uint64]portion.Portion)
+	index.RangeIter(lump.FromU64(0, 0), lump.FromU64(0, math.MaxUint64), func(id lump.LumpId, p portion.Portion) error {
+		dump[id.U64()] = p
+		return nil
+	})
+	return dump
+}
+
+func TestReplayIndexParallel(t *testing.T) {
+	records := replayTestRecords(100000)
+	//the journal starts near the end of the ring, and wraps by GoToFront
+	var capacity, start uint64 = 4 << 20, 3 << 20
+	f, _ := newReplayTestRing(t, capacity, start, records)
+
+	serial, serialJournal, serialReport, err := replayTestIndex(f, start, ReplayOptions{})
+	assert.Nil(t, err)
+	assert.True(t, serialReport.Clean())
+	assert.Equal(t, int64(len(records)), serialReport.Records)
+
+	for _, workers := range []int{2, 4, 16} {
+		tracker := make(portionMap)
+		index, journal, report, err := replayTestIndex(f, start, ReplayOptions{Workers: workers, Tracker: tracker})
+		assert.Nil(t, err)
+		assert.Equal(t, serialReport, report)
+		assert.Equal(t, serialJournal.ring.tail, journal.ring.tail)
+		assert.Equal(t, dumpIndex(serial), dumpIndex(index))
+
+		//the tracker follows the data portions of the index
+		portions := make(portionMap)
+		for _, p := range index.DataPortions()[1:] {
+			portions[p] = true
+		}
+		assert.Equal(t, portions, tracker)
+		index.Free()
+	}
+	serial.Free()
+
+	//the parallel replay reaches EndOfRecords by itself, without the serial one
+	journal := &JournalRegion{ring: NewJournalRingBuffer(NewJournalNvmBuffer(f), start)}
+	index := lumpindex.NewIndex()
+	var report RecoveryReport
+	assert.True(t, journal.replayParallel(index, ReplayOptions{Workers: 4}, &report))
+	assert.Equal(t, int64(len(records)), report.Records)
+	index.Free()
+}
+
+func TestReplayIndexParallelCorrupted(t *testing.T) {
+	records := replayTestRecords(100000)
+	f, positions := newReplayTestRing(t, 4<<20, 0, records)
+	//a broken put in the second chunk, the records after it still lead to EndOfRecords
+	bad := 70000
+	for ; positions[bad] < replayChunkSize; bad++ {
+	}
+	for ; bad < len(records); bad++ {
+		if _, ok := records[bad].(PutRecord); ok {
+			break
+		}
+	}
+	f.AsBytes()[positions[bad]+RECORD_HEADER_SIZE] ^= 0xFF
+
+	for _, policy := range []RecoveryPolicy{RecoverStrict, RecoverTruncateTail, RecoverSkipCorrupted} {
+		serial, serialJournal, serialReport, serialErr := replayTestIndex(f, 0, ReplayOptions{Policy: policy})
+		index, journal, report, err := replayTestIndex(f, 0, ReplayOptions{Policy: policy, Workers: 4})
+		assert.Equal(t, fmt.Sprint(serialErr), fmt.Sprint(err))
+		assert.Equal(t, serialReport, report)
+		assert.Equal(t, serialJournal.ring.tail, journal.ring.tail)
+		assert.Equal(t, dumpIndex(serial), dumpIndex(index))
+		switch policy {
+		case RecoverStrict:
+			assert.Error(t, err)
+		case RecoverTruncateTail:
+			assert.True(t, report.Truncated)
+			assert.Equal(t, int64(bad), report.Records)
+		case RecoverSkipCorrupted:
+			assert.Equal(t, 1, len(report.Skipped))
+			assert.Equal(t, int64(len(records)-1), report.Records)
+		}
+		serial.Free()
+		index.Free()
+	}
+}
+
+func BenchmarkReplayIndex(b *testing.B) {
+	n := *replayRecords
+	//the journal is written directly, so a big one is built quickly
+	buf := bytes.NewBuffer(make([]byte, 0, n*(RECORD_HEADER_SIZE+LUMPID_SIZE+LENGTH_SIZE+PORTION_SIZE)+int(block.MIN)))
+	for i := 0; i < n; i++ {
+		id := lump.FromU64(0, uint64(i%(n/2+1)))
+		var record JournalRecord = PutRecord{LumpID: id, DataPortion: portion.NewDataPortion(uint64(i)*10, 5)}
+		if i%10 == 9 {
+			record = DeleteRecord{LumpID: id}
+		}
+		if err := WriteRecord(buf, record, RecordCRC32C); err != nil {
+			b.Fatal(err)
+		}
+	}
+	EndOfRecords{}.WriteTo(buf)
+	vec := make([]byte, block.Min().CeilAlign(uint64(buf.Len())))
+	copy(vec, buf.Bytes())
+	f, err := nvm.NewFromVec(vec)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(vec)))
+			for i := 0; i < b.N; i++ {
+				portions := allocator.NewPortionSet()
+				index, _, report, err := replayTestIndex(f, 0, ReplayOptions{Workers: workers, Tracker: portions})
+				portions.Done().Free()
+				if err != nil || report.Records != int64(n) {
+					b.Fatalf("replayed %d records: %v", report.Records, err)
+				}
+				index.Free()
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 
 	"github.com/klauspost/readahead"
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/address"
 	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/nvm"
@@ -23,6 +24,11 @@ type JournalRingBuffer struct {
 	tail           uint64
 	//usage field is atomic, only used for collecting metrics
 	usage uint64
+	//skips are the corrupted ranges skipped by RestoreIndex, from start to end.
+	//DequeueIter jumps over them until the head passes
+	skips map[uint64]uint64
+	//format is the checksum of the enqueued records
+	format RecordFormat
 }
 
 func (ring *JournalRingBuffer) Head() uint64 {
@@ -40,6 +46,7 @@ func NewJournalRingBuffer(nvm *JournalNvmBuffer, head uint64) *JournalRingBuffer
 		unreleasedHead: head,
 		head:           head,
 		tail:           head,
+		skips:          make(map[uint64]uint64),
 	}
 }
 
@@ -115,7 +122,7 @@ func (ring *JournalRingBuffer) Enqueue(record JournalRecord) (jportion portion.J
 	if _, err = ring.nvm.Seek(int64(ring.tail), io.SeekStart); err != nil {
 		return
 	}
-	if err = record.WriteTo(ring.nvm); err != nil {
+	if err = WriteRecord(ring.nvm, record, ring.format); err != nil {
 		return
 	}
 	ring.tail = ring.nvm.Position()
@@ -129,6 +136,8 @@ func (ring *JournalRingBuffer) Enqueue(record JournalRecord) (jportion portion.J
 	switch r := record.(type) {
 	case EmbedRecord:
 		jportion = portion.NewJournalPortion(preTail+EMBEDDED_DATA_OFFSET, uint16(len(r.Data)))
+	case EmbedVersionRecord:
+		jportion = portion.NewJournalPortion(preTail+EMBEDDED_VERSION_DATA_OFFSET, uint16(len(r.Data)))
 	}
 
 	ring.DoStoreUsage()
@@ -175,6 +184,13 @@ type DequeueIter struct {
 }
 
 func (iter DequeueIter) PopFront() (entry JournalEntry, err error) {
+	if next, ok := iter.ring.skips[iter.ring.head]; ok {
+		delete(iter.ring.skips, iter.ring.head)
+		iter.ring.head = next
+		if _, err = iter.readBuf.Seek(int64(next), io.SeekStart); err != nil {
+			return JournalEntry{}, err
+		}
+	}
 	record, err := ReadRecordFrom(iter.readBuf)
 	if err != nil {
 		return JournalEntry{}, err
@@ -243,6 +259,10 @@ type ReadIter struct {
 
 /* No buffer and update nothing */
 func (iter ReadIter) PopFront() (entry JournalEntry, err error) {
+	if next, ok := iter.ring.skips[iter.ring.nvm.Position()]; ok {
+		iter.ring.nvm.Seek(int64(next), io.SeekStart)
+	}
+	start := iter.ring.nvm.Position()
 	record, err := ReadRecordFrom(iter.ring.nvm)
 	if err != nil {
 		return JournalEntry{}, err
@@ -256,22 +276,72 @@ func (iter ReadIter) PopFront() (entry JournalEntry, err error) {
 		return JournalEntry{}, internalerror.NoEntries
 	default:
 		entry = JournalEntry{
-			Start:  address.AddressFromU64(iter.ring.head),
+			Start:  address.AddressFromU64(start),
 			Record: record,
 		}
-		//current = entry.End()
 		return entry, nil
 	}
 }
 
+//walk reads the records from position from to EndOfRecords without changing the ring, and
+//calls fn with each of them until it returns false. The checksums are not verified by walk.
+//It returns the position where it stopped
+func (ring *JournalRingBuffer) walk(from uint64, fn func(JournalEntry, RecordChecksum) (bool, error)) (uint64, error) {
+	if from >= ring.Capacity() {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "position %d is out of the journal of %d bytes", from, ring.Capacity())
+	}
+	reader := createSeekableReader(ring.nvm, 8*1024)
+	position := from
+	if _, err := reader.Seek(int64(position), io.SeekStart); err != nil {
+		return 0, err
+	}
+	wrapped := false
+	for {
+		if next, ok := ring.skips[position]; ok {
+			position = next
+			if _, err := reader.Seek(int64(position), io.SeekStart); err != nil {
+				return 0, err
+			}
+		}
+		record, sum, err := readRecord(reader)
+		if err != nil {
+			return 0, corruptedRecord(err, position)
+		}
+		switch record.(type) {
+		case EndOfRecords:
+			return position, nil
+		case GoToFront:
+			if wrapped {
+				return 0, errors.Wrapf(internalerror.StorageCorrupted, "second GoToFront at %d", position)
+			}
+			wrapped = true
+			position = 0
+			if _, err := reader.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		entry := JournalEntry{Start: address.AddressFromU64(position), Record: record}
+		next, err := fn(entry, sum)
+		if err != nil || !next {
+			return position, err
+		}
+		position = entry.End()
+	}
+}
+
 /*Use Buffer and update tail*/
 func (ring *JournalRingBuffer) BufferedIter() BufferedIter {
+	return ring.bufferedIterAt(ring.head)
+}
+
+func (ring *JournalRingBuffer) bufferedIterAt(position uint64) BufferedIter {
 	ra, err := readahead.NewReadSeekerSize(ring.nvm, 4, 1<<20)
 	if err != nil {
 		panic("should not happen in create readahead buf")
 	}
 
-	if _, err := ra.Seek(int64(ring.head), 0); err != nil {
+	if _, err := ra.Seek(int64(position), 0); err != nil {
 		panic(fmt.Sprintf("panic in new DequeueIter %+v", err))
 	}
 	return BufferedIter{
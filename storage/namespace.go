@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+//Namespace is a named range [Start, End) of the LumpId space. The puts which make
+//the namespace exceed its quotas fail with a *QuotaError. Lumps out of any namespace
+//have no quota
+type Namespace struct {
+	Name  string
+	Start lump.LumpId
+	End   lump.LumpId
+	//MaxBytes limits the space on disk used by the lumps, 0 means unlimited
+	MaxBytes uint64
+	//MaxLumps limits the count of lumps, 0 means unlimited
+	MaxLumps uint64
+}
+
+type NamespaceUsage struct {
+	Name     string `json:"name"`
+	Start    uint64 `json:"start"`
+	End      uint64 `json:"end"`
+	Bytes    uint64 `json:"bytes"`
+	Lumps    uint64 `json:"lumps"`
+	MaxBytes uint64 `json:"maxbytes"`
+	MaxLumps uint64 `json:"maxlumps"`
+}
+
+//QuotaError is returned by the puts which exceed the quota of a namespace
+type QuotaError struct {
+	Op        string
+	Id        lump.LumpId
+	Namespace string
+	//Bytes and Lumps are the usage of the namespace if the put succeeded
+	Bytes uint64
+	Lumps uint64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s: namespace %s would use %d bytes and %d lumps: %v",
+		e.Op, e.Id.String(), e.Namespace, e.Bytes, e.Lumps, internalerror.QuotaExceeded)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return internalerror.QuotaExceeded
+}
+
+func (e *QuotaError) Cause() error {
+	return internalerror.QuotaExceeded
+}
+
+type namespaceState struct {
+	Namespace
+	bytes uint64
+	lumps uint64
+}
+
+//namespaces are ordered by Start, and they do not overlap. store.i protects them
+type namespaces []*namespaceState
+
+func (list namespaces) find(id lump.LumpId) *namespaceState {
+	i := sort.Search(len(list), func(i int) bool {
+		return list[i].End.U64() > id.U64()
+	})
+	if i < len(list) && list[i].Start.U64() <= id.U64() {
+		return list[i]
+	}
+	return nil
+}
+
+func (list namespaces) byName(name string) int {
+	for i, ns := range list {
+		if ns.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+//dataSizeOnDisk is the size of a portion which holds n bytes in the data region
+func dataSizeOnDisk(n uint32) uint64 {
+	return block.Min().CeilAlign(uint64(n) + uint64(LUMP_DATA_TRAILER_SIZE))
+}
+
+//DeclareNamespace adds ns, its usage is counted from the lumps already in its range.
+//It is not kept in the storage, so declare the namespaces every time the storage is
+//opened, or use Options.Namespaces
+func (store *Storage) DeclareNamespace(ns Namespace) error {
+	store.i.Lock()
+	defer store.i.Unlock()
+	if !store.opened {
+		return internalerror.StorageClosed
+	}
+	return store.declareNamespace(ns)
+}
+
+func (store *Storage) declareNamespace(ns Namespace) error {
+	if ns.Name == "" || ns.Start.U64() >= ns.End.U64() {
+		return errors.Wrap(internalerror.InvalidInput, "namespace needs a name and a non-empty range")
+	}
+	if store.namespaces.byName(ns.Name) >= 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "namespace %s exists", ns.Name)
+	}
+	for _, other := range store.namespaces {
+		if ns.Start.U64() < other.End.U64() && other.Start.U64() < ns.End.U64() {
+			return errors.Wrapf(internalerror.InvalidInput, "namespace %s overlaps %s", ns.Name, other.Name)
+		}
+	}
+	state := &namespaceState{Namespace: ns}
+	store.index.RangeIter(ns.Start, ns.End, func(id lump.LumpId, p portion.Portion) error {
+		state.bytes += uint64(p.SizeOnDisk(block.Min()))
+		state.lumps++
+		return nil
+	})
+	store.namespaces = append(store.namespaces, state)
+	sort.Slice(store.namespaces, func(i, j int) bool {
+		return store.namespaces[i].Start.U64() < store.namespaces[j].Start.U64()
+	})
+	return nil
+}
+
+//DropNamespace deletes all the lumps of the namespace by DeleteRange, and removes it
+func (store *Storage) DropNamespace(name string) error {
+	store.i.RLock()
+	i := store.namespaces.byName(name)
+	var ns Namespace
+	if i >= 0 {
+		ns = store.namespaces[i].Namespace
+	}
+	store.i.RUnlock()
+	if i < 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "namespace %s does not exist", name)
+	}
+	if err := store.DeleteRange(ns.Start, ns.End, true); err != nil {
+		return err
+	}
+	store.i.Lock()
+	defer store.i.Unlock()
+	if i = store.namespaces.byName(name); i >= 0 {
+		store.namespaces = append(store.namespaces[:i], store.namespaces[i+1:]...)
+	}
+	return nil
+}
+
+//NamespaceUsage returns the usage of the declared namespaces, ordered by Start
+func (store *Storage) NamespaceUsage() []NamespaceUsage {
+	store.i.RLock()
+	defer store.i.RUnlock()
+	return store.namespaceUsage()
+}
+
+//namespaceUsage is NamespaceUsage with store.i held
+func (store *Storage) namespaceUsage() []NamespaceUsage {
+	if len(store.namespaces) == 0 {
+		return nil
+	}
+	usage := make([]NamespaceUsage, 0, len(store.namespaces))
+	for _, ns := range store.namespaces {
+		usage = append(usage, NamespaceUsage{
+			Name:     ns.Name,
+			Start:    ns.Start.U64(),
+			End:      ns.End.U64(),
+			Bytes:    ns.bytes,
+			Lumps:    ns.lumps,
+			MaxBytes: ns.MaxBytes,
+			MaxLumps: ns.MaxLumps,
+		})
+	}
+	return usage
+}
+
+//checkQuota returns a *QuotaError if putting size bytes to id exceeds the quota.
+//The existing lump of id is replaced, so its size is not counted. store.i must be held
+//until the put is accounted, otherwise concurrent puts could pass the check together
+func (store *Storage) checkQuota(op string, id lump.LumpId, size uint64) error {
+	ns := store.namespaces.find(id)
+	if ns == nil {
+		return nil
+	}
+	bytes, lumps := ns.bytes+size, ns.lumps+1
+	if p, err := store.index.Get(id); err == nil {
+		bytes -= uint64(p.SizeOnDisk(block.Min()))
+		lumps--
+	}
+	if (ns.MaxBytes != 0 && bytes > ns.MaxBytes) || (ns.MaxLumps != 0 && lumps > ns.MaxLumps) {
+		return &QuotaError{Op: op, Id: id, Namespace: ns.Name, Bytes: bytes, Lumps: lumps}
+	}
+	return nil
+}
+
+//accountAdd and accountRemove update the usage of the namespace of id, store.i must be held
+func (store *Storage) accountAdd(id lump.LumpId, p portion.Portion) {
+	if ns := store.namespaces.find(id); ns != nil {
+		ns.bytes += uint64(p.SizeOnDisk(block.Min()))
+		ns.lumps++
+	}
+}
+
+func (store *Storage) accountRemove(id lump.LumpId, p portion.Portion) {
+	if ns := store.namespaces.find(id); ns != nil {
+		ns.bytes -= uint64(p.SizeOnDisk(block.Min()))
+		ns.lumps--
+	}
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+//PointInTimeView is the lumps of the storage as of a journal position, it is read-only
+type PointInTimeView struct {
+	store *Storage
+	pit   *journal.PointInTime
+}
+
+//PointInTime replays the journal up to the record at position until, or up to records
+//records, into a new index, see journal.ReplayUntil. It is meant for a storage which is
+//not written, like one opened read-only: the data portions allocated after the view is
+//created are not known by it. The view must be closed to free the index
+func (store *Storage) PointInTime(until int64, records int64) (*PointInTimeView, error) {
+	store.i.RLock()
+	defer store.i.RUnlock()
+	store.jr.Lock()
+	defer store.jr.Unlock()
+	if !store.opened {
+		return nil, internalerror.StorageClosed
+	}
+	pit, err := store.journalRegion.ReplayUntil(until, records)
+	if err != nil {
+		return nil, err
+	}
+	return &PointInTimeView{store: store, pit: pit}, nil
+}
+
+//Position is the journal position of the view, the records from it are not replayed
+func (view *PointInTimeView) Position() uint64 {
+	return view.pit.Position
+}
+
+//Records is the count of the replayed records
+func (view *PointInTimeView) Records() int64 {
+	return view.pit.Records
+}
+
+func (view *PointInTimeView) Count() uint64 {
+	return view.pit.Index.Count()
+}
+
+func (view *PointInTimeView) List() []lump.LumpId {
+	return view.pit.Index.List()
+}
+
+func (view *PointInTimeView) ListRange(start, end lump.LumpId, maxSize uint64) []lump.LumpId {
+	return view.pit.Index.ListRange(start, end, maxSize)
+}
+
+//Available returns true if the data of id could be read, an error is returned if id is
+//not in the view
+func (view *PointInTimeView) Available(id lump.LumpId) (bool, error) {
+	p, err := view.pit.Index.Get(id)
+	if err != nil {
+		return false, lumpError("get", id, err)
+	}
+	return view.available(p), nil
+}
+
+func (view *PointInTimeView) available(p portion.Portion) bool {
+	switch v := p.(type) {
+	case portion.DataPortion:
+		return !view.pit.Overwritten(v)
+	case portion.JournalPortion:
+		view.store.jr.Lock()
+		defer view.store.jr.Unlock()
+		return view.store.journalRegion.Retained(v.Start.AsU64())
+	default:
+		panic("never here")
+	}
+}
+
+//Get returns the data of id as of the position. If the bytes of id are allocated again or
+//updated by PutWithOffset after the position, internalerror.DataUnavailable is returned
+//instead of the new bytes
+func (view *PointInTimeView) Get(id lump.LumpId) ([]byte, error) {
+	p, err := view.pit.Index.Get(id)
+	if err != nil {
+		return nil, lumpError("get", id, err)
+	}
+	unavailable := func() error {
+		return lumpError("get", id, errors.Wrapf(internalerror.DataUnavailable,
+			"%+v is overwritten after journal position %d", p, view.pit.Position))
+	}
+	store := view.store
+	store.i.RLock()
+	defer store.i.RUnlock()
+	if !store.opened {
+		return nil, internalerror.StorageClosed
+	}
+	switch v := p.(type) {
+	case portion.DataPortion:
+		if view.pit.Overwritten(v) {
+			return nil, unavailable()
+		}
+		data, err := store.dataRegion.Get(v)
+		if err != nil {
+			return nil, err
+		}
+		return data.AsBytes(), nil
+	case portion.JournalPortion:
+		store.jr.Lock()
+		defer store.jr.Unlock()
+		if !store.journalRegion.Retained(v.Start.AsU64()) {
+			return nil, unavailable()
+		}
+		return store.journalRegion.GetEmbededData(v)
+	default:
+		panic("never here")
+	}
+}
+
+//Close frees the index of the view
+func (view *PointInTimeView) Close() {
+	view.pit.Free()
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+func TestStoragePointInTime(t *testing.T) {
+	path := "pit.lusf"
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove(path)
+	defer storage.Close()
+
+	_, err = storage.Put(lumpidnum(1), dataFromBytes([]byte("first")))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpidnum(4), dataFromBytes([]byte("kept")))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(2), []byte("embedded"))
+	assert.Nil(t, err)
+	_, _, err = storage.Delete(lumpidnum(1))
+	assert.Nil(t, err)
+	//the portion of the deleted lump is released by the sync, and allocated again
+	assert.Nil(t, storage.Sync())
+	_, err = storage.Put(lumpidnum(3), dataFromBytes([]byte("third")))
+	assert.Nil(t, err)
+
+	var positions []uint64
+	assert.Nil(t, storage.JournalDump(-1, func(entry journal.DumpEntry) error {
+		positions = append(positions, entry.Position)
+		return nil
+	}))
+	assert.Equal(t, 5, len(positions))
+
+	//before the delete
+	view, err := storage.PointInTime(int64(positions[3]), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, positions[3], view.Position())
+	assert.Equal(t, int64(3), view.Records())
+	assert.Equal(t, []lump.LumpId{lumpidnum(1), lumpidnum(2), lumpidnum(4)}, view.List())
+	data, err := view.Get(lumpidnum(4))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("kept"), data)
+	data, err = view.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("embedded"), data)
+	available, err := view.Available(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.False(t, available)
+	_, err = view.Get(lumpidnum(1))
+	assert.True(t, errors.Is(err, internalerror.DataUnavailable))
+	_, err = view.Get(lumpidnum(3))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	view.Close()
+
+	//the same view by the count of records
+	view, err = storage.PointInTime(-1, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, positions[3], view.Position())
+	assert.Equal(t, []lump.LumpId{lumpidnum(1), lumpidnum(2), lumpidnum(4)}, view.List())
+	view.Close()
+
+	//the whole journal is the storage
+	view, err = storage.PointInTime(-1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), view.Records())
+	assert.Equal(t, storage.List(), view.List())
+	data, err = view.Get(lumpidnum(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("third"), data)
+	view.Close()
+
+	_, err = storage.PointInTime(int64(positions[1]+1), 0)
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+}
+
+func TestStoragePointInTimeUpdateInPlace(t *testing.T) {
+	path := "pit-update.lusf"
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove(path)
+
+	assert.Nil(t, storage.PutWithOffset(lumpidnum(1), dataFromBytes([]byte("before")), 0, 0))
+	_, err = storage.Put(lumpidnum(2), dataFromBytes([]byte("kept")))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.PutWithOffset(lumpidnum(1), dataFromBytes([]byte("AF")), 0, 0))
+	_, version, err := storage.GetWithVersion(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), version)
+
+	//the view before the update does not read the updated bytes
+	view, err := storage.PointInTime(-1, 2)
+	assert.Nil(t, err)
+	available, err := view.Available(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.False(t, available)
+	_, err = view.Get(lumpidnum(1))
+	assert.True(t, errors.Is(err, internalerror.DataUnavailable))
+	data, err := view.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("kept"), data)
+	view.Close()
+
+	//the journal GC keeps the record of the update, not the previous one
+	assert.Nil(t, storage.JournalGC())
+	view, err = storage.PointInTime(-1, 0)
+	assert.Nil(t, err)
+	data, err = view.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("AFfore"), data)
+	view.Close()
+	assert.Nil(t, storage.Close())
+
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	defer storage.Close()
+	data, version, err = storage.GetWithVersion(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("AFfore"), data)
+	assert.Equal(t, uint64(2), version)
+}
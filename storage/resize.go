@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/allocator"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+//ResizeJournal moves the live journal records into a journal region of newSize bytes.
+//An internal journal takes the space from the front of the data region, the lumps stored
+//there are copied to the free space first, or gives the space back when it shrinks.
+//An external journal file is grown or shrunk instead.
+//The records are written where the old journal has no live records, then the head of the
+//resized journal is written to the slot the current head does not use. Both are durable
+//before the storage header is switched to the new size by one sector, until then a crash
+//keeps the old journal. It needs the journal head slots of nvm.MINOR_VERSION_HEAD_SLOTS.
+//Every operation waits during resize
+func (store *Storage) ResizeJournal(newSize uint64) error {
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to resize journal")
+	}
+	if err := store.checkFailed("resize journal"); err != nil {
+		return err
+	}
+	store.regions.Lock()
+	defer store.regions.Unlock()
+	store.i.Lock()
+	defer store.i.Unlock()
+	store.jr.Lock()
+	defer store.jr.Unlock()
+	if !store.opened {
+		return internalerror.StorageClosed
+	}
+	oldSize := store.storageHeader.JournalRegionSize
+	if err := store.latch(store.resizeJournal(newSize)); err != nil {
+		return err
+	}
+	store.log.Infof("resized journal region from %d to %d bytes", oldSize, store.storageHeader.JournalRegionSize)
+	return nil
+}
+
+func (store *Storage) resizeJournal(newSize uint64) error {
+	header := *store.storageHeader
+	bs := header.BlockSize
+	blockBytes := uint64(bs.AsU16())
+	newSize = bs.CeilAlign(newSize)
+	if newSize == header.JournalRegionSize {
+		return nil
+	}
+	if !header.HasJournalHeadSlots() {
+		return errors.Wrapf(internalerror.NotSupported,
+			"resizing the journal needs the journal head slots of minor version %d", nvm.MINOR_VERSION_HEAD_SLOTS)
+	}
+	if newSize < minJournalSize(&header) || newSize > MAX_JOURNAL_REGION_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid journal size %d", newSize)
+	}
+
+	newHeader := header
+	newHeader.JournalRegionSize = newSize
+	//shift is the count of blocks the data region start moves forward, the
+	//block b of the old data region is the block b-shift of the new one
+	var shift int64
+	if !header.HasExternalJournal() {
+		if newSize > header.JournalRegionSize {
+			grow := newSize - header.JournalRegionSize
+			if grow+blockBytes > header.DataRegionSize {
+				return errors.Wrap(internalerror.InvalidInput, "data region is too small to grow the journal")
+			}
+			newHeader.DataRegionSize = header.DataRegionSize - grow
+		} else {
+			newHeader.DataRegionSize = header.DataRegionSize + header.JournalRegionSize - newSize
+			if newHeader.DataRegionSize > MAX_DATA_REGION_SIZE {
+				return errors.Wrap(internalerror.InvalidInput, "data region is too big")
+			}
+		}
+		shift = (int64(newSize) - int64(header.JournalRegionSize)) / int64(blockBytes)
+	}
+
+	//the pending released portions and the journal buffer must be on disk,
+	//so the free blocks could be overwritten
+	if err := store.journalSync(); err != nil {
+		return err
+	}
+
+	portions, used, err := store.relocateData(&newHeader, shift)
+	if err != nil {
+		return err
+	}
+
+	stream, err := store.liveRecords(portions)
+	if err != nil {
+		return err
+	}
+	size := bs.CeilAlign(uint64(len(stream)))
+	headBytes := blockBytes * uint64(headLayout(&header).Sectors())
+	head, ok := store.journalRegion.RelocationWindow(newSize-headBytes, size, used...)
+	if !ok {
+		return errors.Wrapf(internalerror.JournalStorageFull, "no room for %d bytes of records in journal of %d bytes", size, newSize)
+	}
+
+	//the file holding the journal region, and the header at its start
+	var file nvm.NonVolatileMemory = store.innerNVM
+	journalHeader := newHeader
+	if header.HasExternalJournal() {
+		file = store.journalFile
+		current, err := nvm.ReadHeader(store.journalFile)
+		if err != nil {
+			return err
+		}
+		journalHeader = *current
+		journalHeader.JournalRegionSize = newSize
+		if err = store.journalFile.Grow(journalHeader.StorageSize()); err != nil {
+			return err
+		}
+	}
+
+	ringStart := journalRingStart(&journalHeader)
+	if err = writeAlignedAt(file, stream, ringStart+head); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+
+	//the slot of the new size is ignored by the old storage header
+	if err = store.journalRegion.WriteRelocatedHead(newSize, head, store.index.Retired()); err != nil {
+		return err
+	}
+	//the commit point, one copy of the header is written in one sector
+	if err = nvm.WriteHeader(file, &journalHeader); err != nil {
+		return err
+	}
+	if header.HasExternalJournal() {
+		//the journal size in the storage file is informative, it is read from the journal file
+		if err = nvm.WriteHeader(store.innerNVM, &newHeader); err != nil {
+			return err
+		}
+	} else {
+		newHeader = journalHeader
+	}
+	return store.reopenRegions(&newHeader)
+}
+
+//relocateData returns the portions of the lumps in the new data region. The lumps in
+//the blocks taken by the journal are copied to the free space of the new data region,
+//until the headers are switched their old copies are still used, so their positions
+//in the new ring buffer are returned in used
+func (store *Storage) relocateData(newHeader *nvm.StorageHeader, shift int64) (
+	portions map[uint64]portion.DataPortion, used [][2]uint64, err error) {
+	bs := newHeader.BlockSize
+	blockBytes := int64(bs.AsU16())
+	//the old data region starts at this position of the new ring buffer, after the journal header
+	headBytes := uint64(blockBytes) * uint64(headLayout(store.storageHeader).Sectors())
+	oldDataStart := store.storageHeader.JournalRegionSize - headBytes
+	portions = make(map[uint64]portion.DataPortion)
+	var moved []lump.LumpId
+	kept := []portion.DataPortion{portion.NewDataPortion(0, 0)}
+	for _, id := range store.index.List() {
+		p, err := store.index.Get(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		dp, ok := p.(portion.DataPortion)
+		if !ok {
+			continue
+		}
+		if int64(dp.Start.AsU64()) < shift {
+			moved = append(moved, id)
+			continue
+		}
+		np := portion.NewDataPortion(uint64(int64(dp.Start.AsU64())-shift), dp.Len)
+		portions[id.U64()] = np
+		kept = append(kept, np)
+	}
+	if len(moved) == 0 {
+		return portions, nil, nil
+	}
+
+	alloc := allocator.NewJudyAlloc()
+	defer alloc.Free()
+	alloc.RestoreFromIndex(bs, newHeader.DataRegionSize, kept)
+	for _, id := range moved {
+		p, _ := store.index.Get(id)
+		dp := p.(portion.DataPortion)
+		np, err := alloc.Allocate(dp.Len)
+		if err != nil {
+			return nil, nil, errors.Wrap(internalerror.StorageFull, "no space to move the lumps out of the journal region")
+		}
+		buf, err := store.dataRegion.readBlocks(int64(dp.Start.AsU64())*blockBytes, int(dp.Len))
+		if err != nil {
+			return nil, nil, err
+		}
+		//np is in the new data region, write it by the old one
+		if _, err = store.dataRegion.writeAt(buf, (int64(np.Start.AsU64())+shift)*blockBytes); err != nil {
+			return nil, nil, err
+		}
+		portions[id.U64()] = np
+		start := oldDataStart + dp.Start.AsU64()*uint64(blockBytes)
+		used = append(used, [2]uint64{start, start + uint64(dp.Len)*uint64(blockBytes)})
+	}
+	return portions, used, store.innerNVM.Sync()
+}
+
+//liveRecords encodes the records of every lump, ended by EndOfRecords
+func (store *Storage) liveRecords(portions map[uint64]portion.DataPortion) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, id := range store.index.List() {
+		p, err := store.index.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		var record journal.JournalRecord
+		switch p := p.(type) {
+		case portion.JournalPortion:
+			data, err := store.journalRegion.GetEmbededData(p)
+			if err != nil {
+				return nil, err
+			}
+			if version := store.index.Version(id); version > 1 {
+				record = journal.EmbedVersionRecord{LumpID: id, Version: version, Data: data}
+			} else {
+				record = journal.EmbedRecord{LumpID: id, Data: data}
+			}
+		case portion.DataPortion:
+			np := portions[id.U64()]
+			meta, _ := store.index.GetMeta(id)
+			if version := store.index.Version(id); version > 1 {
+				record = journal.PutVersionRecord{LumpID: id, DataPortion: np, Version: version, Meta: meta}
+			} else if len(meta) > 0 {
+				record = journal.PutWithMetaRecord{LumpID: id, DataPortion: np, Meta: meta}
+			} else {
+				record = journal.PutRecord{LumpID: id, DataPortion: np}
+			}
+		}
+		if err = journal.WriteRecord(buf, record, store.journalRegion.RecordFormat()); err != nil {
+			return nil, err
+		}
+	}
+	if err := (journal.EndOfRecords{}).WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//reopenRegions replays the resized journal, and replaces the regions, index and allocator
+func (store *Storage) reopenRegions(header *nvm.StorageHeader) error {
+	journalNVM, dataNVM, err := splitRegions(store.innerNVM, store.journalFile, header)
+	if err != nil {
+		return err
+	}
+	journalRegion, err := journal.OpenJournalRegion(journalNVM, headLayout(header))
+	if err != nil {
+		return err
+	}
+	index := lumpindex.NewIndex()
+	if _, err = journalRegion.RestoreIndex(index, journal.RecoverStrict); err != nil {
+		index.Free()
+		return err
+	}
+	journalRegion.SetAutomaticGcMode(store.journalRegion.AutomaticGcMode())
+	journalRegion.SetGCPolicy(store.journalRegion.GCPolicy())
+	journalRegion.SetRecordFormat(store.journalRegion.RecordFormat())
+	alloc := allocator.NewJudyAlloc()
+	alloc.RestoreFromIndex(header.BlockSize, header.DataRegionSize, index.DataPortions())
+
+	store.index.Free()
+	store.alloc.Free()
+	store.storageHeader = header
+	store.journalRegion = journalRegion
+	store.index = index
+	store.alloc = alloc
+	store.dataRegion = NewDataRegion(alloc, dataNVM)
+	return nil
+}
+
+func writeAlignedAt(file nvm.NonVolatileMemory, buf []byte, offset uint64) error {
+	aligned := block.FromBytes(buf, file.BlockSize())
+	aligned.Align()
+	_, err := file.WriteAt(aligned.AsBytes(), int64(offset))
+	return err
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
 	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/logger"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/lumpindex"
 	x "github.com/thesues/cannyls-go/metrics"
@@ -19,6 +23,7 @@ import (
 	"github.com/thesues/cannyls-go/storage/journal"
 	"github.com/thesues/cannyls-go/util"
 	ostats "go.opencensus.io/stats"
+	"go.opencensus.io/tag"
 )
 
 var _ = fmt.Println
@@ -34,16 +39,32 @@ const (
 )
 
 type Storage struct {
+	//regions is held for read by the data region I/O done outside store.i, ResizeJournal
+	//and Close hold it for write to replace or free the regions. It is taken before store.i
+	regions               sync.RWMutex
 	i                     sync.RWMutex
 	jr                    sync.Mutex //protect journal region(read/write)
 	storageHeader         *nvm.StorageHeader
 	dataRegion            *DataRegion
 	journalRegion         *journal.JournalRegion
 	index                 *lumpindex.LumpIndex
-	innerNVM              *nvm.SnapNVM
+	innerNVM              nvm.NonVolatileMemory
+	journalFile           *nvm.FileNVM //nil if the journal region follows the header
+	snapNVM               *nvm.SnapNVM //nil if the storage is read-only or has an external journal
 	alloc                 allocator.DataPortionAlloc
 	updateCapacityStopper *util.Stopper
+	usageStopOnce         sync.Once
+	gcStopper             *util.Stopper //nil if the background GC is disabled
+	gcStopOnce            sync.Once
 	opened                bool
+	readOnly              bool
+	log                   logger.Logger
+	namespaces            namespaces
+	recovery              journal.RecoveryReport
+
+	failMu     sync.Mutex
+	failed     error //the first fatal I/O error, nil if the storage is healthy
+	fatalHooks []func(error)
 }
 
 type StorageUsage struct {
@@ -54,27 +75,203 @@ type StorageUsage struct {
 	JournalUsageBytes uint64 `json:"journalusagebytes"`
 	MaxSegmentSize    uint64 `json:"maxsegmentsize"`
 	//	CurrentFileSize uint64 `json:"currentfilesize"`
+	FreePortions   uint64                   `json:"freeportions"`
+	Fragmentation  float64                  `json:"fragmentation"`
+	AllocatorStats allocator.AllocatorStats `json:"allocator"`
+	Namespaces     []NamespaceUsage         `json:"namespaces,omitempty"`
+}
+
+//Options are the optional settings of a Storage, the zero value is the default
+type Options struct {
+	//Logger receives the open/replay/GC/snapshot events, nothing is logged if it is nil
+	Logger logger.Logger
+	//ReadOnly opens the storage like OpenCannylsStorageReadOnly
+	ReadOnly bool
+	//Namespaces are declared when the storage is opened, see DeclareNamespace
+	Namespaces []Namespace
+	//Recovery decides how a corrupted journal is replayed, the open fails by default.
+	//A writable open persists the recovered journal, see journal.PersistRecovery
+	Recovery journal.RecoveryPolicy
+	//JournalPath is the file of the external journal, it is required to open a storage
+	//created with it. The journal region of the storage is capacity*journal_ratio in
+	//this file, and the data region is the whole capacity of the storage file
+	JournalPath string
+	//GCPolicy decides when the journal is garbage collected and synced, nil is journal.DefaultGCPolicy
+	GCPolicy journal.GCPolicy
+	//BackgroundGC is the interval of the side jobs run by the storage itself, see
+	//RunSideJobOnce. It is disabled if it is 0 or the storage is read-only
+	BackgroundGC time.Duration
+	//ReplayWorkers is the count of goroutines decoding the journal when the storage is
+	//opened, 0 is GOMAXPROCS and 1 replays the journal on one goroutine
+	ReplayWorkers int
 }
 
 func OpenCannylsStorage(path string) (*Storage, error) {
-	file, header, err := nvm.Open(path)
+	return OpenCannylsStorageWithOptions(path, Options{})
+}
+
+//OpenCannylsStorageReadOnly opens the storage for inspection. It does not take the
+//exclusive lock, so it could be used while another process is serving the storage.
+//Every mutating API returns internalerror.StorageReadOnly, and nothing is written
+//to the file, including the journal header and snapshot files
+func OpenCannylsStorageReadOnly(path string) (*Storage, error) {
+	return OpenCannylsStorageWithOptions(path, Options{ReadOnly: true})
+}
+
+//OpenCannylsStorageWithJournal opens the storage at path whose journal region is in journalPath
+func OpenCannylsStorageWithJournal(path string, journalPath string) (*Storage, error) {
+	return OpenCannylsStorageWithOptions(path, Options{JournalPath: journalPath})
+}
+
+func OpenCannylsStorageWithOptions(path string, opts Options) (*Storage, error) {
+	opts.Logger = logger.OrNop(opts.Logger)
+	store, err := openStorageFile(path, opts)
 	if err != nil {
+		opts.Logger.Errorf("failed to open storage %s: %v", path, err)
 		return nil, err
 	}
-	snapNVM, err := nvm.NewSnapshotNVM(file)
+	opts.Logger.Infof("opened storage %s, journal region %d bytes, data region %d bytes, read-only %v",
+		path, store.storageHeader.JournalRegionSize, store.storageHeader.DataRegionSize, opts.ReadOnly)
+	return store, nil
+}
+
+func openStorageFile(path string, opts Options) (*Storage, error) {
+	openFile := nvm.Open
+	if opts.ReadOnly {
+		openFile = nvm.OpenReadOnly
+	}
+	file, header, err := openFile(path)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkJournalPath(header, opts.JournalPath); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if header.HasExternalJournal() {
+		journalFile, journalHeader, err := openFile(opts.JournalPath)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err = header.CheckJournalFile(journalHeader); err != nil {
+			journalFile.Close()
+			file.Close()
+			return nil, errors.Wrapf(err, "failed to open journal %s", opts.JournalPath)
+		}
+		header.JournalRegionSize = journalHeader.JournalRegionSize
+		//a snapshot of the storage file could not cover the journal file
+		return openStorage(file, nil, journalFile, header, opts)
+	}
+	if opts.ReadOnly {
+		return openStorage(file, nil, nil, header, opts)
+	}
+	snapNVM, err := nvm.NewSnapshotNVMWithLogger(file, opts.Logger)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return openStorage(snapNVM, snapNVM, nil, header, opts)
+}
 
+//headLayout returns the layout of the journal header of the storage of header
+func headLayout(header *nvm.StorageHeader) journal.HeadLayout {
+	if header.HasJournalHeadSlots() {
+		return journal.HeadSlots
+	}
+	return journal.HeadSector
+}
+
+//minJournalSize is the journal header and one block of records
+func minJournalSize(header *nvm.StorageHeader) uint64 {
+	return uint64(header.BlockSize.AsU16()) * uint64(headLayout(header).Sectors()+1)
+}
+
+//journalRingStart is the offset of the journal records in the file of the journal region
+func journalRingStart(header *nvm.StorageHeader) uint64 {
+	return header.RegionSize() + uint64(header.BlockSize.AsU16())*uint64(headLayout(header).Sectors())
+}
+
+//splitRegions returns the journal region and the data region described by header
+func splitRegions(innerNVM nvm.NonVolatileMemory, journalFile *nvm.FileNVM,
+	header *nvm.StorageHeader) (nvm.NonVolatileMemory, nvm.NonVolatileMemory, error) {
+	journalNVM, dataNVM := header.SplitRegion(innerNVM)
+	if journalFile == nil {
+		return journalNVM, dataNVM, nil
+	}
+	_, body, err := journalFile.Split(header.RegionSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	ring, _, err := body.Split(header.JournalRegionSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nvm.SyncAfter(ring, dataNVM), dataNVM, nil
+}
+
+func checkJournalPath(header *nvm.StorageHeader, journalPath string) error {
+	switch {
+	case header.IsJournalFile():
+		return errors.Wrap(internalerror.InvalidInput, "it is a journal file, open the storage it belongs to")
+	case header.HasExternalJournal() && journalPath == "":
+		return errors.Wrapf(internalerror.InvalidInput, "storage has the external journal %v, Options.JournalPath is required", header.JournalUUID)
+	case !header.HasExternalJournal() && journalPath != "":
+		return errors.Wrap(internalerror.InvalidInput, "storage has no external journal")
+	}
+	return nil
+}
+
+//openStorage replays the journal and builds the storage, journalFile is nil
+//unless the journal region is external. Both files are closed on error
+func openStorage(innerNVM nvm.NonVolatileMemory, snapNVM *nvm.SnapNVM, journalFile *nvm.FileNVM,
+	header *nvm.StorageHeader, opts Options) (*Storage, error) {
+
+	closeFiles := func() {
+		innerNVM.Close()
+		if journalFile != nil {
+			journalFile.Close()
+		}
+	}
+	log := logger.OrNop(opts.Logger)
 	index := lumpindex.NewIndex()
-	journalNVM, dataNVM := header.SplitRegion(snapNVM)
+	journalNVM, dataNVM, err := splitRegions(innerNVM, journalFile, header)
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
 
-	journalRegion, err := journal.OpenJournalRegion(journalNVM)
+	journalRegion, err := journal.OpenJournalRegion(journalNVM, headLayout(header))
 	if err != nil {
+		closeFiles()
 		return nil, err
 	}
 
-	journalRegion.RestoreIndex(index)
+	workers := opts.ReplayWorkers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	//the used portions are collected while the index is restored, instead of
+	//walking and sorting index.DataPortions() afterwards
+	portions := allocator.NewPortionSet()
+	start := time.Now()
+	report, err := journalRegion.ReplayIndex(index, journal.ReplayOptions{
+		Policy:  opts.Recovery,
+		Workers: workers,
+		Tracker: portions,
+	})
+	used := portions.Done()
+	if err != nil {
+		used.Free()
+		index.Free()
+		closeFiles()
+		return nil, err
+	}
+	if !report.Clean() {
+		log.Warnf("recovered journal by %s: %d records replayed, %d ranges skipped, truncated %v at %d, %d bytes lost: %s",
+			report.Policy, report.Records, len(report.Skipped), report.Truncated, report.TruncatedAt, report.BytesLost, report.Cause)
+	}
+	log.Infof("restored %d lumps from journal by %d workers in %v", index.Count(), workers, time.Since(start))
 	/*
 		fmt.Printf("Index's mem is %d\n", index.MemoryUsed())
 		id, _ := index.Min()
@@ -85,17 +282,23 @@ func OpenCannylsStorage(path string) (*Storage, error) {
 
 	//use JudyAlloc as default
 	alloc := allocator.NewJudyAlloc()
-
-	//  use RestoreFromIndex as default
-	alloc.RestoreFromIndex(snapNVM.BlockSize(), header.DataRegionSize, index.DataPortions())
-	/*
-		alloc.RestoreFromIndexWithJudy(file.BlockSize(), header.DataRegionSize, index.JudyDataPortions())
-
-		RestoreFromIndexWithJudy is 10% slower than RestoreFromIndex, But it takes significant less
-			memory.
-	*/
+	alloc.RestoreFromIndexWithJudy(innerNVM.BlockSize(), header.DataRegionSize, used)
 
 	dataRegion := NewDataRegion(alloc, dataNVM)
+	journalRegion.SetGCPolicy(opts.GCPolicy)
+	if header.HasCRC32CJournal() {
+		journalRegion.SetRecordFormat(journal.RecordCRC32C)
+	}
+	if !report.Clean() && !opts.ReadOnly {
+		//otherwise the next open with the default policy fails again
+		if err = journalRegion.PersistRecovery(index, report); err != nil {
+			alloc.Free()
+			index.Free()
+			closeFiles()
+			return nil, err
+		}
+		log.Infof("persisted the recovered journal")
+	}
 
 	//Add a go routing to collect capacity information into metric
 
@@ -104,10 +307,22 @@ func OpenCannylsStorage(path string) (*Storage, error) {
 		dataRegion:            dataRegion,
 		journalRegion:         journalRegion,
 		index:                 index,
-		innerNVM:              snapNVM,
+		innerNVM:              innerNVM,
+		journalFile:           journalFile,
+		snapNVM:               snapNVM,
 		alloc:                 alloc,
 		updateCapacityStopper: util.NewStopper(),
 		opened:                true,
+		readOnly:              opts.ReadOnly,
+		log:                   log,
+		recovery:              report,
+	}
+
+	for _, ns := range opts.Namespaces {
+		if err := s.declareNamespace(ns); err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
 
 	//RunWorker == go func()
@@ -115,22 +330,32 @@ func OpenCannylsStorage(path string) (*Storage, error) {
 		updateUsageInfo(s)
 	})
 
+	if !opts.ReadOnly && opts.BackgroundGC > 0 {
+		s.gcStopper = util.NewStopper()
+		s.gcStopper.RunWorker(func() {
+			backgroundGC(s, opts.BackgroundGC)
+		})
+	}
+
 	return s, nil
 }
 
-//go routine to collect capacity data
+//go routine to collect capacity data, the regions are read by Usage under store.i,
+//they are replaced by ResizeJournal
 func updateUsageInfo(store *Storage) {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
+	record := func() {
+		usage := store.Usage()
+		ostats.Record(context.Background(), x.JournalRegionMetric.Capacity.M(int64(usage.JournalUsageBytes)))
+		recordAllocatorStats(usage.AllocatorStats, store.Header().BlockSize)
+	}
 	//on start, record the capacity first
-	ctx := context.Background()
-	ostats.Record(ctx, x.JournalRegionMetric.Capacity.M(int64(store.journalRegion.Usage())))
+	record()
 	for {
 		select {
 		case <-ticker.C:
-			ctx := context.Background()
-			ostats.Record(ctx, x.JournalRegionMetric.Capacity.M(int64(store.journalRegion.Usage())))
-			//TODO, update data region usage in the future
+			record()
 		case <-store.updateCapacityStopper.ShouldStop():
 			return
 		}
@@ -138,48 +363,173 @@ func updateUsageInfo(store *Storage) {
 
 }
 
+//go routine to run the side jobs, it stops when the storage is closed or failed
+func backgroundGC(store *Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.RunSideJobOnce(0); err != nil {
+				if errors.Is(err, internalerror.StorageClosed) {
+					return
+				}
+				store.log.Errorf("background GC failed: %v", err)
+				if store.Err() != nil {
+					return
+				}
+			}
+		case <-store.gcStopper.ShouldStop():
+			return
+		}
+	}
+}
+
+func recordAllocatorStats(stats allocator.AllocatorStats, blockSize block.BlockSize) {
+	ctx := context.Background()
+	bs := int64(blockSize.AsU16())
+	ostats.Record(ctx, x.DataRegionMetric.FreeBytes.M(int64(stats.FreeBlocks)*bs),
+		x.DataRegionMetric.FreePortions.M(int64(stats.FreePortions)),
+		x.DataRegionMetric.LargestFree.M(int64(stats.LargestFree)*bs),
+		x.DataRegionMetric.Fragmentation.M(stats.Fragmentation))
+	for class, count := range stats.SizeClasses {
+		ostats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(x.SizeClass, strconv.Itoa(class))},
+			x.DataRegionMetric.FreeBySize.M(int64(count)))
+	}
+}
+
 func CreateCannylsStorage(path string, capacity uint64, journal_ratio float64) (*Storage, error) {
+	return CreateCannylsStorageWithOptions(path, capacity, journal_ratio, Options{})
+}
 
+func CreateCannylsStorageWithOptions(path string, capacity uint64, journal_ratio float64, opts Options) (*Storage, error) {
+	if opts.ReadOnly {
+		return nil, errors.Wrap(internalerror.InvalidInput, "can not create a read-only storage")
+	}
+	if opts.JournalPath != "" {
+		if err := createWithJournal(path, capacity, journal_ratio, opts.JournalPath); err != nil {
+			return nil, err
+		}
+		logger.OrNop(opts.Logger).Infof("created storage %s with journal %s, capacity %d bytes, journal ratio %v",
+			path, opts.JournalPath, capacity, journal_ratio)
+		return OpenCannylsStorageWithOptions(path, opts)
+	}
 	file, err := nvm.CreateIfAbsent(path, capacity)
 	if err != nil {
 		return nil, err
 	}
-	snapNVM, err := nvm.NewSnapshotNVM(file)
+	snapNVM, err := nvm.NewSnapshotNVMWithLogger(file, opts.Logger)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = formatStorage(snapNVM, journal_ratio); err != nil {
+		return nil, err
+	}
+	snapNVM.Close()
+	logger.OrNop(opts.Logger).Infof("created storage %s, capacity %d bytes, journal ratio %v",
+		path, capacity, journal_ratio)
+
+	return OpenCannylsStorageWithOptions(path, opts)
+}
+
+//write the storage header and an empty journal to the start of file
+func formatStorage(file nvm.NonVolatileMemory, journal_ratio float64) (err error) {
 	headBuf := new(bytes.Buffer)
-	header := makeHeader(snapNVM, journal_ratio)
+	header := makeHeader(file, journal_ratio)
 
 	if err = header.WriteHeaderRegionTo(headBuf); err != nil {
-		return nil, err
+		return err
 	}
 	//now headBuf's len should be at least 512
 
-	journal.InitialJournalRegion(headBuf, snapNVM.BlockSize())
-	//headbuf should be header(512) + (journal header)512 + (journal)512
+	journal.InitialJournalRegion(headBuf, file.BlockSize(), headLayout(&header), header.JournalRegionSize)
+	//headbuf should be header + journal header + (journal)512
+	return writeAligned(file, headBuf.Bytes())
+}
 
-	alignedBufHead := block.FromBytes(headBuf.Bytes(), snapNVM.BlockSize())
+func writeAligned(file nvm.NonVolatileMemory, buf []byte) error {
+	alignedBufHead := block.FromBytes(buf, file.BlockSize())
 	alignedBufHead.Align()
-	snapNVM.Write(alignedBufHead.AsBytes())
+	if _, err := file.Write(alignedBufHead.AsBytes()); err != nil {
+		return err
+	}
+	return file.Sync()
+}
 
-	if err = snapNVM.Sync(); err != nil {
-		return nil, err
+//createWithJournal creates the storage file at path whose data region is the whole capacity,
+//and the journal file at journalPath whose journal region is capacity*journal_ratio
+func createWithJournal(path string, capacity uint64, journal_ratio float64, journalPath string) error {
+	bs := block.Min()
+	header := nvm.DefaultStorageHeader()
+	header.JournalUUID = uuid.NewV4()
+	header.JournalRegionSize = bs.CeilAlign(uint64(float64(capacity) * journal_ratio))
+	if header.JournalRegionSize < minJournalSize(header) {
+		header.JournalRegionSize = minJournalSize(header)
 	}
-	snapNVM.Close()
+	if header.JournalRegionSize > MAX_JOURNAL_REGION_SIZE {
+		return errors.Wrap(internalerror.InvalidInput, "journal size is too big")
+	}
+	if capacity < header.RegionSize()+uint64(bs.AsU16()) {
+		return errors.Wrap(internalerror.InvalidInput, "capacity is too small")
+	}
+	header.DataRegionSize = bs.FloorAlign(capacity - header.RegionSize())
+	if header.DataRegionSize > MAX_DATA_REGION_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "data size is too big: %d", header.DataRegionSize)
+	}
+
+	//the journal file is marked by the same UUID and JournalUUID
+	journalHeader := *header
+	journalHeader.UUID = header.JournalUUID
+	journalHeader.DataRegionSize = 0
 
-	return OpenCannylsStorage(path)
+	file, err := nvm.CreateIfAbsent(path, header.StorageSize())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	journalFile, err := nvm.CreateIfAbsent(journalPath, journalHeader.StorageSize())
+	if err != nil {
+		return err
+	}
+	defer journalFile.Close()
+
+	buf := new(bytes.Buffer)
+	if err = header.WriteHeaderRegionTo(buf); err != nil {
+		return err
+	}
+	if err = writeAligned(file, buf.Bytes()); err != nil {
+		return err
+	}
+	buf.Reset()
+	if err = journalHeader.WriteHeaderRegionTo(buf); err != nil {
+		return err
+	}
+	journal.InitialJournalRegion(buf, bs, headLayout(&journalHeader), journalHeader.JournalRegionSize)
+	return writeAligned(journalFile, buf.Bytes())
+}
+
+//openStorageOnNVM opens the storage formatted by formatStorage on any NVM,
+//snapshot is not supported
+func openStorageOnNVM(file nvm.NonVolatileMemory) (*Storage, error) {
+	header, err := nvm.ReadHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	return openStorage(file, nil, nil, header, Options{})
 }
 
 func makeHeader(file nvm.NonVolatileMemory, journal_ratio float64) nvm.StorageHeader {
 
+	header := nvm.DefaultStorageHeader()
+	header.BlockSize = file.BlockSize()
+
 	//total size
 	totalSize := file.Capacity()
-	headerSize := file.BlockSize().CeilAlign(uint64(nvm.FULL_HEADER_SIZE))
+	headerSize := header.RegionSize()
 
-	//check capacity
-	if totalSize < headerSize+uint64(file.BlockSize().AsU16()*3) {
+	//check capacity, the smallest journal and one block of data
+	if totalSize < headerSize+minJournalSize(header)+uint64(file.BlockSize().AsU16()) {
 		panic("file size is too small")
 	}
 
@@ -190,8 +540,8 @@ func makeHeader(file nvm.NonVolatileMemory, journal_ratio float64) nvm.StorageHe
 		panic("journal size is too big")
 	}
 
-	if journalSize < uint64(file.BlockSize().AsU16()*2) {
-		journalSize = uint64(file.BlockSize().AsU16() * 2)
+	if journalSize < minJournalSize(header) {
+		journalSize = minJournalSize(header)
 	}
 
 	dataSize := totalSize - journalSize - headerSize
@@ -204,21 +554,30 @@ func makeHeader(file nvm.NonVolatileMemory, journal_ratio float64) nvm.StorageHe
 		dataSize = uint64(file.BlockSize().AsU16())
 	}
 
-	header := nvm.DefaultStorageHeader()
-	header.BlockSize = file.BlockSize()
 	header.JournalRegionSize = journalSize
 	header.DataRegionSize = dataSize
 	return *header
 }
 
 func (store *Storage) Header() nvm.StorageHeader {
+	store.i.RLock()
+	defer store.i.RUnlock()
 	return *store.storageHeader
 }
 
 func (store *Storage) SetAutomaticGcMode(gc bool) {
+	store.jr.Lock()
+	defer store.jr.Unlock()
 	store.journalRegion.SetAutomaticGcMode(gc)
 }
 
+//SetGCPolicy replaces the journal GC policy, nil restores journal.DefaultGCPolicy
+func (store *Storage) SetGCPolicy(policy journal.GCPolicy) {
+	store.jr.Lock()
+	defer store.jr.Unlock()
+	store.journalRegion.SetGCPolicy(policy)
+}
+
 func (store *Storage) List() []lump.LumpId {
 	store.i.RLock()
 	defer store.i.RUnlock()
@@ -228,52 +587,163 @@ func (store *Storage) List() []lump.LumpId {
 	return store.index.List()
 }
 
+func (store *Storage) IsReadOnly() bool {
+	return store.readOnly
+}
+
+//RecoveryReport returns how the journal was replayed when the storage was opened, see Options.Recovery
+func (store *Storage) RecoveryReport() journal.RecoveryReport {
+	return store.recovery
+}
+
+//OnFatalError registers a hook which is called once when the storage fails.
+//Hooks run in their own goroutine, so they could call back into the storage, e.g. Close
+func (store *Storage) OnFatalError(hook func(error)) {
+	store.failMu.Lock()
+	defer store.failMu.Unlock()
+	if store.failed != nil {
+		go hook(store.failed)
+		return
+	}
+	store.fatalHooks = append(store.fatalHooks, hook)
+}
+
+//Err returns the error which failed the storage, or nil if the storage is healthy
+func (store *Storage) Err() error {
+	store.failMu.Lock()
+	defer store.failMu.Unlock()
+	return store.failed
+}
+
+//soft errors are returned to the caller, but leave the storage usable
+func isSoftError(err error) bool {
+	switch errors.Cause(err) {
+	case internalerror.StorageFull, internalerror.JournalStorageFull, internalerror.InvalidInput,
+		internalerror.StorageClosed, internalerror.StorageReadOnly, internalerror.NoEntries,
+		internalerror.LumpNotFound, internalerror.NotSupported, internalerror.VersionConflict,
+		internalerror.QuotaExceeded:
+		return true
+	}
+	return false
+}
+
+//latch records the first fatal error from the journal or data region. After a failed
+//write the journal and the index could disagree, so the storage refuses all calls
+func (store *Storage) latch(err error) error {
+	if err == nil || isSoftError(err) {
+		return err
+	}
+	store.failMu.Lock()
+	defer store.failMu.Unlock()
+	if store.failed == nil {
+		store.log.Errorf("storage failed: %+v", err)
+		store.failed = err
+		for _, hook := range store.fatalHooks {
+			go hook(err)
+		}
+		store.fatalHooks = nil
+	}
+	return err
+}
+
+func (store *Storage) checkFailed(op string) error {
+	store.failMu.Lock()
+	defer store.failMu.Unlock()
+	if store.failed != nil {
+		return errors.Wrapf(store.failed, "%s: storage has failed", op)
+	}
+	return nil
+}
+
 func (store *Storage) CreateSnapshot() error {
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to create snapshot")
+	}
+	if store.snapNVM == nil {
+		return errors.Wrap(internalerror.NotSupported, "snapshot is not supported")
+	}
+	if err := store.checkFailed("create snapshot"); err != nil {
+		return err
+	}
 	store.jr.Lock()
 	defer store.jr.Unlock()
 	if !store.opened {
 		return internalerror.StorageClosed
 	}
-	store.journalSync()
-	return store.innerNVM.CreateSnapshotIfNeeded()
+	if err := store.journalSync(); err != nil {
+		return err
+	}
+	return store.snapNVM.CreateSnapshotIfNeeded()
 }
 
 func (store *Storage) DeleteSnapshot() error {
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to delete snapshot")
+	}
+	if store.snapNVM == nil {
+		return errors.Wrap(internalerror.NotSupported, "snapshot is not supported")
+	}
 	store.jr.Lock()
 	defer store.jr.Unlock()
 	if !store.opened {
 		return internalerror.StorageClosed
 	}
-	return store.innerNVM.DeleteSnapshot()
+	return store.snapNVM.DeleteSnapshot()
 }
 
 func (store *Storage) GetSnapshotReader() (*nvm.SnapshotReader, error) {
+	if store.readOnly {
+		return nil, errors.Wrap(internalerror.StorageReadOnly, "failed to get snapshot reader")
+	}
+	if store.snapNVM == nil {
+		return nil, errors.Wrap(internalerror.NotSupported, "snapshot is not supported")
+	}
+	if err := store.checkFailed("get snapshot reader"); err != nil {
+		return nil, err
+	}
 	store.jr.Lock()
 	defer store.jr.Unlock()
 	if !store.opened {
 		return nil, internalerror.StorageClosed
 	}
-	store.journalSync()
-	reader, err := store.innerNVM.GetSnapshotReader()
+	if err := store.journalSync(); err != nil {
+		return nil, err
+	}
+	reader, err := store.snapNVM.GetSnapshotReader()
 	if err != nil {
-		return nil, errors.Errorf("failed to get Snapshot reader %+v", err)
+		return nil, errors.Wrap(err, "failed to get snapshot reader")
 	}
 	return reader, err
 }
 
 func (store *Storage) Usage() StorageUsage {
-	blockSize := uint64(store.Header().BlockSize.AsU16())
+	store.i.RLock()
+	defer store.i.RUnlock()
+	blockSize := uint64(store.storageHeader.BlockSize.AsU16())
+	stats := store.alloc.Stats()
 	return StorageUsage{
-		JournalCapacity:   store.Header().JournalRegionSize,
-		DataCapacity:      store.Header().DataRegionSize,
+		JournalCapacity:   store.storageHeader.JournalRegionSize,
+		DataCapacity:      store.storageHeader.DataRegionSize,
 		FileCounts:        store.index.Count(),
-		DataFreeBytes:     store.alloc.FreeCount() * blockSize,
+		DataFreeBytes:     stats.FreeBlocks * blockSize,
 		JournalUsageBytes: store.journalRegion.Usage(),
-		MaxSegmentSize:    util.Min(lump.LUMP_MAX_SIZE, store.alloc.MaxSegmentSize()*blockSize-2),
+		MaxSegmentSize:    util.Min(lump.LUMP_MAX_SIZE, stats.LargestFree*blockSize-2),
 		//	CurrentFileSize: uint64(store.innerNVM.RawSize()),
+		FreePortions:   stats.FreePortions,
+		Fragmentation:  stats.Fragmentation,
+		AllocatorStats: stats,
+		Namespaces:     store.namespaceUsage(),
 	}
 }
 
+//AllocatorStats describes the free space of the data region, sizes are in blocks.
+//thread safe
+func (store *Storage) AllocatorStats() allocator.AllocatorStats {
+	store.i.RLock()
+	defer store.i.RUnlock()
+	return store.alloc.Stats()
+}
+
 func (store *Storage) MinId() (lump.LumpId, bool) {
 	store.i.RLock()
 	defer store.i.RUnlock()
@@ -293,6 +763,9 @@ func (store *Storage) MaxId() (lump.LumpId, bool) {
 }
 
 func (store *Storage) First(id lump.LumpId) (lump.LumpId, error) {
+	if err := store.checkFailed("first"); err != nil {
+		return lump.EmptyLump(), err
+	}
 	store.i.RLock()
 	defer store.i.RUnlock()
 	if !store.opened {
@@ -325,15 +798,77 @@ func (store *Storage) GenerateEmptyId() (id lump.LumpId, have bool) {
 	}
 }
 
-func (store *Storage) JournalGC() {
+func (store *Storage) JournalGC() error {
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to run journal gc")
+	}
+	if err := store.checkFailed("journal gc"); err != nil {
+		return err
+	}
 	store.i.Lock()
 	defer store.i.Unlock()
 	store.jr.Lock()
 	defer store.jr.Unlock()
 	if !store.opened {
-		return
+		return internalerror.StorageClosed
+	}
+	before := store.journalRegion.Usage()
+	start := time.Now()
+	//every live record is rewritten by the full GC, it is when an old journal is upgraded
+	upgrade := !store.storageHeader.HasCRC32CJournal()
+	if upgrade {
+		store.journalRegion.SetRecordFormat(journal.RecordCRC32C)
+	}
+	if err := store.journalRegion.GcAllEntries(store.index); err != nil {
+		if upgrade {
+			store.journalRegion.SetRecordFormat(journal.RecordAdler32)
+		}
+		return store.latch(err)
+	}
+	store.log.Infof("journal gc done in %v, usage %d => %d bytes", time.Since(start),
+		before, store.journalRegion.Usage())
+	if upgrade {
+		if err := store.latch(store.upgradeRecordFormat()); err != nil {
+			return err
+		}
+		store.log.Infof("journal records upgraded to %s", journal.RecordCRC32C)
+	}
+	return nil
+}
+
+//upgradeLumpMetaRecords writes the minor version of the records of the lump meta and
+//generation into the storage header, before the first one is appended. The older versions
+//refuse to open the storage then, instead of failing on an unknown record. The layout of
+//the header is kept. store.i and store.jr must be held
+func (store *Storage) upgradeLumpMetaRecords() error {
+	if store.storageHeader.HasLumpMetaRecords() {
+		return nil
+	}
+	header := *store.storageHeader
+	header.MinorVersion = nvm.MINOR_VERSION_LUMP_META
+	if err := nvm.WriteHeader(store.innerNVM, &header); err != nil {
+		return err
 	}
-	store.journalRegion.GcAllEntries(store.index)
+	store.storageHeader = &header
+	//the minor version implies CRC32C, the adler32 records are still read
+	store.journalRegion.SetRecordFormat(journal.RecordCRC32C)
+	store.log.Infof("storage header upgraded to minor version %d for the lump meta records", header.MinorVersion)
+	return nil
+}
+
+//upgradeRecordFormat writes the minor version of CRC32C records into the storage header,
+//the layout of the header is kept
+func (store *Storage) upgradeRecordFormat() error {
+	if err := store.journalSync(); err != nil {
+		return err
+	}
+	header := *store.storageHeader
+	header.MinorVersion = nvm.MINOR_VERSION_CRC32C
+	if err := nvm.WriteHeader(store.innerNVM, &header); err != nil {
+		return err
+	}
+	store.storageHeader = &header
+	return nil
 }
 
 type JournalSnapshot struct {
@@ -355,6 +890,24 @@ func (store *Storage) JournalSnapshot() JournalSnapshot {
 	}
 }
 
+//JournalDump calls fn for each journal record from position from, or from the unreleased
+//head if from is negative, see journal.DumpEntries. The records are not loaded in memory,
+//fn is called with the locks of the storage held
+func (store *Storage) JournalDump(from int64, fn func(journal.DumpEntry) error) error {
+	store.i.RLock()
+	defer store.i.RUnlock()
+	store.jr.Lock()
+	defer store.jr.Unlock()
+	if !store.opened {
+		return internalerror.StorageClosed
+	}
+	start := store.journalRegion.UnreleasedHead()
+	if from >= 0 {
+		start = uint64(from)
+	}
+	return store.journalRegion.DumpEntries(store.index, start, fn)
+}
+
 func (store *Storage) ListRange(start, end lump.LumpId, maxSize uint64) []lump.LumpId {
 	store.i.RLock()
 	defer store.i.RUnlock()
@@ -364,34 +917,55 @@ func (store *Storage) ListRange(start, end lump.LumpId, maxSize uint64) []lump.L
 	return store.index.ListRange(start, end, maxSize)
 }
 
+//lookup is index.Get which does not find the expired lumps, store.i must be held
+func (store *Storage) lookup(lumpid lump.LumpId) (portion.Portion, error) {
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return nil, err
+	}
+	if store.index.IsExpired(lumpid, time.Now().UnixNano()) {
+		return nil, errors.Wrap(internalerror.LumpNotFound, "lump is expired")
+	}
+	return p, nil
+}
+
 // Note the returned size is not accurate size of object, but aligned to block size.
 // For accurate object size, use GetSize, which requires a disk IO.
+// A missing lump is a *LumpError wrapping internalerror.LumpNotFound.
 func (store *Storage) GetSizeOnDisk(lumpid lump.LumpId) (size uint32, err error) {
+	if err = store.checkFailed("get size"); err != nil {
+		return 0, err
+	}
 	store.i.RLock()
 	defer store.i.RUnlock()
 	if !store.opened {
 		return 0, internalerror.StorageClosed
 	}
-	p, err := store.index.Get(lumpid)
+	p, err := store.lookup(lumpid)
 	if err != nil {
-		return 0, err
+		return 0, lumpError("get size", lumpid, err)
 	}
 	return p.SizeOnDisk(block.Min()), nil
 }
 
 // Get accurate size of object, require a disk IO
+// A missing lump is a *LumpError wrapping internalerror.LumpNotFound.
 func (store *Storage) GetSize(lumpid lump.LumpId) (size uint32, err error) {
+	if err = store.checkFailed("get size"); err != nil {
+		return 0, err
+	}
+	store.regions.RLock()
+	defer store.regions.RUnlock()
 	store.i.RLock()
 	if !store.opened {
 		store.i.RUnlock()
 		return 0, internalerror.StorageClosed
 	}
-	p, err := store.index.Get(lumpid)
-
+	p, err := store.lookup(lumpid)
 	store.i.RUnlock()
 
 	if err != nil {
-		return 0, err
+		return 0, lumpError("get size", lumpid, err)
 	}
 	switch v := p.(type) {
 	case portion.DataPortion:
@@ -409,52 +983,104 @@ func (store *Storage) GetSize(lumpid lump.LumpId) (size uint32, err error) {
 	}
 }
 
+//Get returns the data of lumpid. Errors:
+//	*LumpError wrapping internalerror.LumpNotFound if lumpid does not exist
+//	internalerror.StorageClosed if the storage is closed
+//	the latched error (see Err) if the storage has failed, or an I/O error
 func (store *Storage) Get(lumpid lump.LumpId) ([]byte, error) {
-	store.i.RLock()
+	return store.GetContext(context.Background(), lumpid)
+}
+
+//GetContext is Get with tracing and cancellation: if ctx has a span, child spans are
+//created for the disk reads, and ctx.Err() is returned if ctx is done while waiting for locks
+func (store *Storage) GetContext(ctx context.Context, lumpid lump.LumpId) ([]byte, error) {
+	data, _, err := store.get(ctx, lumpid)
+	return data, err
+}
+
+//GetWithVersion is Get which also returns the generation of lumpid, for PutIfVersion and DeleteIfVersion
+func (store *Storage) GetWithVersion(lumpid lump.LumpId) ([]byte, uint64, error) {
+	return store.get(context.Background(), lumpid)
+}
+
+func (store *Storage) get(ctx context.Context, lumpid lump.LumpId) ([]byte, uint64, error) {
+	defer recordLatency(x.StorageMetric.GetLatency, time.Now())
+	if err := store.checkFailed("get"); err != nil {
+		return nil, 0, err
+	}
+	if err := lockContext(ctx, store.regions.RLocker()); err != nil {
+		return nil, 0, err
+	}
+	defer store.regions.RUnlock()
+	if err := lockContext(ctx, store.i.RLocker()); err != nil {
+		return nil, 0, err
+	}
 	if !store.opened {
 		store.i.RUnlock()
-		return nil, internalerror.StorageClosed
+		return nil, 0, internalerror.StorageClosed
+	}
+	p, err := store.lookup(lumpid)
+	var version uint64
+	if err == nil {
+		version = store.index.Version(lumpid)
 	}
-	p, err := store.index.Get(lumpid)
 	store.i.RUnlock()
 	if err != nil {
-		return nil, err
+		return nil, 0, lumpError("get", lumpid, err)
 	}
 
 	switch v := p.(type) {
 	case portion.DataPortion:
+		_, span := startSpan(ctx, "cannyls.data_read")
 		lumpdata, err := store.dataRegion.Get(v)
+		span.End()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		return lumpdata.AsBytes(), nil
+		return lumpdata.AsBytes(), version, nil
 	case portion.JournalPortion:
-		store.jr.Lock()
+		if err := lockContext(ctx, &store.jr); err != nil {
+			return nil, 0, err
+		}
+		_, span := startSpan(ctx, "cannyls.journal_read")
 		data, err := store.journalRegion.GetEmbededData(v)
+		span.End()
 		store.jr.Unlock()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		return data, nil
+		return data, version, nil
 	default:
 		panic("never here")
 	}
 }
 
+//GetWithOffset reads length bytes of lumpId from startOffset. Errors are the same as Get,
+//plus *OffsetError wrapping internalerror.InvalidInput if the range is out of the lump
 func (store *Storage) GetWithOffset(lumpId lump.LumpId, startOffset uint32, length uint32) ([]byte, error) {
+	defer recordLatency(x.StorageMetric.GetLatency, time.Now())
+	if err := store.checkFailed("get"); err != nil {
+		return nil, err
+	}
+	store.regions.RLock()
+	defer store.regions.RUnlock()
 	store.i.RLock()
 	if !store.opened {
 		store.i.RUnlock()
 		return nil, internalerror.StorageClosed
 	}
-	p, err := store.index.Get(lumpId)
+	p, err := store.lookup(lumpId)
 	store.i.RUnlock()
 	if err != nil {
-		return nil, err
+		return nil, lumpError("get", lumpId, err)
 	}
 	switch v := p.(type) {
 	case portion.DataPortion:
-		return store.dataRegion.GetWithOffset(v, startOffset, length)
+		data, err := store.dataRegion.GetWithOffset(v, startOffset, length)
+		if errors.Cause(err) == internalerror.InvalidInput {
+			return nil, &OffsetError{Op: "get", Id: lumpId, Offset: startOffset, Length: length, Err: err}
+		}
+		return data, err
 	case portion.JournalPortion:
 		store.jr.Lock()
 		data, err := store.journalRegion.GetEmbededData(v)
@@ -462,6 +1088,10 @@ func (store *Storage) GetWithOffset(lumpId lump.LumpId, startOffset uint32, leng
 		if err != nil {
 			return nil, err
 		}
+		if uint64(startOffset)+uint64(length) > uint64(len(data)) {
+			return nil, &OffsetError{Op: "get", Id: lumpId, Offset: startOffset, Length: length,
+				Err: errors.Wrap(internalerror.InvalidInput, "given length is too big")}
+		}
 		return data[startOffset : startOffset+length], nil
 	default:
 		panic("never here")
@@ -469,40 +1099,329 @@ func (store *Storage) GetWithOffset(lumpId lump.LumpId, startOffset uint32, leng
 
 }
 
-func (store *Storage) put(lumpid lump.LumpId, lumpdata lump.LumpData) (err error) {
-	dataPortion, err := store.dataRegion.Put(lumpdata)
+//ctx is only used for tracing, a put is not cancelled once it starts
+//putOptions are recorded in the journal with the data portion
+type putOptions struct {
+	meta     []byte //encoded lump.LumpMeta, empty for a plain put
+	expireAt int64  //unix nanoseconds, 0 means the lump never expires
+	version  uint64 //generation of the lump, 0 and 1 are the same. put raises it to the next generation
+}
+
+//put writes lumpdata to the data region outside store.i, so puts and gets do not wait for
+//each other's disk writes, then replaces lumpid and commits the put in one critical
+//section of store.i. It returns the new generation of lumpid
+func (store *Storage) put(ctx context.Context, lumpid lump.LumpId, lumpdata lump.LumpData, opts putOptions) (updated bool, version uint64, err error) {
+	if err = lockContext(ctx, store.regions.RLocker()); err != nil {
+		return false, 0, err
+	}
+	defer store.regions.RUnlock()
+	if !store.opened {
+		return false, 0, internalerror.StorageClosed
+	}
+	//the trailer is appended to lumpdata by the data region
+	length := lumpdata.Inner.Len()
+	//write the data outside store.i, so the lump is not changed if it fails
+	dataPortion, err := store.writeData(ctx, lumpdata)
+	if errors.Cause(err) == internalerror.StorageFull {
+		//an overwrite could reuse the portion of the old lump. The delete is journaled,
+		//writeData syncs it before the portion is released, so a crash never replays the
+		//old put over the new bytes. The old lump is lost if the new data does not fit
+		store.i.Lock()
+		updated, _, err = store.deleteLocked(lumpid, true)
+		store.i.Unlock()
+		if err != nil {
+			return updated, 0, err
+		}
+		lumpdata.Inner.Truncate(length)
+		dataPortion, err = store.writeData(ctx, lumpdata)
+	}
 	if err != nil {
-		return
+		return updated, 0, err
 	}
 
-	store.i.Lock()
+	if err = lockContext(ctx, &store.i); err != nil {
+		store.dataRegion.Release(dataPortion)
+		return updated, 0, err
+	}
 	defer store.i.Unlock()
+	if err = store.checkQuota("put", lumpid, dataSizeOnDisk(length)); err != nil {
+		store.dataRegion.Release(dataPortion)
+		return updated, 0, err
+	}
+	version = store.nextVersion(lumpid)
+	if opts.version > version {
+		//an imported lump keeps its generation
+		version = opts.version
+	}
+	if deleted, _, _ := store.deleteLocked(lumpid, false); deleted {
+		updated = true
+	}
+	opts.version = version
+	if err = store.commitPut(ctx, lumpid, dataPortion, opts); err != nil {
+		return updated, 0, err
+	}
+	return updated, version, nil
+}
 
+//writeData writes lumpdata to the data region, the returned portion is not in the index yet
+func (store *Storage) writeData(ctx context.Context, lumpdata lump.LumpData) (portion.DataPortion, error) {
+	length := lumpdata.Inner.Len()
+	dataPortion, err := store.dataRegion.PutContext(ctx, lumpdata)
+	if errors.Cause(err) == internalerror.StorageFull && store.dataRegion.HasPendingRelease() {
+		//the portions deleted after the last sync could be reused after a sync
+		store.jr.Lock()
+		_, span := startSpan(ctx, "cannyls.fsync")
+		err = store.journalSync()
+		span.End()
+		store.jr.Unlock()
+		if err != nil {
+			return dataPortion, err
+		}
+		//the failed put has appended the trailer already
+		lumpdata.Inner.Truncate(length)
+		dataPortion, err = store.dataRegion.PutContext(ctx, lumpdata)
+	}
+	if err != nil {
+		return dataPortion, store.latch(err)
+	}
+	return dataPortion, nil
+}
+
+//commitPut records the put in the journal and the index, store.i must be held
+func (store *Storage) commitPut(ctx context.Context, lumpid lump.LumpId, dataPortion portion.DataPortion, opts putOptions) (err error) {
 	store.jr.Lock()
-	err = store.journalRegion.RecordPut(store.index, lumpid, dataPortion)
+	_, span := startSpan(ctx, "cannyls.journal_append")
+	if opts.version > 1 || len(opts.meta) > 0 {
+		err = store.upgradeLumpMetaRecords()
+	}
+	if err != nil {
+		//the header is not upgraded, the record is not appended
+	} else if opts.version > 1 {
+		err = store.journalRegion.RecordPutVersion(store.index, lumpid, dataPortion, opts.version, opts.meta)
+	} else if len(opts.meta) == 0 {
+		err = store.journalRegion.RecordPut(store.index, lumpid, dataPortion)
+	} else {
+		err = store.journalRegion.RecordPutWithMeta(store.index, lumpid, dataPortion, opts.meta)
+	}
+	span.End()
 	store.jr.Unlock()
 
 	if err != nil {
 		// revert the dataPortion
 		store.dataRegion.Release(dataPortion)
-		return
+		return store.latch(err)
 	}
 
 	store.index.InsertDataPortion(lumpid, dataPortion)
+	store.accountAdd(lumpid, dataPortion)
+	store.index.SetMeta(lumpid, opts.meta)
+	if opts.expireAt != 0 {
+		store.index.SetExpire(lumpid, opts.expireAt)
+	}
+	store.index.SetVersion(lumpid, opts.version)
+	return nil
+}
 
-	if int64(lumpdata.Inner.Len()) == 1 {
+//nextVersion returns the generation of the next put of lumpid, store.i must be held.
+//It is bigger than the generation of the lump and of any deleted lump, so a lump
+//deleted and put again never gets one of its old generations back
+func (store *Storage) nextVersion(lumpid lump.LumpId) uint64 {
+	if _, err := store.lookup(lumpid); err == nil {
+		return store.index.Version(lumpid) + 1
+	}
+	version := store.index.Retired()
+	if _, err := store.index.Get(lumpid); err == nil {
+		//an expired lump is not deleted yet
+		if v := store.index.Version(lumpid); v > version {
+			version = v
+		}
+	}
+	return version + 1
+}
 
-		panic("FUCK")
+//versionLocked returns the generation of lumpid, 0 if it is not found. store.i must be held
+func (store *Storage) versionLocked(lumpid lump.LumpId) uint64 {
+	if _, err := store.lookup(lumpid); err != nil {
+		return 0
 	}
-	return
+	return store.index.Version(lumpid)
 }
 
+//Put creates or overwrites lumpid, updated is true if lumpid existed. Errors:
+//	internalerror.StorageReadOnly, internalerror.StorageClosed
+//	internalerror.StorageFull or internalerror.JournalStorageFull if there is no space
+//	internalerror.InvalidInput if the data is too large
+//	the latched error (see Err) if the storage has failed, or an I/O error which fails it
+//The generation of lumpid is bumped, PutWithVersion returns it
 func (store *Storage) Put(lumpid lump.LumpId, lumpdata lump.LumpData) (updated bool, err error) {
-	err = nil
-	if updated, _, err = store.deleteIfExist(lumpid, false); err != nil {
-		return updated, err
+	return store.PutContext(context.Background(), lumpid, lumpdata)
+}
+
+//PutContext is Put with tracing and cancellation: if ctx has a span, child spans are
+//created for the allocator, the data region write and the journal append.
+//ctx is only checked before the put changes anything, so a cancelled put never
+//leaves the lump half updated
+func (store *Storage) PutContext(ctx context.Context, lumpid lump.LumpId, lumpdata lump.LumpData) (updated bool, err error) {
+	updated, _, err = store.putWithVersion(ctx, lumpid, lumpdata)
+	return
+}
+
+//PutWithVersion is Put which also returns the new generation of lumpid, see PutIfVersion
+func (store *Storage) PutWithVersion(lumpid lump.LumpId, lumpdata lump.LumpData) (updated bool, version uint64, err error) {
+	return store.putWithVersion(context.Background(), lumpid, lumpdata)
+}
+
+func (store *Storage) putWithVersion(ctx context.Context, lumpid lump.LumpId, lumpdata lump.LumpData) (bool, uint64, error) {
+	defer recordLatency(x.StorageMetric.PutLatency, time.Now())
+	if store.readOnly {
+		return false, 0, errors.Wrap(internalerror.StorageReadOnly, "failed to put")
+	}
+	if err := store.checkFailed("put"); err != nil {
+		return false, 0, err
+	}
+	return store.put(ctx, lumpid, lumpdata, putOptions{})
+}
+
+//PutWithMeta is Put which also attaches meta to lumpid, the meta is kept in the journal
+//and returned by GetMeta until the lump is deleted or put again.
+//An invalid meta is internalerror.InvalidInput, other errors are the same as Put
+func (store *Storage) PutWithMeta(lumpid lump.LumpId, lumpdata lump.LumpData, meta lump.LumpMeta) (updated bool, err error) {
+	return store.PutWithMetaContext(context.Background(), lumpid, lumpdata, meta)
+}
+
+//PutWithMetaContext is PutWithMeta with tracing and cancellation, see PutContext
+func (store *Storage) PutWithMetaContext(ctx context.Context, lumpid lump.LumpId, lumpdata lump.LumpData, meta lump.LumpMeta) (updated bool, err error) {
+	defer recordLatency(x.StorageMetric.PutLatency, time.Now())
+	if store.readOnly {
+		return false, errors.Wrap(internalerror.StorageReadOnly, "failed to put")
+	}
+	encoded, err := meta.Encode()
+	if err != nil {
+		return false, lumpError("put", lumpid, err)
+	}
+	if err = store.checkFailed("put"); err != nil {
+		return false, err
+	}
+	opts := putOptions{meta: encoded}
+	if !meta.ExpireAt.IsZero() {
+		opts.expireAt = meta.ExpireAt.UnixNano()
+	}
+	updated, _, err = store.put(ctx, lumpid, lumpdata, opts)
+	return
+}
+
+//PutIfVersion puts lumpid only if its generation is expected, and returns the new
+//generation. The check and the put are atomic under store.i, so readers wait for
+//the data write. If the generation is not expected, the error is a *VersionError
+//wrapping internalerror.VersionConflict, other errors are the same as Put.
+//The generation is kept in the journal. A lump put after its delete gets a generation
+//bigger than any it had; PutWithOffset updates a lump in place and keeps its generation
+func (store *Storage) PutIfVersion(lumpid lump.LumpId, lumpdata lump.LumpData, expected uint64) (uint64, error) {
+	return store.putIf(context.Background(), lumpid, lumpdata, expected)
+}
+
+//PutIfAbsent puts lumpid only if it does not exist, it is PutIfVersion with 0
+func (store *Storage) PutIfAbsent(lumpid lump.LumpId, lumpdata lump.LumpData) (uint64, error) {
+	return store.putIf(context.Background(), lumpid, lumpdata, 0)
+}
+
+func (store *Storage) putIf(ctx context.Context, lumpid lump.LumpId, lumpdata lump.LumpData, expected uint64) (uint64, error) {
+	defer recordLatency(x.StorageMetric.PutLatency, time.Now())
+	if store.readOnly {
+		return 0, errors.Wrap(internalerror.StorageReadOnly, "failed to put")
+	}
+	if err := store.checkFailed("put"); err != nil {
+		return 0, err
+	}
+	if err := lockContext(ctx, &store.i); err != nil {
+		return 0, err
+	}
+	defer store.i.Unlock()
+	if !store.opened {
+		return 0, internalerror.StorageClosed
+	}
+	current := store.versionLocked(lumpid)
+	if current != expected {
+		return current, &VersionError{Op: "put", Id: lumpid, Expected: expected, Actual: current}
+	}
+	if err := store.checkQuota("put", lumpid, dataSizeOnDisk(lumpdata.Inner.Len())); err != nil {
+		return current, err
+	}
+	//write the data first, so the lump is not changed if it fails
+	dataPortion, err := store.writeData(ctx, lumpdata)
+	if err != nil {
+		return current, err
+	}
+	version := store.nextVersion(lumpid)
+	if _, _, err = store.deleteLocked(lumpid, false); err != nil {
+		store.dataRegion.Release(dataPortion)
+		return current, err
+	}
+	if err = store.commitPut(ctx, lumpid, dataPortion, putOptions{version: version}); err != nil {
+		return current, err
+	}
+	return version, nil
+}
+
+//DeleteIfVersion deletes lumpid only if its generation is expected, see PutIfVersion.
+//A missing lump has generation 0
+func (store *Storage) DeleteIfVersion(lumpid lump.LumpId, expected uint64) error {
+	defer recordLatency(x.StorageMetric.DeleteLatency, time.Now())
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to delete")
+	}
+	if err := store.checkFailed("delete"); err != nil {
+		return err
+	}
+	store.i.Lock()
+	defer store.i.Unlock()
+	if !store.opened {
+		return internalerror.StorageClosed
+	}
+	current := store.versionLocked(lumpid)
+	if current != expected {
+		return &VersionError{Op: "delete", Id: lumpid, Expected: expected, Actual: current}
 	}
-	return updated, store.put(lumpid, lumpdata)
+	if current == 0 {
+		return nil
+	}
+	_, _, err := store.deleteLocked(lumpid, true)
+	return err
+}
+
+//PutWithTTL is Put of a lump which expires after ttl. An expired lump is not found
+//by Get, and it is deleted by RunSideJobOnce or ReapExpired later.
+//The expire time is kept in the journal as the ExpireAt of lump.LumpMeta
+func (store *Storage) PutWithTTL(lumpid lump.LumpId, lumpdata lump.LumpData, ttl time.Duration) (updated bool, err error) {
+	if ttl <= 0 {
+		return false, lumpError("put", lumpid, errors.Wrap(internalerror.InvalidInput, "ttl must be positive"))
+	}
+	return store.PutWithMeta(lumpid, lumpdata, lump.LumpMeta{ExpireAt: time.Now().Add(ttl)})
+}
+
+//GetMeta returns the meta attached by PutWithMeta, it is empty if the lump is
+//put without meta. A missing lump is a *LumpError wrapping internalerror.LumpNotFound
+func (store *Storage) GetMeta(lumpid lump.LumpId) (lump.LumpMeta, error) {
+	if err := store.checkFailed("get meta"); err != nil {
+		return lump.LumpMeta{}, err
+	}
+	store.i.RLock()
+	defer store.i.RUnlock()
+	if !store.opened {
+		return lump.LumpMeta{}, internalerror.StorageClosed
+	}
+	if _, err := store.lookup(lumpid); err != nil {
+		return lump.LumpMeta{}, lumpError("get meta", lumpid, err)
+	}
+	encoded, ok := store.index.GetMeta(lumpid)
+	if !ok {
+		return lump.LumpMeta{}, nil
+	}
+	meta, err := lump.DecodeLumpMeta(encoded)
+	if err != nil {
+		return lump.LumpMeta{}, lumpError("get meta", lumpid, errors.Wrap(internalerror.StorageCorrupted, err.Error()))
+	}
+	return meta, nil
 }
 
 // padding payload with necessary zeros before and after, return:
@@ -524,66 +1443,153 @@ func paddingWithZero(payload []byte, startOffset, reservation uint32) []byte {
 // for object update, `reservation` is ignored since space is already allocated,
 // and return error when write offset exceeds reserved object size.
 // Untouched space are zeroed.
+// Writing out of the reserved size is an *OffsetError wrapping internalerror.InvalidInput,
+// updating an embedded lump is a *LumpError wrapping internalerror.NotSupported.
+// An update bumps the generation of the lump and is journaled, see recordUpdate.
 func (store *Storage) PutWithOffset(lumpid lump.LumpId, lumpdata lump.LumpData,
 	startOffset uint32, reservation uint32) (err error) {
+	defer recordLatency(x.StorageMetric.PutLatency, time.Now())
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to put")
+	}
+	if err = store.checkFailed("put"); err != nil {
+		return err
+	}
 
-	store.i.RLock()
+	store.i.Lock()
 	if !store.opened {
-		store.i.RUnlock()
+		store.i.Unlock()
 		return internalerror.StorageClosed
 	}
-	p, err := store.index.Get(lumpid)
-	store.i.RUnlock()
+	p, err := store.lookup(lumpid)
 	payload := lumpdata.AsBytes()
 
 	if err != nil {
+		store.i.Unlock()
 		// Only one error possible, which is "object could not be found",
-		// meaning this is a new object. Padding necessary zeros and call `put`
+		// meaning this is a new object (an expired one is replaced).
+		// Padding necessary zeros and call `put`
 		toWrite := paddingWithZero(payload, startOffset, reservation)
 		data := block.FromBytes(toWrite, block.Min())
 		lumpdata = lump.NewLumpDataWithAb(data)
-		return store.put(lumpid, lumpdata)
+		_, _, err = store.put(context.Background(), lumpid, lumpdata, putOptions{})
+		return err
 	}
 
 	// update exist object; `reservation` is ignored in this case
+	defer store.i.Unlock()
 
 	switch v := p.(type) {
 	case portion.DataPortion:
-		return store.dataRegion.Update(v, startOffset, payload)
+		err = store.dataRegion.Update(v, startOffset, payload)
+		if errors.Cause(err) == internalerror.InvalidInput {
+			return &OffsetError{Op: "put", Id: lumpid, Offset: startOffset, Length: uint32(len(payload)), Err: err}
+		}
+		if err != nil {
+			return store.latch(err)
+		}
+		return store.recordUpdate(lumpid, v)
 	case portion.JournalPortion:
 		// TODO?
-		return errors.Wrap(internalerror.InvalidInput, "embedt object does not support update")
+		return lumpError("put", lumpid, errors.Wrap(internalerror.NotSupported, "embedded object does not support update"))
 	default:
 		panic("never here")
 	}
 }
 
+//recordUpdate journals the update in place of lumpid as a put of the same portion with
+//the next generation, so a journal replay (see PointInTime) knows the bytes were written
+//again. The index is updated first, the journal GC must not relocate the older record
+//after this one. store.i must be held
+func (store *Storage) recordUpdate(lumpid lump.LumpId, p portion.DataPortion) error {
+	version := store.index.Version(lumpid)
+	meta, _ := store.index.GetMeta(lumpid)
+	store.index.SetVersion(lumpid, version+1)
+	store.jr.Lock()
+	err := store.upgradeLumpMetaRecords()
+	if err == nil {
+		err = store.journalRegion.RecordPutVersion(store.index, lumpid, p, version+1, meta)
+	}
+	store.jr.Unlock()
+	if err != nil {
+		store.index.SetVersion(lumpid, version)
+		return store.latch(err)
+	}
+	return nil
+}
+
+//PutEmbed stores data in the journal, the errors are the same as Put
 func (store *Storage) PutEmbed(lumpid lump.LumpId, data []byte) (updated bool, err error) {
-	if updated, _, err = store.deleteIfExist(lumpid, false); err != nil {
-		return
+	defer recordLatency(x.StorageMetric.PutLatency, time.Now())
+	if store.readOnly {
+		return false, errors.Wrap(internalerror.StorageReadOnly, "failed to put")
 	}
+	if err = store.checkFailed("put embed"); err != nil {
+		return false, err
+	}
+	return store.putEmbed(lumpid, data, 0)
+}
 
+//putEmbed is PutEmbed whose generation is at least version
+func (store *Storage) putEmbed(lumpid lump.LumpId, data []byte, version uint64) (updated bool, err error) {
 	store.i.Lock()
 	defer store.i.Unlock()
+	if !store.opened {
+		return false, internalerror.StorageClosed
+	}
+	if err = store.checkQuota("put", lumpid, uint64(len(data))); err != nil {
+		return
+	}
+	if next := store.nextVersion(lumpid); next > version {
+		version = next
+	}
+	updated, _, _ = store.deleteLocked(lumpid, false)
 	store.jr.Lock()
 	defer store.jr.Unlock()
-	err = store.journalRegion.RecordEmbed(store.index, lumpid, data)
+	if version > 1 {
+		if err = store.upgradeLumpMetaRecords(); err == nil {
+			err = store.journalRegion.RecordEmbedVersion(store.index, lumpid, data, version)
+		}
+	} else {
+		err = store.journalRegion.RecordEmbed(store.index, lumpid, data)
+	}
+	if err = store.latch(err); err != nil {
+		return
+	}
+	if p, err := store.index.Get(lumpid); err == nil {
+		store.accountAdd(lumpid, p)
+	}
 	return
 }
 
+//Delete removes lumpid. Deleting a missing lump is not an error, updated is false.
+//Errors are internalerror.StorageReadOnly, internalerror.StorageClosed, or the latched error
 func (store *Storage) Delete(lumpid lump.LumpId) (updated bool, size uint32, err error) {
-	updated, size, err = store.deleteIfExist(lumpid, true)
+	defer recordLatency(x.StorageMetric.DeleteLatency, time.Now())
+	if store.readOnly {
+		return false, 0, errors.Wrap(internalerror.StorageReadOnly, "failed to delete")
+	}
+	if err = store.checkFailed("delete"); err != nil {
+		return false, 0, err
+	}
+	updated, size, err = store.deleteIfExist(context.Background(), lumpid, true)
 	return
 }
 
-func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, uint32, error) {
+func (store *Storage) deleteIfExist(ctx context.Context, lumpid lump.LumpId, doRecord bool) (bool, uint32, error) {
 
-	store.i.Lock()
+	if err := lockContext(ctx, &store.i); err != nil {
+		return false, 0, err
+	}
 	defer store.i.Unlock()
 	if !store.opened {
 		return false, 0, internalerror.StorageClosed
 	}
+	return store.deleteLocked(lumpid, doRecord)
+}
 
+//deleteLocked is deleteIfExist with store.i held
+func (store *Storage) deleteLocked(lumpid lump.LumpId, doRecord bool) (bool, uint32, error) {
 	p, err := store.index.Get(lumpid)
 
 	//if not exist
@@ -591,15 +1597,28 @@ func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, ui
 		return false, 0, nil
 	}
 
-	//Because previous Get is ok, this Delete will surely success
-	if ok := store.index.Delete(lumpid); ok == false {
+	//Because previous Get is ok, this Delete will surely success. A lump which is
+	//not recorded deleted is put again, its generation is not retired
+	ok := false
+	if doRecord {
+		ok = store.index.Delete(lumpid)
+	} else {
+		ok = store.index.Remove(lumpid)
+	}
+	if ok == false {
 		panic("Delete after Get failed, something bad happend")
 	}
+	store.accountRemove(lumpid, p)
 
 	if doRecord {
+		//the index is updated first, otherwise the journal GC in RecordDelete would
+		//relocate the deleted lump's record after the delete record
 		store.jr.Lock()
-		store.journalRegion.RecordDelete(store.index, lumpid)
+		err = store.journalRegion.RecordDelete(store.index, lumpid)
 		store.jr.Unlock()
+		if err != nil {
+			return false, 0, store.latch(err)
+		}
 	}
 
 	var releasedSize uint32
@@ -607,7 +1626,7 @@ func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, ui
 	switch v := p.(type) {
 	case portion.DataPortion:
 		releasedSize = uint32(v.Len) * uint32(store.innerNVM.BlockSize().AsU16())
-		store.dataRegion.Release(v)
+		store.dataRegion.DeferRelease(v)
 	case portion.JournalPortion:
 		releasedSize = uint32(v.Len)
 
@@ -628,9 +1647,11 @@ func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, ui
 
 /*
 return value: len([]float) no more than 12800 points, each point is 4MB
-//thread-UNSAFE
+For the whole data region, use AllocatorStats
 */
 func (store *Storage) GetAllocationStatus() []float64 {
+	store.i.RLock()
+	defer store.i.RUnlock()
 	//each point represents 4M bytes
 	blockSizeBytes := store.storageHeader.BlockSize.AsU32()
 
@@ -646,61 +1667,170 @@ func (store *Storage) GetAllocationStatus() []float64 {
 		total = 12800 * n //max size is 50GB
 	}
 
-	return store.alloc.GetAllocationBitStatus(n, total)
+	return store.dataRegion.AllocationStatus(n, total)
 }
 
-func (store *Storage) Sync() {
-	store.jr.Lock()
+func (store *Storage) Sync() error {
+	return store.SyncContext(context.Background())
+}
+
+//SyncContext is Sync with tracing and cancellation: if ctx has a span, child spans are
+//created for the journal flush and fsync, and ctx.Err() is returned if ctx is done
+//while waiting for the journal lock
+func (store *Storage) SyncContext(ctx context.Context) error {
+	defer recordLatency(x.StorageMetric.SyncLatency, time.Now())
+	if store.readOnly {
+		return nil
+	}
+	if err := store.checkFailed("sync"); err != nil {
+		return err
+	}
+	if err := lockContext(ctx, &store.jr); err != nil {
+		return err
+	}
 	defer store.jr.Unlock()
 	if !store.opened {
-		return
+		return internalerror.StorageClosed
+	}
+	_, span := startSpan(ctx, "cannyls.flush")
+	err := store.journalRegion.Flush()
+	span.End()
+	if err != nil {
+		return store.latch(err)
 	}
-	store.journalSync()
+	_, span = startSpan(ctx, "cannyls.fsync")
+	defer span.End()
+	return store.journalSync()
 }
 
-func (store *Storage) Flush() {
+func (store *Storage) Flush() error {
+	if store.readOnly {
+		return nil
+	}
+	if err := store.checkFailed("flush"); err != nil {
+		return err
+	}
 	store.jr.Lock()
 	defer store.jr.Unlock()
 	if !store.opened {
-		return
+		return internalerror.StorageClosed
 	}
-	store.journalRegion.Flush()
+	return store.latch(store.journalRegion.Flush())
 }
 
-func (store *Storage) journalSync() {
-	store.journalRegion.Sync()
+func recordLatency(measure *ostats.Float64Measure, start time.Time) {
+	ostats.Record(context.Background(), measure.M(x.SinceInMilliseconds(start)))
 }
 
-func (store *Storage) Close() {
-	store.jr.Lock()
-	defer store.jr.Unlock()
+func (store *Storage) journalSync() error {
+	if err := store.journalRegion.Sync(); err != nil {
+		return store.latch(err)
+	}
+	//the deleted portions are not referenced by the durable journal any more
+	store.dataRegion.ReleasePending()
+	return nil
+}
+
+//Close releases the storage even if it has failed, the returned error is
+//from the last journal sync
+func (store *Storage) Close() (err error) {
+	//the side job and the usage worker take the locks, stop them first
+	if store.gcStopper != nil {
+		store.gcStopOnce.Do(store.gcStopper.Stop)
+	}
+	store.usageStopOnce.Do(store.updateCapacityStopper.Stop)
+	store.regions.Lock()
+	defer store.regions.Unlock()
 	store.i.Lock()
 	defer store.i.Unlock()
+	store.jr.Lock()
+	defer store.jr.Unlock()
 	if !store.opened {
-		return
+		return nil
 	}
-	fmt.Printf("close")
+	store.log.Infof("close storage")
 	store.opened = false
-	store.updateCapacityStopper.Stop() //will wait goroutine's end
-	store.journalSync()
+	if !store.readOnly && store.checkFailed("close") == nil {
+		err = store.journalSync()
+	}
 	store.innerNVM.Close()
+	if store.journalFile != nil {
+		store.journalFile.Close()
+	}
 	store.index.Free()
 	store.alloc.Free()
+	return
 }
 
-func (store *Storage) RunSideJobOnce(countSideJob int) {
+//RunSideJobOnce reaps countSideJob expired lumps, and fills the GC queue, syncs or relocates
+//countSideJob live journal entries as the GC policy decides. countSideJob <= 0 takes the step
+//size of the policy, and reaps journal.SIDE_JOB_GC_STEP lumps. Options.BackgroundGC calls it
+//periodically
+func (store *Storage) RunSideJobOnce(countSideJob int) error {
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to run side job")
+	}
+	if err := store.checkFailed("side job"); err != nil {
+		return err
+	}
 	store.i.Lock()
 	defer store.i.Unlock()
+	if store.opened == false {
+		return internalerror.StorageClosed
+	}
+	reap := countSideJob
+	if reap <= 0 {
+		reap = journal.SIDE_JOB_GC_STEP
+	}
+	if _, err := store.reapExpired(reap); err != nil {
+		return err
+	}
 	store.jr.Lock()
 	defer store.jr.Unlock()
+	return store.latch(store.journalRegion.RunSideJobOnce(store.index, countSideJob))
+}
+
+//ReapExpired deletes no more than max expired lumps, and returns the number of
+//deleted lumps. RunSideJobOnce calls it as well, so it is not needed if the side
+//jobs are running
+func (store *Storage) ReapExpired(max int) (int, error) {
+	if store.readOnly {
+		return 0, errors.Wrap(internalerror.StorageReadOnly, "failed to reap expired")
+	}
+	if err := store.checkFailed("reap expired"); err != nil {
+		return 0, err
+	}
+	store.i.Lock()
+	defer store.i.Unlock()
 	if store.opened == false {
-		return
+		return 0, internalerror.StorageClosed
+	}
+	return store.reapExpired(max)
+}
+
+func (store *Storage) reapExpired(max int) (n int, err error) {
+	for _, id := range store.index.Expired(time.Now().UnixNano(), max) {
+		if _, _, err = store.deleteLocked(id, true); err != nil {
+			return
+		}
+		n++
+	}
+	if n > 0 {
+		ostats.Record(context.Background(), x.StorageMetric.Expired.M(int64(n)))
+		store.log.Debugf("reaped %d expired lumps", n)
 	}
-	store.journalRegion.RunSideJobOnce(store.index, countSideJob)
+	return
 }
 
 //half open range: [start, end)
 func (store *Storage) DeleteRange(start lump.LumpId, end lump.LumpId, hasDataPortion bool) error {
+	defer recordLatency(x.StorageMetric.DeleteLatency, time.Now())
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to delete range")
+	}
+	if err := store.checkFailed("delete range"); err != nil {
+		return err
+	}
 	//write a DeleteRange record into journal
 	store.i.Lock()
 	defer store.i.Unlock()
@@ -711,7 +1841,7 @@ func (store *Storage) DeleteRange(start lump.LumpId, end lump.LumpId, hasDataPor
 	err := store.journalRegion.RecordDeleteRange(store.index, start, end)
 	store.jr.Unlock()
 	if err != nil {
-		return err
+		return store.latch(err)
 	}
 	return store.index.RangeIter(start, end, func(id lump.LumpId, p portion.Portion) error {
 		p, err := store.index.Get(id)
@@ -719,9 +1849,10 @@ func (store *Storage) DeleteRange(start lump.LumpId, end lump.LumpId, hasDataPor
 			return err
 		}
 		store.index.Delete(id)
+		store.accountRemove(id, p)
 		switch v := p.(type) {
 		case portion.DataPortion:
-			store.dataRegion.Release(v)
+			store.dataRegion.DeferRelease(v)
 		}
 		return nil
 
@@ -729,21 +1860,26 @@ func (store *Storage) DeleteRange(start lump.LumpId, end lump.LumpId, hasDataPor
 }
 
 //added API for raft log and raft apply
+//A missing lump is a *LumpError wrapping internalerror.LumpNotFound, an embedded
+//lump is a *LumpError wrapping internalerror.NotSupported
 func (store *Storage) GetRecord(lumpid lump.LumpId) (*portion.DataPortion, error) {
+	if err := store.checkFailed("get record"); err != nil {
+		return nil, err
+	}
 	store.i.RLock()
 	defer store.i.RUnlock()
 	if store.opened == false {
 		return nil, internalerror.StorageClosed
 	}
-	p, err := store.index.Get(lumpid)
+	p, err := store.lookup(lumpid)
 	if err != nil {
-		return nil, err
+		return nil, lumpError("get record", lumpid, err)
 	}
 	switch v := p.(type) {
 	case portion.DataPortion:
 		return &v, nil
 	default:
-		return nil, errors.Errorf("only support DataPortion")
+		return nil, lumpError("get record", lumpid, errors.Wrap(internalerror.NotSupported, "only support DataPortion"))
 	}
 }
 
@@ -782,12 +1918,18 @@ func (store *Storage) DeleteRecord(lumpid lump.LumpId) error {
 		}
 		return store.journalRegion.RecordDelete(store.index, lumpid)
 	default:
-		return errors.Errorf("only support DataPortion")
+		return errors.Wrap(internalerror.NotSupported, "only support DataPortion")
 	}
 }
 */
 
 func (store *Storage) WriteRecord(lumpid lump.LumpId, dataPortion portion.DataPortion) error {
+	if store.readOnly {
+		return errors.Wrap(internalerror.StorageReadOnly, "failed to write record")
+	}
+	if err := store.checkFailed("write record"); err != nil {
+		return err
+	}
 	store.i.Lock()
 	defer store.i.Unlock()
 	store.jr.Lock()
@@ -796,8 +1938,12 @@ func (store *Storage) WriteRecord(lumpid lump.LumpId, dataPortion portion.DataPo
 		return internalerror.StorageClosed
 	}
 	if err := store.journalRegion.RecordPut(store.index, lumpid, dataPortion); err != nil {
-		return err
+		return store.latch(err)
+	}
+	if old, err := store.index.Get(lumpid); err == nil {
+		store.accountRemove(lumpid, old)
 	}
 	store.index.InsertDataPortion(lumpid, dataPortion)
+	store.accountAdd(lumpid, dataPortion)
 	return nil
 }
@@ -1,18 +1,25 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/logger"
 	"github.com/thesues/cannyls-go/lump"
 	x "github.com/thesues/cannyls-go/metrics"
+	"github.com/thesues/cannyls-go/nvm"
 	"github.com/thesues/cannyls-go/storage/journal"
 	"github.com/thesues/cannyls-go/util"
 )
@@ -95,7 +102,7 @@ func TestCreateCannylsStorageWork(t *testing.T) {
 	//snapshot
 	storage.Sync()
 	reader, err := storage.GetSnapshotReader()
-	defer storage.innerNVM.DeleteSnapshot()
+	defer storage.snapNVM.DeleteSnapshot()
 	assert.Nil(t, err)
 
 	updated, err = storage.PutEmbed(lumpid("00"), []byte("hello"))
@@ -152,12 +159,18 @@ func TestCreateCannylsStorageFull(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, updated)
 
-	updated, err = storage.Put(lumpid("0000"), zeroedData(512*1024))
+	//the overwrite reuses the space of the old lump
+	updated, err = storage.Put(lumpid("0000"), dataFromBytes(bytes.Repeat([]byte{1}, 512*1024)))
 	assert.Nil(t, err)
 	assert.True(t, updated)
+	data, err := storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 512*1024), data)
 
 	updated, err = storage.Put(lumpid("1111"), zeroedData(512*1024))
 	assert.Error(t, err)
+	_, err = storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
 
 	storage.Delete(lumpid("0000"))
 	updated, err = storage.Put(lumpid("1111"), zeroedData(512*1024))
@@ -165,6 +178,41 @@ func TestCreateCannylsStorageFull(t *testing.T) {
 
 }
 
+func TestStorageFullOverwriteCrash(t *testing.T) {
+	device, err := nvm.NewFaultyNVM(1 << 20)
+	assert.Nil(t, err)
+	assert.Nil(t, formatStorage(device, 0.01))
+	storage, err := openStorageOnNVM(device)
+	assert.Nil(t, err)
+	old := bytes.Repeat([]byte{1}, 700*1024)
+	_, err = storage.Put(lumpid("0000"), dataFromBytes(old))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Sync())
+
+	//the new data only fits in the portion of the old lump, and it is shorter
+	updated, err := storage.Put(lumpid("0000"), dataFromBytes(bytes.Repeat([]byte{2}, 600*1024)))
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	//the data write reaches the disk, the put record does not
+	assert.Nil(t, device.Sync())
+	image := device.Crash(nvm.CrashDropUnsynced, nil)
+	storage.Close()
+
+	path := "full-overwrite-crash.lusf"
+	defer os.Remove(path)
+	assert.Nil(t, ioutil.WriteFile(path, image, 0644))
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	defer storage.Close()
+	//the old put is not replayed over the new bytes
+	data, err := storage.Get(lumpid("0000"))
+	if err == nil {
+		assert.Equal(t, bytes.Repeat([]byte{2}, 600*1024), data)
+	} else {
+		assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	}
+}
+
 func TestCreateCannylsStorageFullGC(t *testing.T) {
 
 	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
@@ -447,6 +495,12 @@ func TestMetricHttpSever(t *testing.T) {
 	rr := httptest.NewRecorder()
 	x.PrometheusHandler.ServeHTTP(rr, req)
 	fmt.Printf("%s", rr.Body.String())
+
+	body := rr.Body.String()
+	assert.Contains(t, body, "cannyls_PutLatency_bucket")
+	assert.Contains(t, body, "cannyls_SyncLatency_bucket")
+	assert.Contains(t, body, `cannyls_JournalAppends{type="embed"}`)
+	assert.Contains(t, body, `cannyls_WriteLatency_bucket{region="journal"`)
 }
 
 func storageRangeDelete(t *testing.T, reOpen bool, isEmbeded bool) {
@@ -659,3 +713,1139 @@ func BenchmarkStoragGetDataMultiThread(b *testing.B) {
 
 	}
 }
+
+func TestStorageReadOnly(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp11.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	_, err = store.PutEmbed(lumpid("00"), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = store.Put(lumpid("01"), dataFromBytes([]byte("world")))
+	assert.Nil(t, err)
+	store.Sync()
+
+	//the writer still holds the exclusive lock
+	ro, err := OpenCannylsStorageReadOnly("tmp11.lusf")
+	assert.Nil(t, err)
+	data, err := ro.Get(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), data)
+	ro.Close()
+	store.Close()
+
+	before, err := ioutil.ReadFile("tmp11.lusf")
+	assert.Nil(t, err)
+
+	ro, err = OpenCannylsStorageReadOnly("tmp11.lusf")
+	assert.Nil(t, err)
+	assert.True(t, ro.IsReadOnly())
+	//shared lock allows more readers, but no writer
+	ro2, err := OpenCannylsStorageReadOnly("tmp11.lusf")
+	assert.Nil(t, err)
+	defer ro2.Close()
+	_, err = OpenCannylsStorage("tmp11.lusf")
+	assert.Error(t, err)
+
+	data, err = ro.Get(lumpid("00"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	_, err = ro.Put(lumpid("02"), dataFromBytes([]byte("quux")))
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	_, err = ro.PutEmbed(lumpid("02"), []byte("quux"))
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	err = ro.PutWithOffset(lumpid("01"), dataFromBytes([]byte("quux")), 0, 0)
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	_, _, err = ro.Delete(lumpid("00"))
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	err = ro.DeleteRange(lumpid("00"), lumpid("10"), true)
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	err = ro.CreateSnapshot()
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	_, err = ro.GetSnapshotReader()
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	err = ro.JournalGC()
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	err = ro.RunSideJobOnce(64)
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	_, err = ro.ReapExpired(64)
+	assert.Equal(t, internalerror.StorageReadOnly, errors.Cause(err))
+	ro.Sync()
+	ro.Close()
+
+	after, err := ioutil.ReadFile("tmp11.lusf")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(before, after))
+}
+
+func TestStorageFatalError(t *testing.T) {
+	device, err := nvm.NewFaultyNVM(4 << 20)
+	assert.Nil(t, err)
+	assert.Nil(t, formatStorage(device, 0.01))
+	store, err := openStorageOnNVM(device)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	failed := make(chan error, 1)
+	store.OnFatalError(func(err error) {
+		failed <- err
+	})
+
+	_, err = store.Put(lumpid("00"), dataFromBytes([]byte("hello")))
+	assert.Nil(t, err)
+
+	//soft errors do not fail the storage
+	_, err = store.PutEmbed(lumpid("01"), make([]byte, lump.MAX_EMBEDDED_SIZE+1))
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	assert.Nil(t, store.Err())
+
+	device.FailWrite(0)
+	_, err = store.Put(lumpid("02"), dataFromBytes([]byte("world")))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(store.Err()))
+
+	select {
+	case err = <-failed:
+		assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+	case <-time.After(time.Second):
+		t.Fatal("OnFatalError hook is not called")
+	}
+
+	//all further calls return the latched error, including reads
+	_, err = store.Get(lumpid("00"))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+	_, err = store.Put(lumpid("03"), dataFromBytes([]byte("again")))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+	_, _, err = store.Delete(lumpid("00"))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(store.Sync()))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(store.JournalGC()))
+
+	//a hook registered after the failure is still called
+	store.OnFatalError(func(err error) {
+		failed <- err
+	})
+	select {
+	case err = <-failed:
+		assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+	case <-time.After(time.Second):
+		t.Fatal("OnFatalError hook is not called")
+	}
+}
+
+func TestStorageSyncError(t *testing.T) {
+	device, err := nvm.NewFaultyNVM(4 << 20)
+	assert.Nil(t, err)
+	assert.Nil(t, formatStorage(device, 0.01))
+	store, err := openStorageOnNVM(device)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, err = store.PutEmbed(lumpid("00"), []byte("hello"))
+	assert.Nil(t, err)
+	device.FailSync(0)
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(store.Sync()))
+	_, err = store.PutEmbed(lumpid("01"), []byte("world"))
+	assert.Equal(t, nvm.ErrInjected, errors.Cause(err))
+}
+
+func TestStorageLogger(t *testing.T) {
+	var mu sync.Mutex
+	var msgs []string
+	log := logger.FuncLogger(func(level logger.Level, msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, level.String()+" "+msg)
+	})
+	store, err := CreateCannylsStorageWithOptions("tmp11.lusf", 10<<20, 0.01, Options{Logger: log})
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	_, err = store.PutEmbed(lumpid("00"), []byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.JournalGC())
+	assert.Nil(t, store.CreateSnapshot())
+	assert.Nil(t, store.DeleteSnapshot())
+	store.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"INFO created storage", "INFO restored 0 lumps", "INFO opened storage",
+		"INFO journal gc done", "INFO created snapshot file", "INFO delete snapshot file", "INFO close storage"}
+	if assert.Equal(t, len(expected), len(msgs), "%v", msgs) {
+		for i := range expected {
+			assert.Contains(t, msgs[i], expected[i])
+		}
+	}
+}
+
+func TestStorageTypedErrors(t *testing.T) {
+	storage, err := CreateCannylsStorage("typederr.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("typederr.lusf")
+	defer storage.Close()
+
+	var lumpErr *LumpError
+	_, err = storage.Get(lumpid("404"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	assert.False(t, errors.Is(err, internalerror.InvalidInput))
+	assert.True(t, errors.As(err, &lumpErr))
+	assert.Equal(t, lumpid("404"), lumpErr.Id)
+	assert.Equal(t, internalerror.LumpNotFound, errors.Cause(err))
+
+	_, err = storage.GetSize(lumpid("404"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	_, err = storage.GetRecord(lumpid("404"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+
+	_, err = storage.PutEmbed(lumpid("01"), []byte("embed"))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("02"), dataFromBytes([]byte("hello")))
+	assert.Nil(t, err)
+
+	var offsetErr *OffsetError
+	_, err = storage.GetWithOffset(lumpid("01"), 3, 10)
+	assert.True(t, errors.As(err, &offsetErr))
+	assert.Equal(t, lumpid("01"), offsetErr.Id)
+	assert.Equal(t, uint32(3), offsetErr.Offset)
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+
+	_, err = storage.GetWithOffset(lumpid("02"), 0, 1<<20)
+	assert.True(t, errors.As(err, &offsetErr))
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+
+	err = storage.PutWithOffset(lumpid("02"), dataFromBytes([]byte("world")), 1<<20, 0)
+	assert.True(t, errors.As(err, &offsetErr))
+	assert.Equal(t, uint32(1<<20), offsetErr.Offset)
+
+	_, err = storage.GetRecord(lumpid("01"))
+	assert.True(t, errors.Is(err, internalerror.NotSupported))
+
+	//none of them fails the storage
+	assert.Nil(t, storage.Err())
+}
+
+func TestStorageLumpMeta(t *testing.T) {
+	storage, err := CreateCannylsStorage("meta.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("meta.lusf")
+
+	meta := lump.LumpMeta{
+		ContentType: "text/plain",
+		Created:     time.Unix(1500000000, 0),
+		Owner:       "alice",
+	}
+	_, err = storage.PutWithMeta(lumpid("01"), dataFromBytes([]byte("hello")), meta)
+	assert.Nil(t, err)
+	_, err = storage.PutWithMeta(lumpid("02"), dataFromBytes([]byte("world")), lump.LumpMeta{Owner: "bob"})
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("03"), dataFromBytes([]byte("plain")))
+	assert.Nil(t, err)
+
+	got, err := storage.GetMeta(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", got.Owner)
+	got, err = storage.GetMeta(lumpid("03"))
+	assert.Nil(t, err)
+	assert.True(t, got.IsEmpty())
+	_, err = storage.GetMeta(lumpid("04"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+
+	//put again without meta drops the meta
+	_, err = storage.Put(lumpid("02"), dataFromBytes([]byte("again")))
+	assert.Nil(t, err)
+	got, err = storage.GetMeta(lumpid("02"))
+	assert.Nil(t, err)
+	assert.True(t, got.IsEmpty())
+
+	//the meta survives journal gc and restore
+	assert.Nil(t, storage.JournalGC())
+	assert.Nil(t, storage.Close())
+	storage, err = OpenCannylsStorage("meta.lusf")
+	assert.Nil(t, err)
+	defer storage.Close()
+
+	got, err = storage.GetMeta(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", got.ContentType)
+	assert.Equal(t, "alice", got.Owner)
+	assert.True(t, meta.Created.Equal(got.Created))
+	data, err := storage.Get(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	got, err = storage.GetMeta(lumpid("02"))
+	assert.Nil(t, err)
+	assert.True(t, got.IsEmpty())
+}
+
+func TestStorageTTL(t *testing.T) {
+	storage, err := CreateCannylsStorage("ttl.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("ttl.lusf")
+
+	_, err = storage.PutWithTTL(lumpid("01"), dataFromBytes([]byte("short")), 50*time.Millisecond)
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("02"), dataFromBytes([]byte("long")), time.Hour)
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("03"), dataFromBytes([]byte("never")), 0)
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+
+	data, err := storage.Get(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("short"), data)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = storage.Get(lumpid("01"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	_, err = storage.GetSize(lumpid("01"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+
+	//the expire time survives restart
+	assert.Nil(t, storage.Close())
+	storage, err = OpenCannylsStorage("ttl.lusf")
+	assert.Nil(t, err)
+	defer storage.Close()
+	_, err = storage.Get(lumpid("01"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	meta, err := storage.GetMeta(lumpid("02"))
+	assert.Nil(t, err)
+	assert.True(t, meta.ExpireAt.After(time.Now()))
+
+	//the reaper deletes the expired lump only
+	assert.Equal(t, uint64(2), storage.Usage().FileCounts)
+	n, err := storage.ReapExpired(10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, uint64(1), storage.Usage().FileCounts)
+	assert.Nil(t, storage.RunSideJobOnce(10))
+	data, err = storage.Get(lumpid("02"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("long"), data)
+
+	//an expired lump could be put again
+	_, err = storage.PutWithTTL(lumpid("03"), dataFromBytes([]byte("soon")), time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, storage.PutWithOffset(lumpid("03"), dataFromBytes([]byte("new")), 0, 0))
+	data, err = storage.Get(lumpid("03"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), data)
+}
+
+func TestStorageVersion(t *testing.T) {
+	storage, err := CreateCannylsStorage("version.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("version.lusf")
+
+	v, err := storage.PutIfAbsent(lumpid("01"), dataFromBytes([]byte("v1")))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), v)
+	v, err = storage.PutIfAbsent(lumpid("01"), dataFromBytes([]byte("again")))
+	var versionErr *VersionError
+	assert.True(t, errors.As(err, &versionErr))
+	assert.True(t, errors.Is(err, internalerror.VersionConflict))
+	assert.Equal(t, uint64(0), versionErr.Expected)
+	assert.Equal(t, uint64(1), versionErr.Actual)
+	assert.Equal(t, uint64(1), v)
+
+	//Put bumps the version as well
+	_, err = storage.Put(lumpid("01"), dataFromBytes([]byte("v2")))
+	assert.Nil(t, err)
+	v, err = storage.PutIfVersion(lumpid("01"), dataFromBytes([]byte("v3")), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), v)
+	_, err = storage.PutIfVersion(lumpid("01"), dataFromBytes([]byte("stale")), 2)
+	assert.True(t, errors.Is(err, internalerror.VersionConflict))
+	data, v, err := storage.GetWithVersion(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), data)
+	assert.Equal(t, uint64(3), v)
+
+	_, err = storage.PutWithMeta(lumpid("02"), dataFromBytes([]byte("meta")), lump.LumpMeta{Owner: "alice"})
+	assert.Nil(t, err)
+	_, err = storage.PutWithMeta(lumpid("02"), dataFromBytes([]byte("meta2")), lump.LumpMeta{Owner: "bob"})
+	assert.Nil(t, err)
+
+	assert.True(t, errors.Is(storage.DeleteIfVersion(lumpid("02"), 1), internalerror.VersionConflict))
+	_, err = storage.PutIfAbsent(lumpid("03"), dataFromBytes([]byte("deleted")))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.DeleteIfVersion(lumpid("03"), 1))
+	_, err = storage.Get(lumpid("03"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+
+	//versions survive journal gc and restart
+	assert.Nil(t, storage.JournalGC())
+	assert.Nil(t, storage.Close())
+	storage, err = OpenCannylsStorage("version.lusf")
+	assert.Nil(t, err)
+	defer storage.Close()
+	data, v, err = storage.GetWithVersion(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), data)
+	assert.Equal(t, uint64(3), v)
+	_, v, err = storage.GetWithVersion(lumpid("02"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), v)
+	meta, err := storage.GetMeta(lumpid("02"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", meta.Owner)
+	//a lump put after its delete does not get its old generation back,
+	//the delete record is released by the journal gc before the restart
+	v, err = storage.PutIfAbsent(lumpid("03"), dataFromBytes([]byte("new")))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), v)
+	_, err = storage.PutIfVersion(lumpid("03"), dataFromBytes([]byte("stale")), 1)
+	assert.True(t, errors.Is(err, internalerror.VersionConflict))
+
+	//so does an embedded lump
+	_, _, err = storage.Delete(lumpid("03"))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("03"), []byte("embed"))
+	assert.Nil(t, err)
+	_, v, err = storage.GetWithVersion(lumpid("03"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), v)
+	assert.Nil(t, storage.JournalGC())
+	assert.Nil(t, storage.Close())
+	storage, err = OpenCannylsStorage("version.lusf")
+	assert.Nil(t, err)
+	defer storage.Close()
+	data, v, err = storage.GetWithVersion(lumpid("03"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("embed"), data)
+	assert.Equal(t, uint64(3), v)
+	_, err = storage.PutIfVersion(lumpid("03"), dataFromBytes([]byte("stale")), 2)
+	assert.True(t, errors.Is(err, internalerror.VersionConflict))
+
+	//concurrent writers, only one wins each version
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wins := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, v, err := storage.GetWithVersion(lumpid("01"))
+				if err != nil {
+					continue
+				}
+				if _, err = storage.PutIfVersion(lumpid("01"), dataFromBytes([]byte("x")), v); err == nil {
+					mu.Lock()
+					wins++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	_, v, err = storage.GetWithVersion(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3+wins), v)
+
+	_, v, err = storage.PutWithVersion(lumpid("01"), dataFromBytes([]byte("y")))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4+wins), v)
+}
+
+func TestStorageVersionConcurrentPut(t *testing.T) {
+	storage, err := CreateCannylsStorage("version.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("version.lusf")
+	defer storage.Close()
+	free := storage.AllocatorStats().FreeBlocks
+
+	//Put and PutIfAbsent race on one lump, every success is a new generation
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	versions := make(map[uint64]bool)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var v uint64
+				var err error
+				if i%2 == 0 {
+					_, v, err = storage.PutWithVersion(lumpid("01"), dataFromBytes([]byte{byte(j)}))
+				} else if v, err = storage.PutIfAbsent(lumpid("01"), dataFromBytes([]byte("absent"))); err != nil {
+					assert.True(t, errors.Is(err, internalerror.VersionConflict))
+					continue
+				}
+				assert.Nil(t, err)
+				mu.Lock()
+				assert.False(t, versions[v], "generation %d is returned twice", v)
+				versions[v] = true
+				mu.Unlock()
+			}
+		}(i)
+		if i%2 == 1 {
+			//PutIfAbsent succeeds again after the lump is deleted
+			_, _, err = storage.Delete(lumpid("01"))
+			assert.Nil(t, err)
+		}
+	}
+	wg.Wait()
+
+	//no data portion is leaked
+	_, _, err = storage.Delete(lumpid("01"))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Sync())
+	assert.Equal(t, free, storage.AllocatorStats().FreeBlocks)
+}
+
+func TestStorageNamespace(t *testing.T) {
+	storage, err := CreateCannylsStorage("namespace.lusf", 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("namespace.lusf")
+
+	_, err = storage.Put(lumpid("1001"), dataFromBytes([]byte("before")))
+	assert.Nil(t, err)
+
+	tenant := Namespace{Name: "tenant", Start: lumpid("1000"), End: lumpid("2000"), MaxBytes: 2048, MaxLumps: 3}
+	assert.Nil(t, storage.DeclareNamespace(tenant))
+	err = storage.DeclareNamespace(Namespace{Name: "other", Start: lumpid("1fff"), End: lumpid("3000")})
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+	assert.Nil(t, storage.DeclareNamespace(Namespace{Name: "other", Start: lumpid("2000"), End: lumpid("3000")}))
+
+	usage := storage.Usage().Namespaces
+	assert.Equal(t, 2, len(usage))
+	assert.Equal(t, "tenant", usage[0].Name)
+	assert.Equal(t, uint64(1), usage[0].Lumps)
+	assert.Equal(t, uint64(512), usage[0].Bytes)
+
+	_, err = storage.Put(lumpid("1002"), dataFromBytes(make([]byte, 1000)))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("1003"), []byte("embed"))
+	assert.Nil(t, err)
+	usage = storage.NamespaceUsage()
+	assert.Equal(t, uint64(3), usage[0].Lumps)
+	assert.Equal(t, uint64(512+1024+5), usage[0].Bytes)
+
+	//too many lumps
+	_, err = storage.Put(lumpid("1004"), dataFromBytes([]byte("x")))
+	var quotaErr *QuotaError
+	assert.True(t, errors.As(err, &quotaErr))
+	assert.True(t, errors.Is(err, internalerror.QuotaExceeded))
+	assert.Equal(t, "tenant", quotaErr.Namespace)
+	assert.Nil(t, storage.Err())
+
+	//too many bytes, and the old lump is kept
+	_, err = storage.Put(lumpid("1001"), dataFromBytes(make([]byte, 1000)))
+	assert.True(t, errors.Is(err, internalerror.QuotaExceeded))
+	data, err := storage.Get(lumpid("1001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("before"), data)
+	_, err = storage.PutIfVersion(lumpid("1001"), dataFromBytes(make([]byte, 1000)), 1)
+	assert.True(t, errors.Is(err, internalerror.QuotaExceeded))
+
+	//overwrite in the quota
+	_, err = storage.Put(lumpid("1001"), dataFromBytes([]byte("after")))
+	assert.Nil(t, err)
+	_, _, err = storage.Delete(lumpid("1003"))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("1004"), dataFromBytes([]byte("x")))
+	assert.Nil(t, err)
+
+	//lumps out of the namespaces have no quota
+	_, err = storage.Put(lumpid("5000"), dataFromBytes(make([]byte, 4096)))
+	assert.Nil(t, err)
+
+	assert.Nil(t, storage.DropNamespace("tenant"))
+	usage = storage.NamespaceUsage()
+	assert.Equal(t, 1, len(usage))
+	assert.Equal(t, "other", usage[0].Name)
+	_, err = storage.Get(lumpid("1001"))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	_, err = storage.Get(lumpid("5000"))
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(storage.DropNamespace("tenant"), internalerror.InvalidInput))
+	assert.Nil(t, storage.Close())
+
+	//namespaces are declared by the options on open
+	storage, err = OpenCannylsStorageWithOptions("namespace.lusf", Options{Namespaces: []Namespace{
+		{Name: "all", Start: lumpid("0"), End: lumpid("ffff")},
+	}})
+	assert.Nil(t, err)
+	defer storage.Close()
+	usage = storage.NamespaceUsage()
+	assert.Equal(t, uint64(1), usage[0].Lumps)
+}
+
+func TestStorageNamespaceConcurrentPut(t *testing.T) {
+	tenant := Namespace{Name: "tenant", Start: lumpid("1000"), End: lumpid("2000"), MaxBytes: 8 * 512, MaxLumps: 6}
+	storage, err := CreateCannylsStorageWithOptions("namespace.lusf", 10<<20, 0.01, Options{Namespaces: []Namespace{tenant}})
+	assert.Nil(t, err)
+	defer os.Remove("namespace.lusf")
+	defer storage.Close()
+
+	//the quota is checked and accounted in one critical section
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				_, err = storage.Put(lump.FromU64(0, 0x1000+uint64(i)), dataFromBytes([]byte("x")))
+			} else {
+				_, err = storage.PutEmbed(lump.FromU64(0, 0x1000+uint64(i)), []byte("x"))
+			}
+			if err != nil {
+				assert.True(t, errors.Is(err, internalerror.QuotaExceeded))
+			}
+		}(i)
+	}
+	wg.Wait()
+	usage := storage.NamespaceUsage()
+	assert.Equal(t, uint64(6), usage[0].Lumps)
+	assert.Equal(t, uint64(len(storage.ListRange(tenant.Start, tenant.End, 100))), usage[0].Lumps)
+	assert.True(t, usage[0].Bytes <= tenant.MaxBytes)
+}
+
+func TestStorageJournalRecovery(t *testing.T) {
+	path := "recovery.lusf"
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove(path)
+	//10 embed records of 25 bytes from the front of the ring buffer
+	for i := 1; i <= 10; i++ {
+		_, err = storage.PutEmbed(lumpidnum(i), []byte("0123456789"))
+		assert.Nil(t, err)
+	}
+	header := storage.Header()
+	storage.Close()
+
+	//flip a data byte of the 5th record, its checksum fails
+	ringStart := int64(journalRingStart(&header))
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("x"), ringStart+4*25+20)
+	assert.Nil(t, err)
+	f.Close()
+
+	_, err = OpenCannylsStorage(path)
+	assert.True(t, errors.Is(err, internalerror.StorageCorrupted))
+	corrupted, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	storage, err = OpenCannylsStorageWithOptions(path, Options{ReadOnly: true, Recovery: journal.RecoverTruncateTail})
+	assert.Nil(t, err)
+	report := storage.RecoveryReport()
+	assert.False(t, report.Clean())
+	assert.True(t, report.Truncated)
+	assert.Equal(t, uint64(4*25), report.TruncatedAt)
+	assert.Equal(t, uint64(6*25), report.BytesLost)
+	assert.Equal(t, int64(4), report.Records)
+	assert.Equal(t, []lump.LumpId{lumpidnum(1), lumpidnum(2), lumpidnum(3), lumpidnum(4)}, storage.List())
+	storage.Close()
+
+	//a writable open persists the truncation, even if nothing is appended
+	truncated := "recovery-truncated.lusf"
+	assert.Nil(t, ioutil.WriteFile(truncated, corrupted, 0644))
+	defer os.Remove(truncated)
+	storage, err = OpenCannylsStorageWithOptions(truncated, Options{Recovery: journal.RecoverTruncateTail})
+	assert.Nil(t, err)
+	assert.True(t, storage.RecoveryReport().Truncated)
+	storage.Close()
+	storage, err = OpenCannylsStorage(truncated)
+	assert.Nil(t, err)
+	assert.True(t, storage.RecoveryReport().Clean())
+	assert.Equal(t, []lump.LumpId{lumpidnum(1), lumpidnum(2), lumpidnum(3), lumpidnum(4)}, storage.List())
+	storage.Close()
+
+	storage, err = OpenCannylsStorageWithOptions(path, Options{Recovery: journal.RecoverSkipCorrupted})
+	assert.Nil(t, err)
+	report = storage.RecoveryReport()
+	assert.False(t, report.Truncated)
+	assert.Equal(t, []journal.SkippedRange{{Start: 4 * 25, End: 5 * 25}}, report.Skipped)
+	assert.Equal(t, uint64(25), report.BytesLost)
+	assert.Equal(t, int64(9), report.Records)
+	assert.Equal(t, 9, len(storage.List()))
+	_, err = storage.Get(lumpidnum(5))
+	assert.True(t, errors.Is(err, internalerror.LumpNotFound))
+	data, err := storage.Get(lumpidnum(6))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("0123456789"), data)
+
+	//the live records are relocated past the skipped range on open, so the next open is clean
+	storage.Close()
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	defer storage.Close()
+	assert.True(t, storage.RecoveryReport().Clean())
+	assert.Equal(t, uint64(9), storage.index.Count())
+}
+
+func TestStorageJournalDump(t *testing.T) {
+	path := "dump.lusf"
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove(path)
+	_, err = storage.Put(lumpidnum(1), zeroedData(42))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(2), []byte("0123456789"))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpidnum(1), zeroedData(42))
+	assert.Nil(t, err)
+	_, _, err = storage.Delete(lumpidnum(2))
+	assert.Nil(t, err)
+
+	var entries []journal.DumpEntry
+	collect := func(entry journal.DumpEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}
+	assert.Nil(t, storage.JournalDump(-1, collect))
+	tags := make([]byte, 0, len(entries))
+	garbage := make([]bool, 0, len(entries))
+	for _, entry := range entries {
+		tags = append(tags, entry.Record.Tag())
+		garbage = append(garbage, entry.Garbage)
+		assert.True(t, entry.Checksum.Valid())
+		assert.Equal(t, journal.RecordCRC32C, entry.Checksum.Format)
+	}
+	assert.Equal(t, []byte{journal.TAG_PUT, journal.TAG_EMBED, journal.TAG_PUT_VERSION, journal.TAG_DELETE}, tags)
+	assert.Equal(t, []bool{true, true, false, true}, garbage)
+	snap := storage.JournalSnapshot()
+	for i, entry := range snap.Entries {
+		assert.Equal(t, entry.Start.AsU64(), entries[i].Position)
+	}
+
+	//from the third record
+	from := entries[2].Position
+	entries = nil
+	assert.Nil(t, storage.JournalDump(int64(from), collect))
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, from, entries[0].Position)
+	header := storage.Header()
+	storage.Close()
+
+	//the records after a corrupted one are still decoded
+	ringStart := int64(journalRingStart(&header))
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("x"), ringStart+int64(from)+journal.EMBEDDED_DATA_OFFSET)
+	assert.Nil(t, err)
+	f.Close()
+	storage, err = OpenCannylsStorageWithOptions(path, Options{ReadOnly: true, Recovery: journal.RecoverTruncateTail})
+	assert.Nil(t, err)
+	defer storage.Close()
+	entries = nil
+	assert.Nil(t, storage.JournalDump(-1, collect))
+	assert.Equal(t, 4, len(entries))
+	assert.False(t, entries[2].Checksum.Valid())
+	assert.True(t, entries[3].Checksum.Valid())
+}
+
+func TestStorageExternalJournal(t *testing.T) {
+	path, journalPath := "external.lusf", "external-journal.lusf"
+	defer os.Remove(path)
+	defer os.Remove(journalPath)
+	storage, err := CreateCannylsStorageWithOptions(path, 10<<20, 0.01, Options{JournalPath: journalPath})
+	assert.Nil(t, err)
+	header := storage.Header()
+	assert.True(t, header.HasExternalJournal())
+	assert.Equal(t, uint64(10<<20)-header.RegionSize(), header.DataRegionSize)
+	_, err = storage.Put(lumpidnum(1), dataFromBytes([]byte("data")))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(2), []byte("embed"))
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(storage.CreateSnapshot(), internalerror.NotSupported))
+	assert.Nil(t, storage.Close())
+
+	journalHeader, err := nvm.ReadHeaderFromPath(journalPath)
+	assert.Nil(t, err)
+	assert.True(t, journalHeader.IsJournalFile())
+
+	//the journal path is required, and the journal file is not a storage
+	_, err = OpenCannylsStorage(path)
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+	_, err = OpenCannylsStorage(journalPath)
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+
+	//the journal of another storage is rejected
+	otherPath, otherJournalPath := "external2.lusf", "external2-journal.lusf"
+	defer os.Remove(otherPath)
+	defer os.Remove(otherJournalPath)
+	other, err := CreateCannylsStorageWithOptions(otherPath, 10<<20, 0.01, Options{JournalPath: otherJournalPath})
+	assert.Nil(t, err)
+	other.Close()
+	_, err = OpenCannylsStorageWithJournal(path, otherJournalPath)
+	assert.True(t, errors.Is(err, internalerror.InvalidInput))
+
+	storage, err = OpenCannylsStorageWithJournal(path, journalPath)
+	assert.Nil(t, err)
+	data, err := storage.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), data)
+	data, err = storage.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("embed"), data)
+	assert.Nil(t, storage.Close())
+
+	storage, err = OpenCannylsStorageWithOptions(path, Options{ReadOnly: true, JournalPath: journalPath})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(storage.List()))
+	storage.Close()
+}
+
+func TestStorageResizeJournal(t *testing.T) {
+	path := "resize-journal.lusf"
+	defer os.Remove(path)
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	oldHeader := storage.Header()
+
+	//the first lumps are in the front of the data region, they are moved by the grow
+	expected := make(map[int][]byte)
+	for i := 0; i < 20; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1000+i)
+		_, err = storage.Put(lumpidnum(i), dataFromBytes(data))
+		assert.Nil(t, err)
+		expected[i] = data
+	}
+	_, err = storage.PutWithMeta(lumpidnum(20), dataFromBytes([]byte("meta")), lump.LumpMeta{Owner: "alice"})
+	assert.Nil(t, err)
+	expected[20] = []byte("meta")
+	_, err = storage.Put(lumpidnum(3), dataFromBytes([]byte("v2")))
+	assert.Nil(t, err)
+	expected[3] = []byte("v2")
+	_, err = storage.PutEmbed(lumpidnum(21), []byte("embed"))
+	assert.Nil(t, err)
+	expected[21] = []byte("embed")
+	_, _, err = storage.Delete(lumpidnum(5))
+	assert.Nil(t, err)
+	delete(expected, 5)
+
+	check := func(storage *Storage) {
+		assert.Equal(t, len(expected), len(storage.List()))
+		for i, want := range expected {
+			data, err := storage.Get(lumpidnum(i))
+			assert.Nil(t, err, "lump %d", i)
+			assert.Equal(t, want, data, "lump %d", i)
+		}
+		meta, err := storage.GetMeta(lumpidnum(20))
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", meta.Owner)
+		_, version, err := storage.GetWithVersion(lumpidnum(3))
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(2), version)
+	}
+
+	//grow takes the space from the data region
+	assert.Nil(t, storage.ResizeJournal(1<<20))
+	header := storage.Header()
+	assert.Equal(t, uint64(1<<20), header.JournalRegionSize)
+	assert.Equal(t, oldHeader.DataRegionSize-(1<<20-oldHeader.JournalRegionSize), header.DataRegionSize)
+	check(storage)
+	_, err = storage.Put(lumpidnum(100), dataFromBytes([]byte("after grow")))
+	assert.Nil(t, err)
+	expected[100] = []byte("after grow")
+	assert.Nil(t, storage.Close())
+
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1<<20), storage.Header().JournalRegionSize)
+	check(storage)
+
+	//shrink gives the space back
+	assert.Nil(t, storage.ResizeJournal(64<<10))
+	assert.Equal(t, uint64(64<<10), storage.Header().JournalRegionSize)
+	assert.Equal(t, oldHeader.DataRegionSize+oldHeader.JournalRegionSize-(64<<10), storage.Header().DataRegionSize)
+	check(storage)
+	assert.True(t, errors.Is(storage.ResizeJournal(512), internalerror.InvalidInput))
+	assert.Nil(t, storage.Close())
+
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	check(storage)
+	storage.Close()
+
+	storage, err = OpenCannylsStorageWithOptions(path, Options{ReadOnly: true})
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(storage.ResizeJournal(1<<20), internalerror.StorageReadOnly))
+	storage.Close()
+}
+
+func TestStorageResizeExternalJournal(t *testing.T) {
+	path, journalPath := "resize-external.lusf", "resize-external-journal.lusf"
+	defer os.Remove(path)
+	defer os.Remove(journalPath)
+	storage, err := CreateCannylsStorageWithOptions(path, 10<<20, 0.01, Options{JournalPath: journalPath})
+	assert.Nil(t, err)
+	dataSize := storage.Header().DataRegionSize
+	_, err = storage.Put(lumpidnum(1), dataFromBytes([]byte("data")))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(2), []byte("embed"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, storage.ResizeJournal(2<<20))
+	assert.Equal(t, dataSize, storage.Header().DataRegionSize)
+	assert.Nil(t, storage.Close())
+
+	journalHeader, err := nvm.ReadHeaderFromPath(journalPath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2<<20), journalHeader.JournalRegionSize)
+
+	storage, err = OpenCannylsStorageWithJournal(path, journalPath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2<<20), storage.Header().JournalRegionSize)
+	data, err := storage.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), data)
+	data, err = storage.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("embed"), data)
+	storage.Close()
+}
+
+func TestStorageResizeJournalConcurrent(t *testing.T) {
+	path := "resize-concurrent.lusf"
+	defer os.Remove(path)
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	defer storage.Close()
+	for i := 0; i < 10; i++ {
+		_, err = storage.Put(lumpidnum(i), dataFromBytes(bytes.Repeat([]byte{byte(i)}, 1000)))
+		assert.Nil(t, err)
+	}
+
+	//the readers and writers run while the regions are replaced, go test -race checks them
+	stop := make(chan struct{})
+	var wg, started sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		started.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				usage := storage.Usage()
+				assert.True(t, usage.DataCapacity > 0)
+				storage.AllocatorStats()
+				storage.GetAllocationStatus()
+				i := n % 10
+				data, err := storage.Get(lumpidnum(i))
+				assert.Nil(t, err)
+				assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1000), data)
+				_, err = storage.Put(lumpidnum(100+w), dataFromBytes([]byte("writer")))
+				assert.Nil(t, err)
+				if n == 0 {
+					started.Done()
+				}
+			}
+		}(w)
+	}
+	started.Wait()
+	for _, size := range []uint64{1 << 20, 64 << 10, 512 << 10} {
+		assert.Nil(t, storage.ResizeJournal(size))
+		assert.Equal(t, size, storage.Header().JournalRegionSize)
+	}
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, 14, len(storage.List()))
+}
+
+func TestStorageBackgroundGC(t *testing.T) {
+	path := "background-gc.lusf"
+	defer os.Remove(path)
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.1)
+	assert.Nil(t, err)
+	storage.SetGCPolicy(journal.IdleOnlyGCPolicy{IdleAfter: time.Hour})
+	//the overwritten records are garbage, the idle-only policy leaves them
+	for i := 0; i < 2000; i++ {
+		_, err = storage.PutEmbed(lumpidnum(i%10), []byte("garbage"))
+		assert.Nil(t, err)
+	}
+	before := storage.Usage().JournalUsageBytes
+	assert.Nil(t, storage.RunSideJobOnce(0))
+	assert.Nil(t, storage.Close())
+
+	storage, err = OpenCannylsStorageWithOptions(path, Options{BackgroundGC: time.Millisecond})
+	assert.Nil(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for storage.Usage().JournalUsageBytes >= before/2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(t, storage.Usage().JournalUsageBytes < before/2)
+	for i := 0; i < 10; i++ {
+		data, err := storage.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("garbage"), data)
+	}
+	assert.Nil(t, storage.Close())
+	assert.Nil(t, storage.Close())
+}
+
+func TestStorageBackgroundGCReapsExpired(t *testing.T) {
+	path := "background-reap.lusf"
+	defer os.Remove(path)
+	storage, err := CreateCannylsStorageWithOptions(path, 10<<20, 0.01, Options{BackgroundGC: time.Millisecond})
+	assert.Nil(t, err)
+	defer storage.Close()
+	_, err = storage.PutWithTTL(lumpid("01"), dataFromBytes([]byte("short")), 20*time.Millisecond)
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("02"), dataFromBytes([]byte("long")), time.Hour)
+	assert.Nil(t, err)
+
+	//the background GC deletes the expired lump, not only hides it
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storage.List()) > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, []lump.LumpId{lumpid("02")}, storage.List())
+	n, err := storage.ReapExpired(10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestStorageUpgradeRecordFormat(t *testing.T) {
+	path := "upgrade-format.lusf"
+	defer os.Remove(path)
+	crc32c := func(storage *Storage) bool {
+		header := storage.Header()
+		return header.HasCRC32CJournal()
+	}
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	assert.True(t, crc32c(storage))
+	assert.Nil(t, storage.Close())
+
+	//format it again as a storage of the previous minor version
+	file, header, err := nvm.Open(path)
+	assert.Nil(t, err)
+	header.MinorVersion = nvm.MINOR_VERSION_CRC32C - 1
+	header.Mirrored = false
+	buf := new(bytes.Buffer)
+	assert.Nil(t, header.WriteHeaderRegionTo(buf))
+	journal.InitialJournalRegion(buf, header.BlockSize, journal.HeadSector, header.JournalRegionSize)
+	assert.Nil(t, writeAlignedAt(file, buf.Bytes(), 0))
+	file.Close()
+
+	//tags returns the on-disk tags of the journal records, they are next to each other
+	ringStart := int64(header.RegionSize() + 512)
+	tags := func(storage *Storage) []byte {
+		raw, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		snap := storage.JournalSnapshot()
+		pos := int64(snap.UnreleasedHead)
+		var tags []byte
+		for _, entry := range snap.Entries {
+			tags = append(tags, raw[ringStart+pos+4])
+			pos += int64(entry.Record.ExternalSize())
+		}
+		return tags
+	}
+
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	assert.False(t, crc32c(storage))
+	_, err = storage.Put(lumpidnum(1), dataFromBytes([]byte("old")))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(2), []byte("embed"))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Sync())
+	assert.Equal(t, []byte{journal.TAG_PUT, journal.TAG_EMBED}, tags(storage))
+
+	//the full GC rewrites the records and upgrades the header
+	assert.Nil(t, storage.JournalGC())
+	assert.True(t, crc32c(storage))
+	_, err = storage.Put(lumpidnum(3), dataFromBytes([]byte("new")))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Sync())
+	for _, tag := range tags(storage) {
+		assert.NotZero(t, tag&journal.TAG_CRC32C)
+	}
+	assert.Nil(t, storage.Close())
+
+	header2, err := nvm.ReadHeaderFromPath(path)
+	assert.Nil(t, err)
+	assert.Equal(t, nvm.MINOR_VERSION_CRC32C, header2.MinorVersion)
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	for i, want := range []string{"old", "embed", "new"} {
+		data, err := storage.Get(lumpidnum(i + 1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(want), data)
+	}
+	storage.Close()
+}
+
+func TestStorageUpgradeLumpMetaRecords(t *testing.T) {
+	path := "upgrade-meta.lusf"
+	defer os.Remove(path)
+	lumpMeta := func(storage *Storage) bool {
+		header := storage.Header()
+		return header.HasLumpMetaRecords()
+	}
+	storage, err := CreateCannylsStorage(path, 10<<20, 0.01)
+	assert.Nil(t, err)
+	assert.True(t, lumpMeta(storage))
+	assert.Nil(t, storage.Close())
+
+	//format it again as a storage of the mirrored header
+	file, header, err := nvm.Open(path)
+	assert.Nil(t, err)
+	header.MinorVersion = nvm.MINOR_VERSION_LUMP_META - 1
+	buf := new(bytes.Buffer)
+	assert.Nil(t, header.WriteHeaderRegionTo(buf))
+	journal.InitialJournalRegion(buf, header.BlockSize, journal.HeadSector, header.JournalRegionSize)
+	assert.Nil(t, writeAlignedAt(file, buf.Bytes(), 0))
+	file.Close()
+
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpidnum(1), dataFromBytes([]byte("plain")))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(2), []byte("embed"))
+	assert.Nil(t, err)
+	assert.False(t, lumpMeta(storage))
+
+	//the first record of the lump meta upgrades the header
+	_, err = storage.PutWithMeta(lumpidnum(3), dataFromBytes([]byte("meta")), lump.LumpMeta{Owner: "alice"})
+	assert.Nil(t, err)
+	assert.True(t, lumpMeta(storage))
+	assert.Nil(t, storage.Close())
+
+	header2, err := nvm.ReadHeaderFromPath(path)
+	assert.Nil(t, err)
+	assert.Equal(t, nvm.MINOR_VERSION_LUMP_META, header2.MinorVersion)
+	assert.Equal(t, header.RegionSize(), header2.RegionSize())
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	defer storage.Close()
+	meta, err := storage.GetMeta(lumpidnum(3))
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", meta.Owner)
+	data, err := storage.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plain"), data)
+}
+
+func TestStorageTornHeader(t *testing.T) {
+	path := "torn-header.lusf"
+	defer os.Remove(path)
+	storage, err := CreateCannylsStorage(path, 1<<20, 0.1)
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(1), []byte("header"))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Close())
+
+	//a torn write of the first copy of the header
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("torn"), 16)
+	assert.Nil(t, err)
+	f.Close()
+
+	storage, err = OpenCannylsStorage(path)
+	assert.Nil(t, err)
+	data, err := storage.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("header"), data)
+	storage.Close()
+}